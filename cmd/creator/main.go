@@ -1,103 +1,100 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/ncruces/zenity"
+	"io/fs"
 	"log"
+	"math"
 	"mesh-levelling/pkg/bltouch"
 	"mesh-levelling/pkg/mesh"
 	"mesh-levelling/pkg/printer"
+	"mesh-levelling/pkg/probing"
+	"mesh-levelling/pkg/profile"
+	"mesh-levelling/pkg/session"
 	"os"
+	"strconv"
 )
 
-type MeshCreationParameters struct {
-	MinX                    float64
-	MinY                    float64
-	MaxX                    float64
-	MaxY                    float64
-	NumberOfPointsPerSide   uint8
-	NumberOfRepeatsPerPoint uint8
-}
-
 func main() {
+	profileFilename := flag.String("profile", profile.DefaultFilename, "printer profile to probe with")
+	repeatability := flag.Int("repeatability", 0, "instead of creating a mesh, probe one point this many times and report the statistics, like M48")
+	repeatabilityX := flag.Float64("x", math.NaN(), "X of the point for -repeatability, the centre of the bed by default")
+	repeatabilityY := flag.Float64("y", math.NaN(), "Y of the point for -repeatability, the centre of the bed by default")
+	sessionFilename := flag.String("session", session.DefaultFilename, "file that probing progress is saved to, so that it can be resumed if it is interrupted")
+	restart := flag.Bool("restart", false, "discard any interrupted probing session instead of resuming it")
+	adaptive := flag.Bool("adaptive", false, "after probing the layout in the profile, add points where they improve the mesh the most")
+	gcodeFilename := flag.String("gcode", "", "only probe the area of the bed that this gcode file prints on, and merge the points into an existing mesh")
+	flag.Parse()
+
+	printerProfile, err := profile.Load(*profileFilename)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No printer profile found at %s, using the default profile\n", *profileFilename)
+		printerProfile = profile.Default()
+	} else if err != nil {
+		panic(err)
+	}
+
 	log.Println("Connecting to printer...")
-	printer, err := printer.NewPrinter("HarryPrinter:8899")
+	printer, err := printer.NewPrinter(printerProfile)
 	if err != nil {
 		panic(err)
 	}
 	defer printer.Close()
 
 	log.Println("Connecting to BLTouch...")
-	bltouch, err := bltouch.NewBLTouch("HarryUnoWifiRev2.lan:9988")
+	bltouch, err := bltouch.NewBLTouch(printerProfile)
 	if err != nil {
 		panic(err)
 	}
 	defer bltouch.Close()
 
-	mcp := MeshCreationParameters{
-		MinX:                    -75,
-		MinY:                    -75,
-		MaxX:                    75,
-		MaxY:                    75,
-		NumberOfPointsPerSide:   7,
-		NumberOfRepeatsPerPoint: 1,
+	// Testing repeatability doesn't create a mesh, so it doesn't need a grid or a session
+	if *repeatability > 0 {
+		x, y := printerProfile.BedCentre()
+		if !math.IsNaN(*repeatabilityX) {
+			x = *repeatabilityX
+		}
+		if !math.IsNaN(*repeatabilityY) {
+			y = *repeatabilityY
+		}
+		start(printer)
+		statistics, err := probing.MeasureRepeatability(printer, bltouch, x, y, *repeatability)
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Repeatability:", statistics)
+		return
 	}
 
-	meshPoints := make([]mesh.Point, 0, mcp.NumberOfPointsPerSide*mcp.NumberOfPointsPerSide)
-	var averageZ float64
-	var averageZCount uint
-
-	log.Println("Ready to start. MAKE SURE THE PRINTER HAS BEEN HOMED!!!")
-	log.Print("Press enter to start:")
-	_, _ = fmt.Scanln()
-
-	log.Println("Starting...")
-	if err := printer.StartingPosition(); err != nil {
-		panic(err)
+	mcp, err := probing.Grid(printerProfile, *gcodeFilename)
+	if err != nil {
+		log.Fatalln(err)
 	}
-	reverseYDirection := false
-	numberOfPoints := mcp.NumberOfPointsPerSide * mcp.NumberOfPointsPerSide * mcp.NumberOfRepeatsPerPoint
-	numberOfPointsDone := 0
-	printProgress := func() {
-		numberOfPointsDone++
-		log.Printf("%.1f%%\r\n", float64(numberOfPointsDone)/float64(numberOfPoints)*100.0)
-	}
-	for xIndex := uint8(0); xIndex < mcp.NumberOfPointsPerSide; xIndex++ {
-		xCoordinate := mcp.MinX + ((mcp.MaxX - mcp.MinX) * (float64(xIndex) / float64(mcp.NumberOfPointsPerSide-1)))
-		for yIndex := uint8(0); yIndex < mcp.NumberOfPointsPerSide; yIndex++ {
-			var actualYIndex uint8
-			if reverseYDirection {
-				actualYIndex = mcp.NumberOfPointsPerSide - 1 - yIndex
-			} else {
-				actualYIndex = yIndex
-			}
-			yCoordinate := mcp.MinY + ((mcp.MaxY - mcp.MinY) * (float64(actualYIndex) / float64(mcp.NumberOfPointsPerSide-1)))
-			var z float64
-			for i := uint8(0); i < mcp.NumberOfRepeatsPerPoint; i++ {
-				log.Println("X:", xCoordinate, "Y:", yCoordinate)
-				newZ, err := bltouch.GetZAtPoint(printer, xCoordinate, yCoordinate)
-				if err != nil {
-					panic(err)
-				}
-				z += newZ
-				printProgress()
+	probingSession, err := probing.LoadSession(*sessionFilename, mcp, *restart)
+	if err != nil {
+		log.Fatalf("%v, use -restart to discard it\n", err)
+	}
+	if probingSession == nil {
+		log.Print("Bed temperature (leave empty if unknown):")
+		var bedTemperature float64
+		var bedTemperatureText string
+		_, _ = fmt.Scanln(&bedTemperatureText)
+		if bedTemperatureText != "" {
+			bedTemperature, err = strconv.ParseFloat(bedTemperatureText, 64)
+			if err != nil {
+				panic(err)
 			}
-			z /= float64(mcp.NumberOfRepeatsPerPoint)
-			meshPoint := mesh.Point{X: xCoordinate, Y: yCoordinate, Z: z}
-			meshPoints = append(meshPoints, meshPoint)
-			averageZ += z
-			averageZCount++
 		}
-		reverseYDirection = !reverseYDirection
+		probingSession = session.New(*sessionFilename, mcp, bedTemperature)
 	}
 
-	averageZ /= float64(averageZCount)
-
-	resultingMesh := mesh.Mesh{
-		BLTouchHeight:   averageZ,
-		Points:          meshPoints,
-		Interpolator:    nil,
-		MaterialOffsets: make(map[string]float64),
+	start(printer)
+	resultingMesh, err := probing.ProbeMesh(printer, bltouch, printerProfile, probingSession, *adaptive)
+	if err != nil {
+		panic(err)
 	}
 
 	openMeshConfig := []zenity.Option{
@@ -117,7 +114,24 @@ func main() {
 				log.Fatalln("Could not back up mesh")
 			}
 			oldMesh, err := mesh.LoadMesh(file)
-			if err == nil {
+			if err == nil && *gcodeFilename != "" {
+				// Only the print area was probed, so the rest of the existing mesh is kept
+				printArea := mesh.Bounds{MinX: mcp.MinX, MinY: mcp.MinY, MaxX: mcp.MaxX, MaxY: mcp.MaxY}
+				if err := oldMesh.MergePoints(resultingMesh.Points, printArea); err != nil {
+					panic(err)
+				}
+				oldMesh.Metadata.ProbeDate = resultingMesh.Metadata.ProbeDate
+
+				if err := mesh.SaveMesh(oldMesh, file); err != nil {
+					panic(err)
+				}
+				if err := probingSession.Finish(); err != nil {
+					log.Println("Could not delete the probing session:", err)
+				}
+
+				log.Println("Complete! Print area merged into the mesh.")
+				return
+			} else if err == nil {
 				// Update the existing mesh's BLTouchHeight FIRST before updating the mesh points
 				// Find a common point between the two meshes
 				commonPointFound := false
@@ -143,15 +157,19 @@ func main() {
 						oldAverageZ += oldMesh.Points[i].Z
 					}
 					oldAverageZ /= float64(len(oldMesh.Points))
-					oldMesh.BLTouchHeight += oldAverageZ - averageZ
+					oldMesh.BLTouchHeight += oldAverageZ - resultingMesh.BLTouchHeight
 				}
 
 				// Update existing mesh points
-				oldMesh.Points = resultingMesh.Points
+				oldMesh.SetPoints(resultingMesh.Points)
+				oldMesh.Metadata = resultingMesh.Metadata
 
 				if err := mesh.SaveMesh(oldMesh, file); err != nil {
 					panic(err)
 				}
+				if err := probingSession.Finish(); err != nil {
+					log.Println("Could not delete the probing session:", err)
+				}
 
 				log.Println("Complete! Mesh Updated.")
 				return
@@ -162,13 +180,31 @@ func main() {
 		break
 	}
 
-	if err := mesh.SaveMesh(&resultingMesh, "newMesh.mesh"); err != nil {
+	if *gcodeFilename != "" {
+		log.Println("Warning: the new mesh only covers the print area")
+	}
+	if err := mesh.SaveMesh(resultingMesh, "newMesh.mesh"); err != nil {
 		panic(err)
 	}
+	if err := probingSession.Finish(); err != nil {
+		log.Println("Could not delete the probing session:", err)
+	}
 
 	log.Println("Complete! Mesh Created.")
 }
 
+// start waits for the user to confirm that the printer is ready, and then moves it to the starting position.
+func start(printer printer.Printer) {
+	log.Println("Ready to start. MAKE SURE THE PRINTER HAS BEEN HOMED!!!")
+	log.Print("Press enter to start:")
+	_, _ = fmt.Scanln()
+
+	log.Println("Starting...")
+	if err := printer.StartingPosition(); err != nil {
+		panic(err)
+	}
+}
+
 func copyFile(from, to string) error {
 	data, err := os.ReadFile(from)
 	if err != nil {
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mesh-levelling/pkg/mesh"
+	"mesh-levelling/pkg/postprocess"
+	"os"
+	"path/filepath"
+)
+
+const (
+	exitFailure = 1 // One or more files could not be processed
+	exitUsage   = 2 // The command line was invalid
+)
+
+const usage = `Usage:
+  mesh-level process --mesh bed.mesh [--material PLA] [options] input... [-o output]
+  mesh-level file.gcode
+
+Levels gcode files using a mesh. Inputs can be files, glob patterns, or - for stdin.
+With a single input, -o is the output file (- for stdout). With multiple inputs, -o
+is a directory. Without -o, each output is written next to its input with an _ML suffix.
+Without --material, the material is detected from the slicer's comments in each file.
+
+The second form is for use as a slicer post-processing script. The file is levelled
+in place using the mesh in mesh-level.json next to the executable (or in $MESH_LEVEL_CONFIG),
+with the material from the slicer if it provides one.
+
+Options:
+`
+
+func main() {
+	log.SetFlags(0)
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command with the arguments after the executable's name, and returns the exit code.
+func run(arguments []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if filename, ok := postprocess.Detect(arguments); ok {
+		// We have been run as a slicer post-processing script
+		config, err := postprocess.LoadConfig()
+		if err == nil {
+			err = postprocess.Run(filename, config)
+		}
+		if err != nil {
+			log.Println("Post-processing failed:", err)
+			return exitFailure
+		}
+		return 0
+	}
+	if len(arguments) < 1 || arguments[0] != "process" {
+		fmt.Fprint(stderr, usage)
+		flags := newProcessFlags()
+		flags.SetOutput(stderr)
+		flags.PrintDefaults()
+		return exitUsage
+	}
+	return process(arguments[1:], stdin, stdout, stderr)
+}
+
+type processFlags struct {
+	*flag.FlagSet
+	meshFilename         string
+	material             string
+	fallbackMaterial     string
+	output               string
+	compensateExtrusion  bool
+	maximumMeshDeviation float64
+	minimumSegmentLength float64
+}
+
+func newProcessFlags() *processFlags {
+	flags := processFlags{FlagSet: flag.NewFlagSet("process", flag.ContinueOnError)}
+	flags.StringVar(&flags.meshFilename, "mesh", "", "mesh file to level with (required)")
+	flags.StringVar(&flags.material, "material", "", "material being printed, which must be in the mesh (detected from each file if not given, but only from before the first move when reading from a pipe)")
+	flags.StringVar(&flags.fallbackMaterial, "fallback-material", "", "material to use when it can't be detected")
+	flags.StringVar(&flags.output, "o", "", "output file, or directory when there are multiple inputs")
+	flags.BoolVar(&flags.compensateExtrusion, "compensate-extrusion", false, "increase extrusion and speed to make up for Z added by the mesh")
+	flags.Float64Var(&flags.maximumMeshDeviation, "max-deviation", mesh.MaximumMeshDeviation, "maximum distance in mm that moves may deviate from the mesh")
+	flags.Float64Var(&flags.minimumSegmentLength, "min-segment-length", mesh.MinimumSegmentLength, "minimum length in mm of the segments that moves are split into")
+	return &flags
+}
+
+// parse parses flags that may be mixed in with the positional arguments, eg. "in.gx -o out.gx".
+func (flags *processFlags) parse(arguments []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(arguments); err != nil {
+			return nil, err
+		}
+		arguments = flags.Args()
+		if len(arguments) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, arguments[0])
+		arguments = arguments[1:]
+	}
+}
+
+func process(arguments []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := newProcessFlags()
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	inputPatterns, err := flags.parse(arguments)
+	if err != nil {
+		return exitUsage
+	}
+	if flags.meshFilename == "" || len(inputPatterns) == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	var inputs []string
+	for _, pattern := range inputPatterns {
+		if pattern == "-" {
+			inputs = append(inputs, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Printf("Invalid pattern %s: %v\n", pattern, err)
+			return exitUsage
+		}
+		if len(matches) == 0 {
+			log.Printf("No files match %s\n", pattern)
+			return exitFailure
+		}
+		inputs = append(inputs, matches...)
+	}
+
+	outputs := make([]string, len(inputs))
+	for i, input := range inputs {
+		switch {
+		case len(inputs) == 1 && flags.output != "":
+			outputs[i] = flags.output
+		case input == "-":
+			outputs[i] = "-"
+		case flags.output != "":
+			if flags.output == "-" {
+				log.Println("Only a single input can be written to stdout")
+				return exitUsage
+			}
+			outputs[i] = filepath.Join(flags.output, filepath.Base(mesh.LevelledFilename(input)))
+		default:
+			outputs[i] = mesh.LevelledFilename(input)
+		}
+	}
+	if len(inputs) > 1 && flags.output != "" {
+		if info, err := os.Stat(flags.output); err != nil || !info.IsDir() {
+			log.Printf("%s must be a directory when there are multiple inputs\n", flags.output)
+			return exitUsage
+		}
+	}
+
+	bedMesh, err := mesh.LoadMesh(flags.meshFilename)
+	if err != nil {
+		log.Printf("Could not load mesh %s: %v\n", flags.meshFilename, err)
+		return exitFailure
+	}
+	options := mesh.ProcessOptions{
+		Material:             flags.material,
+		FallbackMaterial:     flags.fallbackMaterial,
+		CompensateExtrusion:  flags.compensateExtrusion,
+		MaximumMeshDeviation: flags.maximumMeshDeviation,
+		MinimumSegmentLength: flags.minimumSegmentLength,
+	}
+
+	exitCode := 0
+	for i, input := range inputs {
+		if err := processFile(input, outputs[i], stdin, stdout, bedMesh, options); err != nil {
+			log.Printf("Could not process %s: %v\n", input, err)
+			exitCode = exitFailure
+			continue
+		}
+		if outputs[i] != "-" {
+			log.Printf("Processed %s -> %s\n", input, outputs[i])
+		}
+	}
+	return exitCode
+}
+
+// processFile processes a single file, where - is stdin or stdout.
+func processFile(input, output string, stdin io.Reader, stdout io.Writer, bedMesh *mesh.Mesh, options mesh.ProcessOptions) error {
+	if input != "-" && output != "-" {
+		return mesh.ProcessFile(input, output, bedMesh, options)
+	}
+
+	reader := stdin
+	if input != "-" {
+		file, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+	if output == "-" {
+		return mesh.Process(reader, stdout, bedMesh, options)
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := mesh.Process(reader, file, bedMesh, options); err != nil {
+		return errors.Join(err, file.Close(), os.Remove(output))
+	}
+	return file.Close()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"mesh-levelling/pkg/mesh"
+	"mesh-levelling/pkg/postprocess"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testGcode        = "G28\nG90\nG1 X10 Y10 Z5\n"
+	levelledPLA      = "G28\nG90\nG1 X10 Y10 Z5.1\n"
+	levelledPETG     = "G28\nG90\nG1 X10 Y10 Z5.3\n"
+	testMeshFilename = "bed.mesh"
+)
+
+// saveTestMesh saves a flat mesh where PLA is offset by 0.1mm and PETG by 0.3mm, so the material that was used can be told from the output.
+func saveTestMesh(t *testing.T, directory string) string {
+	t.Helper()
+	testMesh := &mesh.Mesh{
+		Points:    []mesh.Point{{X: 0, Y: 0}, {X: 0, Y: 100}, {X: 100, Y: 0}, {X: 100, Y: 100}},
+		Materials: map[string]mesh.MaterialProfile{"PLA": {ZOffset: 0.1}, "PETG": {ZOffset: 0.3}},
+	}
+	filename := filepath.Join(directory, testMeshFilename)
+	if err := mesh.SaveMesh(testMesh, filename); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func writeFile(t *testing.T, filename, contents string) string {
+	t.Helper()
+	if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func checkFile(t *testing.T, name, filename, want string) {
+	t.Helper()
+	if got, err := os.ReadFile(filename); err != nil || string(got) != want {
+		t.Errorf("%s: %s is %q (%v), want %q", name, filepath.Base(filename), got, err, want)
+	}
+}
+
+type result struct {
+	exitCode int
+	stdout   string
+	// Both the usage and what is logged
+	stderr string
+}
+
+// runCommand runs the command as if from the command line, with stdin as its input.
+func runCommand(arguments []string, stdin string) result {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	writer := log.Writer()
+	log.SetOutput(stderr)
+	defer log.SetOutput(writer)
+	exitCode := run(arguments, strings.NewReader(stdin), stdout, stderr)
+	return result{exitCode, stdout.String(), stderr.String()}
+}
+
+func TestRunUsage(t *testing.T) {
+	directory := t.TempDir()
+	meshFilename := saveTestMesh(t, directory)
+	inputFilename := writeFile(t, filepath.Join(directory, "print.gcode"), testGcode)
+	tests := []struct {
+		name      string
+		arguments []string
+		want      string
+	}{
+		{"no arguments", nil, "Usage:"},
+		{"unknown command", []string{"level"}, "Usage:"},
+		{"no mesh", []string{"process", inputFilename}, "Usage:"},
+		{"no inputs", []string{"process", "--mesh", meshFilename}, "Usage:"},
+		{"unknown flag", []string{"process", "--mesh", meshFilename, "--fast", inputFilename}, "flag provided but not defined: -fast"},
+		{"invalid pattern", []string{"process", "--mesh", meshFilename, filepath.Join(directory, "[")}, "Invalid pattern"},
+		{"several inputs to stdout", []string{"process", "--mesh", meshFilename, "-o", "-", inputFilename, inputFilename}, "Only a single input can be written to stdout"},
+		{"several inputs to a file", []string{"process", "--mesh", meshFilename, "-o", inputFilename, inputFilename, inputFilename}, "must be a directory when there are multiple inputs"},
+	}
+	for _, test := range tests {
+		result := runCommand(test.arguments, "")
+		if result.exitCode != exitUsage || !strings.Contains(result.stderr, test.want) {
+			t.Errorf("%s: exit code %d with %q, want %d with %q", test.name, result.exitCode, result.stderr, exitUsage, test.want)
+		}
+	}
+	checkFile(t, "usage", inputFilename, testGcode)
+}
+
+func TestRunFailure(t *testing.T) {
+	directory := t.TempDir()
+	meshFilename := saveTestMesh(t, directory)
+	inputFilename := writeFile(t, filepath.Join(directory, "print.gcode"), testGcode)
+	tests := []struct {
+		name      string
+		arguments []string
+		want      string
+	}{
+		{"missing mesh", []string{"process", "--mesh", filepath.Join(directory, "missing.mesh"), inputFilename}, "Could not load mesh"},
+		{"no matching files", []string{"process", "--mesh", meshFilename, filepath.Join(directory, "*.gx")}, "No files match"},
+		{"unknown material", []string{"process", "--mesh", meshFilename, "--material", "TPU", inputFilename}, "Could not process"},
+		{"undetected material", []string{"process", "--mesh", meshFilename, inputFilename}, "Could not process"},
+	}
+	for _, test := range tests {
+		result := runCommand(test.arguments, "")
+		if result.exitCode != exitFailure || !strings.Contains(result.stderr, test.want) {
+			t.Errorf("%s: exit code %d with %q, want %d with %q", test.name, result.exitCode, result.stderr, exitFailure, test.want)
+		}
+	}
+	if _, err := os.Stat(mesh.LevelledFilename(inputFilename)); !os.IsNotExist(err) {
+		t.Errorf("an output was written for a file that failed: %v", err)
+	}
+
+	// The other files are still processed when one fails
+	otherFilename := writeFile(t, filepath.Join(directory, "other.gcode"), testGcode)
+	missingFilename := filepath.Join(directory, "missing.gcode")
+	writeFile(t, inputFilename, "; filament_type = PLA\n"+testGcode)
+	writeFile(t, otherFilename, "; filament_type = TPU\n"+testGcode)
+	result := runCommand([]string{"process", "--mesh", meshFilename, "-o", t.TempDir(), inputFilename, otherFilename}, "")
+	if result.exitCode != exitFailure || !strings.Contains(result.stderr, "Could not process "+otherFilename) || !strings.Contains(result.stderr, "Processed "+inputFilename) {
+		t.Errorf("exit code %d with %q, want one file processed and one failure", result.exitCode, result.stderr)
+	}
+	if result := runCommand([]string{"process", "--mesh", meshFilename, "--material", "PLA", missingFilename}, ""); result.exitCode != exitFailure {
+		t.Errorf("exit code %d for a missing file, want %d", result.exitCode, exitFailure)
+	}
+}
+
+func TestRunProcess(t *testing.T) {
+	directory := t.TempDir()
+	meshFilename := saveTestMesh(t, directory)
+	inputFilename := writeFile(t, filepath.Join(directory, "print.gcode"), testGcode)
+
+	// Without -o, the output is next to the input
+	result := runCommand([]string{"process", "--mesh", meshFilename, "--material", "PLA", inputFilename}, "")
+	if result.exitCode != 0 {
+		t.Fatalf("exit code %d with %q", result.exitCode, result.stderr)
+	}
+	checkFile(t, "next to the input", filepath.Join(directory, "print_ML.g"), levelledPLA)
+	checkFile(t, "next to the input", inputFilename, testGcode)
+
+	// Flags can come after the inputs
+	outputFilename := filepath.Join(directory, "out.gx")
+	if result := runCommand([]string{"process", inputFilename, "--mesh", meshFilename, "-o", outputFilename, "--material", "PETG"}, ""); result.exitCode != 0 {
+		t.Fatalf("exit code %d with %q", result.exitCode, result.stderr)
+	}
+	checkFile(t, "-o file", outputFilename, levelledPETG)
+
+	// The material is detected from each file
+	writeFile(t, inputFilename, "; filament_type = PETG\n"+testGcode)
+	if result := runCommand([]string{"process", "--mesh", meshFilename, "-o", outputFilename, inputFilename}, ""); result.exitCode != 0 {
+		t.Fatalf("exit code %d with %q", result.exitCode, result.stderr)
+	}
+	checkFile(t, "detected material", outputFilename, "; filament_type = PETG\n"+levelledPETG)
+	if result := runCommand([]string{"process", "--mesh", meshFilename, "--fallback-material", "PLA", "-o", outputFilename, writeFile(t, inputFilename, testGcode)}, ""); result.exitCode != 0 {
+		t.Fatalf("exit code %d with %q", result.exitCode, result.stderr)
+	}
+	checkFile(t, "fallback material", outputFilename, levelledPLA)
+}
+
+func TestRunGlob(t *testing.T) {
+	directory := t.TempDir()
+	meshFilename := saveTestMesh(t, directory)
+	inputDirectory := filepath.Join(directory, "prints")
+	if err := os.Mkdir(inputDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.gcode", "b.gcode", "c.gx", "notes.txt"} {
+		writeFile(t, filepath.Join(inputDirectory, name), testGcode)
+	}
+
+	// Each pattern is expanded, and the outputs go in the -o directory
+	outputDirectory := t.TempDir()
+	result := runCommand([]string{"process", "--mesh", meshFilename, "--material", "PLA", "-o", outputDirectory, filepath.Join(inputDirectory, "*.gcode"), filepath.Join(inputDirectory, "c.g?")}, "")
+	if result.exitCode != 0 {
+		t.Fatalf("exit code %d with %q", result.exitCode, result.stderr)
+	}
+	for _, name := range []string{"a_ML.g", "b_ML.g", "c_ML.gx"} {
+		checkFile(t, "glob", filepath.Join(outputDirectory, name), levelledPLA)
+	}
+	if entries, err := os.ReadDir(outputDirectory); err != nil || len(entries) != 3 {
+		t.Errorf("the output directory has %d files (%v), want 3", len(entries), err)
+	}
+}
+
+func TestRunStdinAndStdout(t *testing.T) {
+	directory := t.TempDir()
+	meshFilename := saveTestMesh(t, directory)
+	inputFilename := writeFile(t, filepath.Join(directory, "print.gcode"), testGcode)
+
+	// Only the metadata before the first move can be read from stdin, which is enough here
+	result := runCommand([]string{"process", "--mesh", meshFilename, "-"}, "; filament_type = PETG\n"+testGcode)
+	if result.exitCode != 0 || result.stdout != "; filament_type = PETG\n"+levelledPETG {
+		t.Errorf("stdin to stdout: exit code %d with %q, output %q", result.exitCode, result.stderr, result.stdout)
+	}
+	if strings.Contains(result.stderr, "Processed") {
+		t.Errorf("stdin to stdout: logged %q, which isn't needed when writing to stdout", result.stderr)
+	}
+
+	result = runCommand([]string{"process", "--mesh", meshFilename, "--material", "PLA", "-o", "-", inputFilename}, "")
+	if result.exitCode != 0 || result.stdout != levelledPLA {
+		t.Errorf("file to stdout: exit code %d with %q, output %q", result.exitCode, result.stderr, result.stdout)
+	}
+
+	outputFilename := filepath.Join(directory, "out.gcode")
+	result = runCommand([]string{"process", "--mesh", meshFilename, "--material", "PLA", "-o", outputFilename, "-"}, testGcode)
+	if result.exitCode != 0 || result.stdout != "" {
+		t.Errorf("stdin to file: exit code %d with %q, output %q", result.exitCode, result.stderr, result.stdout)
+	}
+	checkFile(t, "stdin to file", outputFilename, levelledPLA)
+
+	// A failure doesn't leave a partial output file behind
+	os.Remove(outputFilename)
+	result = runCommand([]string{"process", "--mesh", meshFilename, "-o", outputFilename, "-"}, testGcode)
+	if result.exitCode != exitFailure {
+		t.Errorf("stdin without a material: exit code %d, want %d", result.exitCode, exitFailure)
+	}
+	if _, err := os.Stat(outputFilename); !os.IsNotExist(err) {
+		t.Errorf("the output of a failure was kept: %v", err)
+	}
+}
+
+func TestRunPostProcessing(t *testing.T) {
+	for _, key := range []string{"SLIC3R_PP_OUTPUT_NAME", "SLIC3R_FILAMENT_TYPE", "SLIC3R_TEMPERATURE"} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+	directory := t.TempDir()
+	saveTestMesh(t, directory)
+	configFilename := writeFile(t, filepath.Join(directory, postprocess.ConfigFilename), `{"Mesh": "`+testMeshFilename+`", "Material": "PLA"}`)
+	t.Setenv(postprocess.ConfigEnvironmentVariable, configFilename)
+
+	// A slicer runs us with just the file, which is levelled in place
+	inputFilename := writeFile(t, filepath.Join(directory, "print.gcode"), testGcode)
+	if result := runCommand([]string{inputFilename}, ""); result.exitCode != 0 {
+		t.Fatalf("exit code %d with %q", result.exitCode, result.stderr)
+	}
+	checkFile(t, "post-processing", inputFilename, levelledPLA)
+
+	// PrusaSlicer says which material it is printing with
+	t.Setenv("SLIC3R_FILAMENT_TYPE", "PETG")
+	writeFile(t, inputFilename, testGcode)
+	if result := runCommand([]string{inputFilename}, ""); result.exitCode != 0 {
+		t.Fatalf("exit code %d with %q", result.exitCode, result.stderr)
+	}
+	checkFile(t, "post-processing from PrusaSlicer", inputFilename, levelledPETG)
+
+	// Without a config, the file is left as it is
+	t.Setenv(postprocess.ConfigEnvironmentVariable, filepath.Join(directory, "missing.json"))
+	writeFile(t, inputFilename, testGcode)
+	if result := runCommand([]string{inputFilename}, ""); result.exitCode != exitFailure || !strings.Contains(result.stderr, "Post-processing failed") {
+		t.Errorf("exit code %d with %q, want %d", result.exitCode, result.stderr, exitFailure)
+	}
+	checkFile(t, "post-processing without a config", inputFilename, testGcode)
+}
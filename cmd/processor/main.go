@@ -8,7 +8,9 @@ import (
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/widget"
 	"github.com/ncruces/zenity"
+	"log"
 	. "mesh-levelling/pkg/mesh"
+	"mesh-levelling/pkg/postprocess"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -50,7 +52,58 @@ func textPrompt(app fyne.App, title, prompt string) <-chan string {
 	return channel
 }
 
+// formatBedTemperatureOffsets formats bed temperature offsets as eg. "60:0.020, 80:0.050".
+func formatBedTemperatureOffsets(offsets []BedTemperatureOffset) string {
+	var parts []string
+	for _, offset := range offsets {
+		parts = append(parts, strconv.FormatFloat(offset.BedTemperature, 'f', -1, 64)+":"+strconv.FormatFloat(offset.ZOffset, 'f', 3, 64))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseBedTemperatureOffsets parses the output of formatBedTemperatureOffsets.
+func parseBedTemperatureOffsets(text string) ([]BedTemperatureOffset, error) {
+	var offsets []BedTemperatureOffset
+	for _, part := range strings.Split(text, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		temperature, offset, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, errors.New("bed temperature offsets must be in the form temperature:offset, eg. 60:0.02")
+		}
+		bedTemperature, err := strconv.ParseFloat(strings.TrimSpace(temperature), 64)
+		if err != nil {
+			return nil, err
+		}
+		zOffset, err := strconv.ParseFloat(strings.TrimSpace(offset), 64)
+		if err != nil {
+			return nil, err
+		}
+		offsets = append(offsets, BedTemperatureOffset{BedTemperature: bedTemperature, ZOffset: zOffset})
+	}
+	return offsets, nil
+}
+
+// postProcess levels a file in place when we have been run as a slicer post-processing script, and exits.
+func postProcess(filename string) {
+	config, err := postprocess.LoadConfig()
+	if err == nil {
+		err = postprocess.Run(filename, config)
+	}
+	if err != nil {
+		log.Println("Post-processing failed:", err)
+		_ = zenity.Error("Post-processing failed: "+err.Error(), zenity.Title("Mesh Leveller"))
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 func main() {
+	if filename, ok := postprocess.Detect(os.Args[1:]); ok {
+		postProcess(filename)
+	}
+
 	a := app.New()
 	w := a.NewWindow("Mesh Leveller")
 	w.Resize(fyne.NewSize(512, 256))
@@ -64,40 +117,74 @@ func main() {
 	var selectedMaterial string
 
 	materialOffsetTextBox := widget.NewEntry()
+	materialSquishTextBox := widget.NewEntry()
+	materialFadeHeightTextBox := widget.NewEntry()
+	materialBedTemperatureOffsetsTextBox := widget.NewEntry()
+	materialBedTemperatureOffsetsTextBox.SetPlaceHolder("60:0.02, 80:0.05")
 	blTouchHeightTextBox := widget.NewEntry()
+	fadeStartHeightTextBox := widget.NewEntry()
+	fadeHeightTextBox := widget.NewEntry()
+	var fadeCurves []string
+	for _, fadeCurve := range FadeCurves {
+		fadeCurves = append(fadeCurves, string(fadeCurve))
+	}
+	fadeCurveSelector := widget.NewSelect(fadeCurves, nil)
+	var interpolationMethods []string
+	for _, interpolationMethod := range InterpolationMethods {
+		interpolationMethods = append(interpolationMethods, string(interpolationMethod))
+	}
+	interpolationSelector := widget.NewSelect(interpolationMethods, nil)
+	var extrapolationPolicies []string
+	for _, extrapolationPolicy := range ExtrapolationPolicies {
+		extrapolationPolicies = append(extrapolationPolicies, string(extrapolationPolicy))
+	}
+	extrapolationSelector := widget.NewSelect(extrapolationPolicies, nil)
 	materialSelector := widget.NewSelect([]string{}, func(newOption string) {
 		selectedMaterial = newOption
-		materialOffset, ok := currentMesh.MaterialOffsets[selectedMaterial]
+		material, ok := currentMesh.Materials[selectedMaterial]
 		if ok {
-			materialOffsetTextBox.Text = strconv.FormatFloat(materialOffset, 'f', 3, 64)
+			materialOffsetTextBox.SetText(strconv.FormatFloat(material.ZOffset, 'f', 3, 64))
+			materialSquishTextBox.SetText(strconv.FormatFloat(material.FirstLayerSquish, 'f', 3, 64))
+			materialFadeHeightTextBox.SetText(strconv.FormatFloat(material.FadeHeight, 'f', 3, 64))
+			materialBedTemperatureOffsetsTextBox.SetText(formatBedTemperatureOffsets(material.BedTemperatureOffsets))
 		} else {
-			materialOffsetTextBox.Text = "Error"
+			materialOffsetTextBox.SetText("Error")
 		}
-		materialOffsetTextBox.Refresh()
 	})
 
+	compensateExtrusionCheck := widget.NewCheck("Compensate Extrusion", nil)
+	// When checked, the selected material is only used if the material can't be detected from the gcode
+	detectMaterialCheck := widget.NewCheck("Detect Material", nil)
+	maximumMeshDeviationTextBox := widget.NewEntry()
+	maximumMeshDeviationTextBox.SetText(strconv.FormatFloat(MaximumMeshDeviation, 'f', 3, 64))
+	minimumSegmentLengthTextBox := widget.NewEntry()
+	minimumSegmentLengthTextBox.SetText(strconv.FormatFloat(MinimumSegmentLength, 'f', 3, 64))
+
 	processButton := widget.NewButton("Process", func() {
 		if currentMesh != nil {
+			maximumMeshDeviation, err := strconv.ParseFloat(maximumMeshDeviationTextBox.Text, 64)
+			if err != nil {
+				dialog.NewError(err, w).Show()
+				return
+			}
+			minimumSegmentLength, err := strconv.ParseFloat(minimumSegmentLengthTextBox.Text, 64)
+			if err != nil {
+				dialog.NewError(err, w).Show()
+				return
+			}
 			fileName, err := zenity.SelectFile(openGCodeConfig...)
 			if err == nil {
-				processedFile, err := ProcessFile(fileName, currentMesh, selectedMaterial)
-				if err != nil {
-					dialog.NewError(err, w).Show()
-					return
-				}
-				extension := filepath.Ext(fileName)
-				fileNameWithoutExtension := strings.TrimSuffix(fileName, extension)
-				if extension != ".gx" {
-					extension = ".g"
+				options := ProcessOptions{
+					Material:             selectedMaterial,
+					CompensateExtrusion:  compensateExtrusionCheck.Checked,
+					MaximumMeshDeviation: maximumMeshDeviation,
+					MinimumSegmentLength: minimumSegmentLength,
 				}
-				newFileName := fileNameWithoutExtension + "_ML" + extension
-				file, err := os.Create(newFileName)
-				if err != nil {
-					dialog.NewError(err, w).Show()
-					return
+				if detectMaterialCheck.Checked {
+					options.Material = ""
+					options.FallbackMaterial = selectedMaterial
 				}
-				defer file.Close()
-				if _, err := file.WriteString(processedFile); err != nil {
+				if err := ProcessFile(fileName, LevelledFilename(fileName), currentMesh, options); err != nil {
 					dialog.NewError(err, w).Show()
 					return
 				} else {
@@ -122,12 +209,29 @@ func main() {
 				currentMeshFilepath = file
 
 				var materials []string
-				for material := range currentMesh.MaterialOffsets {
+				for material := range currentMesh.Materials {
 					materials = append(materials, material)
 				}
 				materialSelector.Options = materials
 				materialSelector.SetSelectedIndex(0)
 				blTouchHeightTextBox.SetText(strconv.FormatFloat(newMesh.BLTouchHeight, 'f', 3, 64))
+				fadeStartHeightTextBox.SetText(strconv.FormatFloat(newMesh.FadeStartHeight, 'f', 3, 64))
+				fadeHeightTextBox.SetText(strconv.FormatFloat(newMesh.FadeHeight, 'f', 3, 64))
+				if newMesh.Interpolation == "" {
+					interpolationSelector.SetSelected(string(DefaultInterpolationMethod(newMesh.Points)))
+				} else {
+					interpolationSelector.SetSelected(string(newMesh.Interpolation))
+				}
+				if newMesh.Extrapolation == "" {
+					extrapolationSelector.SetSelected(string(ExtrapolationClamp))
+				} else {
+					extrapolationSelector.SetSelected(string(newMesh.Extrapolation))
+				}
+				if newMesh.FadeCurve == "" {
+					fadeCurveSelector.SetSelected(string(FadeCurveLinear))
+				} else {
+					fadeCurveSelector.SetSelected(string(newMesh.FadeCurve))
+				}
 
 				loadedLabel.SetText("Mesh Loaded: " + filepath.Base(file))
 				processButton.Enable()
@@ -156,6 +260,79 @@ func main() {
 				}
 			}),
 		),
+		container.NewGridWithColumns(
+			3,
+			widget.NewLabel("Interpolation:"),
+			interpolationSelector,
+			widget.NewButton("Save", func() {
+				if currentMesh != nil && currentMeshFilepath != "" {
+					if err := currentMesh.SetInterpolation(InterpolationMethod(interpolationSelector.Selected)); err != nil {
+						dialog.NewError(err, w).Show()
+						return
+					}
+
+					// Save Mesh
+					if err := SaveMesh(currentMesh, currentMeshFilepath); err != nil {
+						dialog.NewError(err, w).Show()
+						return
+					}
+
+					dialog.NewInformation("Saved", "Interpolation Method Saved.", w).Show()
+				}
+			}),
+			widget.NewLabel("Extrapolation:"),
+			extrapolationSelector,
+			widget.NewButton("Save", func() {
+				if currentMesh != nil && currentMeshFilepath != "" {
+					currentMesh.Extrapolation = ExtrapolationPolicy(extrapolationSelector.Selected)
+
+					// Save Mesh
+					if err := SaveMesh(currentMesh, currentMeshFilepath); err != nil {
+						dialog.NewError(err, w).Show()
+						return
+					}
+
+					dialog.NewInformation("Saved", "Extrapolation Policy Saved.", w).Show()
+				}
+			}),
+		),
+		container.NewGridWithColumns(
+			3,
+			widget.NewLabel("Fade Start Height:"),
+			fadeStartHeightTextBox,
+			fadeCurveSelector,
+			widget.NewLabel("Fade Height:"),
+			fadeHeightTextBox,
+			widget.NewButton("Save", func() {
+				if currentMesh != nil && currentMeshFilepath != "" {
+					newFadeStartHeight, err := strconv.ParseFloat(fadeStartHeightTextBox.Text, 64)
+					if err != nil {
+						dialog.NewError(err, w).Show()
+						return
+					}
+					newFadeHeight, err := strconv.ParseFloat(fadeHeightTextBox.Text, 64)
+					if err != nil {
+						dialog.NewError(err, w).Show()
+						return
+					}
+					if newFadeHeight > 0 && newFadeStartHeight >= newFadeHeight {
+						dialog.NewError(errors.New("fade start height must be below the fade height"), w).Show()
+						return
+					}
+					currentMesh.FadeStartHeight = newFadeStartHeight
+					currentMesh.FadeHeight = newFadeHeight
+					currentMesh.FadeCurve = FadeCurve(fadeCurveSelector.Selected)
+
+					// Save Mesh
+					if err := SaveMesh(currentMesh, currentMeshFilepath); err != nil {
+						dialog.NewError(err, w).Show()
+						return
+					}
+
+					dialog.NewInformation("Saved", "Fade Values Saved.", w).Show()
+				}
+			}),
+		),
 		container.NewGridWithColumns(
 			4,
 			materialSelector,
@@ -168,12 +345,15 @@ func main() {
 				go func() {
 					newMaterialName, ok := <-textPrompt(a, "Prompt", "Material Name:")
 					if ok {
-						for materialName := range currentMesh.MaterialOffsets {
+						for materialName := range currentMesh.Materials {
 							if materialName == newMaterialName {
 								return
 							}
 						}
-						currentMesh.MaterialOffsets[newMaterialName] = 0
+						if currentMesh.Materials == nil {
+							currentMesh.Materials = make(map[string]MaterialProfile)
+						}
+						currentMesh.Materials[newMaterialName] = MaterialProfile{}
 						materialSelector.Options = append(materialSelector.Options, newMaterialName)
 						materialSelector.SetSelectedIndex(0)
 					}
@@ -181,12 +361,42 @@ func main() {
 			}),
 			widget.NewButton("Save", func() {
 				if currentMesh != nil && currentMeshFilepath != "" {
+					oldMaterial, ok := currentMesh.Materials[selectedMaterial]
+					if !ok {
+						dialog.NewError(errors.New("no material selected"), w).Show()
+						return
+					}
 					newMaterialOffset, err := strconv.ParseFloat(materialOffsetTextBox.Text, 64)
 					if err != nil {
 						dialog.NewError(err, w).Show()
 						return
 					}
-					currentMesh.MaterialOffsets[selectedMaterial] = newMaterialOffset
+					newMaterialSquish, err := strconv.ParseFloat(materialSquishTextBox.Text, 64)
+					if err != nil {
+						dialog.NewError(err, w).Show()
+						return
+					}
+					newMaterialFadeHeight, err := strconv.ParseFloat(materialFadeHeightTextBox.Text, 64)
+					if err != nil {
+						dialog.NewError(err, w).Show()
+						return
+					}
+					newBedTemperatureOffsets, err := parseBedTemperatureOffsets(materialBedTemperatureOffsetsTextBox.Text)
+					if err != nil {
+						dialog.NewError(err, w).Show()
+						return
+					}
+					currentMesh.Materials[selectedMaterial] = MaterialProfile{
+						ZOffset:               newMaterialOffset,
+						BedTemperatureOffsets: newBedTemperatureOffsets,
+						FirstLayerSquish:      newMaterialSquish,
+						FadeHeight:            newMaterialFadeHeight,
+					}
+					if err := currentMesh.Validate(); err != nil {
+						currentMesh.Materials[selectedMaterial] = oldMaterial
+						dialog.NewError(err, w).Show()
+						return
+					}
 
 					// Save Mesh
 					if err := SaveMesh(currentMesh, currentMeshFilepath); err != nil {
@@ -194,10 +404,34 @@ func main() {
 						return
 					}
 
-					dialog.NewInformation("Saved", "Material Offset Value Saved.", w).Show()
+					dialog.NewInformation("Saved", "Material Profile Saved.", w).Show()
 				}
 			}),
 		),
+		container.NewGridWithColumns(
+			4,
+			widget.NewLabel("First Layer Squish:"),
+			materialSquishTextBox,
+			widget.NewLabel("Material Fade Height:"),
+			materialFadeHeightTextBox,
+		),
+		container.NewGridWithColumns(
+			2,
+			widget.NewLabel("Bed Temperature Offsets:"),
+			materialBedTemperatureOffsetsTextBox,
+		),
+		container.NewGridWithColumns(
+			4,
+			widget.NewLabel("Max Deviation:"),
+			maximumMeshDeviationTextBox,
+			widget.NewLabel("Min Segment Length:"),
+			minimumSegmentLengthTextBox,
+		),
+		container.NewGridWithColumns(
+			2,
+			compensateExtrusionCheck,
+			detectMaterialCheck,
+		),
 		processButton,
 	))
 
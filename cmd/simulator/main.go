@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"math"
+	"mesh-levelling/pkg/profile"
+	"mesh-levelling/pkg/simulator"
+	"net"
+)
+
+func main() {
+	profileFilename := flag.String("profile", profile.DefaultFilename, "printer profile to simulate the bed, probe offset and Z limits of")
+	printerAddress := flag.String("printer-address", "localhost:8899", "address to serve the printer on, which the profile's PrinterAddress must point to")
+	bltouchAddress := flag.String("bltouch-address", "localhost:9988", "address to serve the BLTouch sensor on, which the profile's BLTouchAddress must point to")
+	height := flag.Float64("height", 0, "Z of the centre of the bed, halfway between the profile's MinimumZ and ProbeStartZ by default")
+	tiltX := flag.Float64("tilt-x", 0.002, "slope of the bed along X in mm per mm")
+	tiltY := flag.Float64("tilt-y", -0.001, "slope of the bed along Y in mm per mm")
+	warp := flag.Float64("warp", 0.15, "how much higher the corners of the bed are than the centre in mm, negative for a dome")
+	noise := flag.Float64("noise", 0.005, "standard deviation of the probe in mm")
+	seed := flag.Int64("seed", 1, "seed for the probe noise")
+	flag.Parse()
+
+	printerProfile, err := profile.Load(*profileFilename)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No printer profile found at %s, using the default profile\n", *profileFilename)
+		printerProfile = profile.Default()
+	} else if err != nil {
+		log.Fatalln(err)
+	}
+
+	bed := simulator.Bed{
+		Height: *height,
+		TiltX:  *tiltX,
+		TiltY:  *tiltY,
+		Warp:   *warp,
+		Noise:  *noise,
+	}
+	if bed.Height == 0 {
+		bed.Height = (printerProfile.MinimumZ + printerProfile.ProbeStartZ) / 2
+	}
+	bed.CentreX, bed.CentreY = printerProfile.BedCentre()
+	minX, minY, _, _ := printerProfile.BedBounds()
+	// The warp is measured at the corners
+	bed.WarpRadius = math.Hypot(bed.CentreX-minX, bed.CentreY-minY)
+	sim := simulator.New(bed, printerProfile, *seed)
+
+	printerListener, err := net.Listen("tcp", *printerAddress)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	bltouchListener, err := net.Listen("tcp", *bltouchAddress)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("Simulating %s with the printer on %s and the BLTouch on %s\n", printerProfile.Name, printerListener.Addr(), bltouchListener.Addr())
+
+	errs := make(chan error, 2)
+	go func() { errs <- sim.ServePrinter(printerListener) }()
+	go func() { errs <- sim.ServeBLTouch(bltouchListener) }()
+	log.Fatalln(<-errs)
+}
@@ -5,9 +5,11 @@ import (
 	"log"
 	"math"
 	. "mesh-levelling/pkg/mesh"
-	"sort"
 )
 
+// The number of lines drawn across the mesh in each direction
+const numberOfLines = 12
+
 func main() {
 	log.Println("Loading Mesh")
 	mesh, err := LoadMesh("newMesh.mesh")
@@ -15,40 +17,60 @@ func main() {
 		panic(err)
 	}
 
-	p := pinhole.New()
-	sort.Slice(mesh.Points, func(i, j int) bool {
-		if mesh.Points[i].X == mesh.Points[j].X {
-			return mesh.Points[i].Y < mesh.Points[j].Y
-		} else {
-			return mesh.Points[i].X < mesh.Points[j].X
-		}
-	})
+	// The points can be in any arrangement, so the interpolated surface is drawn over the area that they cover
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, point := range mesh.Points {
+		minX, minY = math.Min(minX, point.X), math.Min(minY, point.Y)
+		maxX, maxY = math.Max(maxX, point.X), math.Max(maxY, point.Y)
+	}
+	centreX, centreY := (minX+maxX)/2, (minY+maxY)/2
 
+	p := pinhole.New()
 	p.Begin()
-	scale := 1.0 / 150
+	scale := 1.0 / math.Max(maxX-minX, maxY-minY)
 	translateZ := func(z float64) float64 {
 		const zScale = 5.0
-		return (z - mesh.BLTouchHeight) * zScale
+		return z * zScale
 	}
 	log.Println("Scale", scale)
-	numberOfPointsPerSide := int(math.Sqrt(float64(len(mesh.Points))))
-	log.Println("NPPS", numberOfPointsPerSide)
-	for i := 0; i < numberOfPointsPerSide; i++ {
-		for j := 0; j < numberOfPointsPerSide; j++ {
-			point := &mesh.Points[i*numberOfPointsPerSide+j]
-			if i == 0 && j == 0 {
-				p.DrawDot(point.X, point.Y, translateZ(point.Z), 3*scale)
+	log.Println("Points", len(mesh.Points))
+
+	// The surface at each sample, or NaN if the sample is outside of the probed area
+	var surface [numberOfLines + 1][numberOfLines + 1]float64
+	sampleX := func(i int) float64 {
+		return minX + (maxX-minX)*float64(i)/numberOfLines
+	}
+	sampleY := func(j int) float64 {
+		return minY + (maxY-minY)*float64(j)/numberOfLines
+	}
+	for i := range surface {
+		for j := range surface[i] {
+			surface[i][j] = math.NaN()
+			if x, y := sampleX(i), sampleY(j); mesh.IsInMesh(x, y) {
+				if z, err := mesh.BedHeightAtPosition(x, y); err == nil {
+					surface[i][j] = translateZ(z)
+				}
+			}
+		}
+	}
+	for i := range surface {
+		for j := range surface[i] {
+			if math.IsNaN(surface[i][j]) {
+				continue
 			}
-			if i+1 < numberOfPointsPerSide {
-				nextPointX := mesh.Points[(i+1)*numberOfPointsPerSide+j]
-				p.DrawLine(point.X, point.Y, translateZ(point.Z), nextPointX.X, nextPointX.Y, translateZ(nextPointX.Z))
+			if i+1 < len(surface) && !math.IsNaN(surface[i+1][j]) {
+				p.DrawLine(sampleX(i)-centreX, sampleY(j)-centreY, surface[i][j], sampleX(i+1)-centreX, sampleY(j)-centreY, surface[i+1][j])
 			}
-			if j+1 < numberOfPointsPerSide {
-				nextPointY := mesh.Points[i*numberOfPointsPerSide+(j+1)]
-				p.DrawLine(point.X, point.Y, translateZ(point.Z), nextPointY.X, nextPointY.Y, translateZ(nextPointY.Z))
+			if j+1 < len(surface[i]) && !math.IsNaN(surface[i][j+1]) {
+				p.DrawLine(sampleX(i)-centreX, sampleY(j)-centreY, surface[i][j], sampleX(i)-centreX, sampleY(j+1)-centreY, surface[i][j+1])
 			}
 		}
 	}
+	// Mark the probed points
+	for _, point := range mesh.Points {
+		p.DrawDot(point.X-centreX, point.Y-centreY, translateZ(point.Z-mesh.BLTouchHeight), 3*scale)
+	}
 	p.End()
 	p.Scale(scale, scale, scale)
 	//p.Rotate(math.Pi / 4, math.Pi / 4, -math.Pi / 6)
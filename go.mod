@@ -9,6 +9,9 @@ require (
 	github.com/RobinRCM/sklearn v0.0.0-20231219160650-fcddba52fc6b
 	github.com/ncruces/zenity v0.10.12
 	github.com/tidwall/pinhole v0.0.0-20210130162507-d8644a7c3d19
+	golang.org/x/net v0.21.0
+	golang.org/x/sys v0.17.0
+	gonum.org/v1/gonum v0.14.0
 )
 
 require (
@@ -42,10 +45,7 @@ require (
 	github.com/yuin/goldmark v1.7.0 // indirect
 	golang.org/x/image v0.15.0 // indirect
 	golang.org/x/mobile v0.0.0-20240213143359-d1f7d3436075 // indirect
-	golang.org/x/net v0.21.0 // indirect
-	golang.org/x/sys v0.17.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
-	gonum.org/v1/gonum v0.14.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	honnef.co/go/js/dom v0.0.0-20231112215516-51f43a291193 // indirect
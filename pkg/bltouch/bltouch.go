@@ -2,32 +2,26 @@ package bltouch
 
 import (
 	"fmt"
+	"log"
 	"math"
+	"mesh-levelling/pkg/mesh"
 	"mesh-levelling/pkg/printer"
+	"mesh-levelling/pkg/profile"
 	"net"
 	"time"
 )
 
-const (
-	StartZ float64 = 56   // Don't bother going higher than this
-	ZStep  float64 = 0.02 // Number of mm per Z step (resolution)
-	EndZ   float64 = 50   // Don't ever go below this as it could crush the BLTouch
-
-	SpeedXY    = 80 // mm per second
-	SpeedZFast = 16 // mm per second
-	SpeedZSlow = 1  // mm per second
-)
-
 type BLTouch struct {
-	conn net.Conn
+	conn    net.Conn
+	profile *profile.Profile
 }
 
-func NewBLTouch(address string) (*BLTouch, error) {
-	conn, err := net.Dial("tcp", address)
+func NewBLTouch(profile *profile.Profile) (*BLTouch, error) {
+	conn, err := net.Dial("tcp", profile.BLTouchAddress)
 	if err != nil {
 		return nil, err
 	}
-	bltouch := BLTouch{conn}
+	bltouch := BLTouch{conn, profile}
 	if err := bltouch.retract(); err != nil {
 		return nil, err
 	}
@@ -69,31 +63,93 @@ func (bltouch *BLTouch) hasTouched() (bool, error) {
 	return false, fmt.Errorf("failed to read bltouch after 3 attempts: %v", errors)
 }
 
-func (bltouch *BLTouch) GetZAtPoint(printer *printer.Printer, x, y float64) (float64, error) {
+// ProbePoint probes the bed at the position NumberOfRepeatsPerPoint times, and more if the samples are too spread out.
+func (bltouch *BLTouch) ProbePoint(printer printer.Printer, x, y float64) (mesh.Point, error) {
+	profile := bltouch.profile
+	var samples []float64
+	for reprobes := uint8(0); ; reprobes++ {
+		for i := uint8(0); i < profile.NumberOfRepeatsPerPoint; i++ {
+			z, err := bltouch.GetZAtPoint(printer, x, y)
+			if err != nil {
+				return mesh.Point{}, err
+			}
+			samples = append(samples, z)
+		}
+		spread := mesh.CalculateSampleStatistics(samples).Spread()
+		if profile.MaximumSpread <= 0 || spread <= profile.MaximumSpread {
+			break
+		}
+		if reprobes >= profile.MaximumReprobes {
+			log.Printf("Warning: samples at X%.3f Y%.3f are still spread over %.3fmm after re-probing\n", x, y, spread)
+			break
+		}
+		log.Printf("Samples at X%.3f Y%.3f are spread over %.3fmm, re-probing\n", x, y, spread)
+	}
+
+	z, err := mesh.AggregateSamples(samples, profile.Aggregation)
+	if err != nil {
+		return mesh.Point{}, err
+	}
+	return mesh.Point{
+		X:                 x,
+		Y:                 y,
+		Z:                 z,
+		Samples:           samples,
+		StandardDeviation: mesh.CalculateSampleStatistics(samples).StandardDeviation,
+	}, nil
+}
+
+// GetZAtPoint probes the bed at the position, moving the nozzle so that the probe (rather than the nozzle) is over it.
+func (bltouch *BLTouch) GetZAtPoint(printer printer.Printer, x, y float64) (float64, error) {
+	profile := bltouch.profile
+	if !profile.CanProbe(x, y) {
+		return 0, fmt.Errorf("the probe can't reach X%.3f Y%.3f", x, y)
+	}
+	nozzleX, nozzleY := profile.NozzlePosition(x, y)
 	if err := bltouch.retract(); err != nil {
 		return 0, err
 	}
-	if movementDuration, err := printer.MoveZ(StartZ, SpeedZFast); err != nil {
+	if _, err := printer.MoveZ(profile.ProbeStartZ, profile.SpeedZFast); err != nil {
 		return 0, err
-	} else {
-		time.Sleep(movementDuration)
 	}
-	if movementDuration, err := printer.MoveXY(x, y, SpeedXY); err != nil {
+	if _, err := printer.MoveXY(nozzleX, nozzleY, profile.SpeedXY); err != nil {
 		return 0, err
-	} else {
-		time.Sleep(movementDuration)
 	}
 	if err := bltouch.extend(); err != nil {
 		return 0, err
 	}
 
 	// We are ready to start moving down.
-	for z := StartZ - ZStep; z >= EndZ; z -= ZStep {
+	if profile.FastZStep <= 0 {
+		return bltouch.descend(printer, profile.ProbeStartZ, profile.ZStep, profile.SpeedZSlow)
+	}
+
+	// Find the bed quickly with big steps, then back off and find it accurately with small steps, like Marlin's double touch.
+	fastZ, err := bltouch.descend(printer, profile.ProbeStartZ, profile.FastZStep, profile.SpeedZFast)
+	if err != nil {
+		return 0, err
+	}
+	// The probe latches when it touches, so it has to be reset before it can touch again
+	if err := bltouch.retract(); err != nil {
+		return 0, err
+	}
+	// The bed is somewhere between the last step that didn't touch and fastZ
+	slowStartZ := min(fastZ+profile.FastZStep+profile.ProbeBackOff, profile.ProbeStartZ)
+	if _, err := printer.MoveZ(slowStartZ, profile.SpeedZFast); err != nil {
+		return 0, err
+	}
+	if err := bltouch.extend(); err != nil {
+		return 0, err
+	}
+	return bltouch.descend(printer, slowStartZ, profile.ZStep, profile.SpeedZSlow)
+}
+
+// descend moves down from startZ in steps until the probe touches the bed, and returns the Z that it touched at.
+func (bltouch *BLTouch) descend(printer printer.Printer, startZ, step, speed float64) (float64, error) {
+	for z := startZ - step; z >= bltouch.profile.MinimumZ; z -= step {
 		z = math.Round(z*1000) / 1000
-		if movementDuration, err := printer.MoveZ(z, SpeedZSlow); err != nil {
+		if _, err := printer.MoveZ(z, speed); err != nil {
 			return 0, err
-		} else {
-			time.Sleep(movementDuration)
 		}
 		hasTouched, err := bltouch.hasTouched()
 		if err != nil {
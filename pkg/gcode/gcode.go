@@ -0,0 +1,308 @@
+package gcode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Commands whose arguments are free text (eg. a file name or a message) instead of parameters.
+var textCommands = map[string]bool{
+	"M23":  true, // Select SD file
+	"M28":  true, // Start SD write
+	"M29":  true, // Stop SD write
+	"M30":  true, // Delete SD file
+	"M32":  true, // Select and start SD file
+	"M117": true, // Display message
+	"M118": true, // Serial print
+	"M928": true, // Start SD logging
+}
+
+type Param struct {
+	Letter byte
+	Value  float64
+	// False if the parameter is only a letter, eg. the X in "G28 X"
+	HasValue bool
+}
+
+// Command is a single line of gcode.
+// A line containing only a comment (or nothing at all) is a Command with a Letter of 0.
+type Command struct {
+	// The N line number that hosts send with each line, eg. the 12 in "N12 G1 X10*57"
+	LineNumber    int
+	HasLineNumber bool
+	// Whether the line ends with a checksum. The checksum is recalculated when the command is formatted, so it is valid even if the command has been changed.
+	HasChecksum bool
+	Letter      byte
+	Number      int
+	Subcode     int // eg. the 1 in G28.1. 0 if there is no subcode.
+	Params      []Param
+	// Free text argument of commands such as M117
+	Text       string
+	Comment    string // Everything after the ';', not including the ';'
+	HasComment bool
+}
+
+func NewCommand(letter byte, number int) Command {
+	return Command{Letter: letter, Number: number}
+}
+
+// Parse lexes a single line of gcode, which must not include the line ending.
+func Parse(line string) (Command, error) {
+	var command Command
+	if commentIndex := strings.IndexByte(line, ';'); commentIndex >= 0 {
+		command.Comment = line[commentIndex+1:]
+		command.HasComment = true
+		line = line[:commentIndex]
+	}
+
+	lexer := lexer{line: line}
+	lexer.skipWhitespace()
+	if lexer.done() {
+		return command, nil
+	}
+
+	// A line number can only be followed by a checksum, eg. "N12 G1 X10*57"
+	if lexer.line[lexer.position] == 'N' || lexer.line[lexer.position] == 'n' {
+		lexer.position++
+		number, ok := lexer.number()
+		if !ok || strings.ContainsAny(number, "+-.") {
+			return Command{}, fmt.Errorf("expected line number at column %d: %s", lexer.position+1, line)
+		}
+		command.LineNumber, _ = strconv.Atoi(number)
+		command.HasLineNumber = true
+		if checksumIndex := strings.LastIndexByte(line, '*'); checksumIndex >= 0 {
+			if _, err := strconv.ParseUint(strings.TrimSpace(line[checksumIndex+1:]), 10, 8); err != nil {
+				return Command{}, fmt.Errorf("invalid checksum at column %d: %s", checksumIndex+2, line)
+			}
+			command.HasChecksum = true
+			line = line[:checksumIndex]
+			lexer.line = line
+		}
+		lexer.skipWhitespace()
+		if lexer.done() {
+			return command, nil
+		}
+	}
+
+	letter, ok := lexer.letter()
+	if !ok {
+		return Command{}, fmt.Errorf("expected command letter at column %d: %s", lexer.position+1, line)
+	}
+	number, ok := lexer.number()
+	if !ok || strings.ContainsAny(number, "+-") {
+		return Command{}, fmt.Errorf("expected command number at column %d: %s", lexer.position+1, line)
+	}
+	whole, fraction, hasFraction := strings.Cut(number, ".")
+	var err error
+	if command.Number, err = strconv.Atoi(whole); err != nil {
+		return Command{}, fmt.Errorf("invalid command number %q: %s", number, line)
+	}
+	if hasFraction {
+		if command.Subcode, err = strconv.Atoi(fraction); err != nil {
+			return Command{}, fmt.Errorf("invalid command number %q: %s", number, line)
+		}
+	}
+	command.Letter = letter
+
+	if textCommands[command.Code()] {
+		command.Text = strings.TrimSpace(line[lexer.position:])
+		return command, nil
+	}
+
+	for {
+		lexer.skipWhitespace()
+		if lexer.done() {
+			break
+		}
+		letter, ok := lexer.letter()
+		if !ok {
+			return Command{}, fmt.Errorf("expected parameter letter at column %d: %s", lexer.position+1, line)
+		}
+		param := Param{Letter: letter}
+		if number, ok := lexer.number(); ok {
+			if param.Value, err = strconv.ParseFloat(number, 64); err != nil {
+				return Command{}, fmt.Errorf("invalid value for parameter %c: %s", letter, line)
+			}
+			param.HasValue = true
+		} else if !lexer.done() && !lexer.whitespace() && !lexer.isLetter() {
+			return Command{}, fmt.Errorf("invalid value for parameter %c at column %d: %s", letter, lexer.position+1, line)
+		}
+		command.Params = append(command.Params, param)
+	}
+
+	return command, nil
+}
+
+// Code returns the command without its parameters, eg. "G1" or "G28.1".
+func (command Command) Code() string {
+	if command.Letter == 0 {
+		return ""
+	}
+	code := string(command.Letter) + strconv.Itoa(command.Number)
+	if command.Subcode != 0 {
+		code += "." + strconv.Itoa(command.Subcode)
+	}
+	return code
+}
+
+func (command Command) Is(letter byte, number int) bool {
+	return command.Letter == letter && command.Number == number && command.Subcode == 0
+}
+
+func (command Command) IsEmpty() bool {
+	return command.Letter == 0
+}
+
+// Param returns the value of the parameter with the given letter, and whether it exists.
+func (command Command) Param(letter byte) (float64, bool) {
+	for _, param := range command.Params {
+		if param.Letter == letter {
+			return param.Value, param.HasValue
+		}
+	}
+	return 0, false
+}
+
+func (command Command) HasParam(letter byte) bool {
+	for _, param := range command.Params {
+		if param.Letter == letter {
+			return true
+		}
+	}
+	return false
+}
+
+// SetParam sets the value of the parameter with the given letter, adding it to the end if it doesn't exist.
+func (command *Command) SetParam(letter byte, value float64) {
+	for i := range command.Params {
+		if command.Params[i].Letter == letter {
+			command.Params[i].Value = value
+			command.Params[i].HasValue = true
+			return
+		}
+	}
+	command.Params = append(command.Params, Param{Letter: letter, Value: value, HasValue: true})
+}
+
+func (command *Command) RemoveParam(letter byte) {
+	params := command.Params[:0]
+	for _, param := range command.Params {
+		if param.Letter != letter {
+			params = append(params, param)
+		}
+	}
+	command.Params = params
+}
+
+// String formats the command as a line of gcode, without a line ending.
+func (command Command) String() string {
+	builder := new(strings.Builder)
+	if command.HasLineNumber {
+		builder.WriteByte('N')
+		builder.WriteString(strconv.Itoa(command.LineNumber))
+		if command.Letter != 0 {
+			builder.WriteRune(' ')
+		}
+	}
+	builder.WriteString(command.Code())
+	for _, param := range command.Params {
+		builder.WriteRune(' ')
+		builder.WriteByte(param.Letter)
+		if param.HasValue {
+			builder.WriteString(strconv.FormatFloat(param.Value, 'f', -1, 64))
+		}
+	}
+	if command.Text != "" {
+		builder.WriteRune(' ')
+		builder.WriteString(command.Text)
+	}
+	if command.HasChecksum {
+		checksum := Checksum(builder.String())
+		builder.WriteByte('*')
+		builder.WriteString(strconv.Itoa(int(checksum)))
+	}
+	if command.HasComment {
+		if builder.Len() > 0 {
+			builder.WriteRune(' ')
+		}
+		builder.WriteRune(';')
+		builder.WriteString(command.Comment)
+	}
+	return builder.String()
+}
+
+// Checksum returns the checksum of a line that hosts send after '*', which is the XOR of all of its bytes.
+func Checksum(line string) byte {
+	var checksum byte
+	for i := 0; i < len(line); i++ {
+		checksum ^= line[i]
+	}
+	return checksum
+}
+
+type lexer struct {
+	line     string
+	position int
+}
+
+func (lexer *lexer) done() bool {
+	return lexer.position >= len(lexer.line)
+}
+
+func (lexer *lexer) whitespace() bool {
+	return !lexer.done() && (lexer.line[lexer.position] == ' ' || lexer.line[lexer.position] == '\t')
+}
+
+func (lexer *lexer) skipWhitespace() {
+	for lexer.whitespace() {
+		lexer.position++
+	}
+}
+
+func (lexer *lexer) isLetter() bool {
+	if lexer.done() {
+		return false
+	}
+	character := lexer.line[lexer.position]
+	return (character >= 'A' && character <= 'Z') || (character >= 'a' && character <= 'z')
+}
+
+// letter consumes a single letter, converting it to upper case.
+func (lexer *lexer) letter() (byte, bool) {
+	if !lexer.isLetter() {
+		return 0, false
+	}
+	character := lexer.line[lexer.position]
+	lexer.position++
+	if character >= 'a' && character <= 'z' {
+		character -= 'a' - 'A'
+	}
+	return character, true
+}
+
+// number consumes a decimal number with an optional sign, eg. "-1.5", "+2" or ".5".
+func (lexer *lexer) number() (string, bool) {
+	start := lexer.position
+	if !lexer.done() && (lexer.line[lexer.position] == '-' || lexer.line[lexer.position] == '+') {
+		lexer.position++
+	}
+	digits := 0
+	seenPoint := false
+	for !lexer.done() {
+		character := lexer.line[lexer.position]
+		if character >= '0' && character <= '9' {
+			digits++
+		} else if character == '.' && !seenPoint {
+			seenPoint = true
+		} else {
+			break
+		}
+		lexer.position++
+	}
+	if digits == 0 {
+		lexer.position = start
+		return "", false
+	}
+	return lexer.line[start:lexer.position], true
+}
@@ -0,0 +1,107 @@
+package gcode
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line    string
+		command Command
+	}{
+		{"", Command{}},
+		{"   ", Command{}},
+		{"; comment", Command{Comment: " comment", HasComment: true}},
+		{"G1 X10 Y-2.5 E.5", Command{Letter: 'G', Number: 1, Params: []Param{{'X', 10, true}, {'Y', -2.5, true}, {'E', 0.5, true}}}},
+		{"G1X10Y20", Command{Letter: 'G', Number: 1, Params: []Param{{'X', 10, true}, {'Y', 20, true}}}},
+		{"  g1  x10\ty+20  ", Command{Letter: 'G', Number: 1, Params: []Param{{'X', 10, true}, {'Y', 20, true}}}},
+		{"G1 X10 ; move to X5", Command{Letter: 'G', Number: 1, Params: []Param{{'X', 10, true}}, Comment: " move to X5", HasComment: true}},
+		{"G28 X Y", Command{Letter: 'G', Number: 28, Params: []Param{{Letter: 'X'}, {Letter: 'Y'}}}},
+		{"G28.1", Command{Letter: 'G', Number: 28, Subcode: 1}},
+		{"G10", Command{Letter: 'G', Number: 10}},
+		{"M117 Printing X10;50%", Command{Letter: 'M', Number: 117, Text: "Printing X10", Comment: "50%", HasComment: true}},
+		{"M23 file*name.gco", Command{Letter: 'M', Number: 23, Text: "file*name.gco"}},
+		{"N12 G1 X10*57", Command{LineNumber: 12, HasLineNumber: true, HasChecksum: true, Letter: 'G', Number: 1, Params: []Param{{'X', 10, true}}}},
+		{"n3 M110 N0 *12 ; reset", Command{LineNumber: 3, HasLineNumber: true, HasChecksum: true, Letter: 'M', Number: 110, Params: []Param{{'N', 0, true}}, Comment: " reset", HasComment: true}},
+		{"N7", Command{LineNumber: 7, HasLineNumber: true}},
+	}
+	for _, test := range tests {
+		command, err := Parse(test.line)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(command, test.command) {
+			t.Errorf("Parse(%q) = %+v, want %+v", test.line, command, test.command)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, line := range []string{
+		"1 X10",
+		"G X10",
+		"G-1",
+		"G1 X10 (comment) Y5",
+		"G1 X=10",
+		"N G1",
+		"N12 G1 X10*abc",
+		"\x00\x01binary",
+	} {
+		if command, err := Parse(line); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", line, command)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"G1 X10 Y-2.5 E0.5", "G1 X10 Y-2.5 E0.5"},
+		{"g1x10y20", "G1 X10 Y20"},
+		{"G1 X10 ;comment", "G1 X10 ;comment"},
+		{";comment", ";comment"},
+		{"G28 X Y", "G28 X Y"},
+		{"G28.1", "G28.1"},
+		{"M117 Hello world", "M117 Hello world"},
+		// The checksum is recalculated
+		{"N12 G1 X10*0", "N12 G1 X10*" + checksumString("N12 G1 X10")},
+	}
+	for _, test := range tests {
+		command, err := Parse(test.line)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", test.line, err)
+			continue
+		}
+		if got := command.String(); got != test.want {
+			t.Errorf("Parse(%q).String() = %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestStringAfterChange(t *testing.T) {
+	command, err := Parse("N5 G1 X10 Y20 E1*99 ; infill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	command.SetParam('Z', 0.2)
+	command.RemoveParam('E')
+	want := "N5 G1 X10 Y20 Z0.2*" + checksumString("N5 G1 X10 Y20 Z0.2") + " ; infill"
+	if got := command.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	if checksum := Checksum("N123 M110 N100"); checksum != 124 {
+		t.Errorf("Checksum = %d, want 124", checksum)
+	}
+}
+
+func checksumString(line string) string {
+	return strconv.Itoa(int(Checksum(line)))
+}
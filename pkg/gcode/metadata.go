@@ -0,0 +1,137 @@
+package gcode
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Metadata is information about a print that slicers put in comments.
+type Metadata struct {
+	// eg. "PLA". Empty if unknown.
+	FilamentType string
+	// In °C. 0 if unknown.
+	NozzleTemperature float64
+}
+
+// Comment keys (lower case) that hold the filament type, for PrusaSlicer and its forks, Cura and FlashPrint
+var filamentTypeKeys = map[string]bool{
+	"filament_type":           true,
+	"material":                true,
+	"right_extruder_material": true,
+	"left_extruder_material":  true,
+}
+
+// Comment keys (lower case) that hold the nozzle temperature
+var nozzleTemperatureKeys = map[string]bool{
+	"temperature":                true,
+	"nozzle_temperature":         true,
+	"right_extruder_temperature": true,
+	"left_extruder_temperature":  true,
+}
+
+// Comment keys (lower case) that hold the nozzle temperature of the first layer, which is only used if there is no other temperature
+var firstLayerNozzleTemperatureKeys = map[string]bool{
+	"first_layer_temperature":            true,
+	"nozzle_temperature_initial_layer":   true,
+	"material_print_temperature_layer_0": true,
+}
+
+// firstListValue returns the first value of a setting for multiple extruders, eg. "PLA;PETG" or "215,220".
+func firstListValue(value string) string {
+	if index := strings.IndexAny(value, ";,"); index >= 0 {
+		value = value[:index]
+	}
+	return strings.Trim(strings.TrimSpace(value), "\"")
+}
+
+// parseMetadataComment splits a "key = value" (PrusaSlicer) or "key: value" (Cura, FlashPrint) comment.
+func parseMetadataComment(comment string) (string, string, bool) {
+	index := strings.IndexAny(comment, "=:")
+	if index < 0 {
+		return "", "", false
+	}
+	key := strings.ToLower(strings.TrimSpace(comment[:index]))
+	value := firstListValue(comment[index+1:])
+	return key, value, key != "" && value != ""
+}
+
+// MetadataReader collects Metadata from lines of gcode.
+type MetadataReader struct {
+	metadata Metadata
+	// Where the nozzle temperature came from, as comments are preferred over commands and the first layer temperature is only a fallback
+	temperatureFromComment, temperatureFromFirstLayer, temperatureFromCommand bool
+	firstLayerTemperature                                                     float64
+	commandTemperature                                                        float64
+}
+
+// ReadLine collects any metadata from a line of gcode.
+func (reader *MetadataReader) ReadLine(line string) {
+	// Skip the (many) lines that can't have metadata without parsing them
+	trimmedLine := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmedLine, ";") && !strings.HasPrefix(trimmedLine, "M10") && !strings.HasPrefix(trimmedLine, "m10") {
+		return
+	}
+	command, err := Parse(trimmedLine)
+	if err != nil {
+		return
+	}
+	if command.HasComment && command.IsEmpty() {
+		key, value, ok := parseMetadataComment(command.Comment)
+		if !ok {
+			return
+		}
+		switch {
+		case filamentTypeKeys[key]:
+			// Cura's UltiGCode flavour uses MATERIAL for the volume of filament used
+			if _, err := strconv.ParseFloat(value, 64); err != nil && reader.metadata.FilamentType == "" {
+				reader.metadata.FilamentType = value
+			}
+		case nozzleTemperatureKeys[key]:
+			if temperature, err := strconv.ParseFloat(value, 64); err == nil && !reader.temperatureFromComment {
+				reader.metadata.NozzleTemperature = temperature
+				reader.temperatureFromComment = true
+			}
+		case firstLayerNozzleTemperatureKeys[key]:
+			if temperature, err := strconv.ParseFloat(value, 64); err == nil && !reader.temperatureFromFirstLayer {
+				reader.firstLayerTemperature = temperature
+				reader.temperatureFromFirstLayer = true
+			}
+		}
+	} else if command.Is('M', 104) || command.Is('M', 109) {
+		if temperature, ok := command.Param('S'); ok && temperature > 0 && !reader.temperatureFromCommand {
+			reader.commandTemperature = temperature
+			reader.temperatureFromCommand = true
+		}
+	}
+}
+
+// Metadata returns the metadata collected so far.
+func (reader *MetadataReader) Metadata() Metadata {
+	metadata := reader.metadata
+	if !reader.temperatureFromComment {
+		if reader.temperatureFromFirstLayer {
+			metadata.NozzleTemperature = reader.firstLayerTemperature
+		} else if reader.temperatureFromCommand {
+			metadata.NozzleTemperature = reader.commandTemperature
+		}
+	}
+	return metadata
+}
+
+// ReadMetadata reads all of the gcode to find its metadata.
+// The whole file is read as some slicers (eg. PrusaSlicer) put their settings at the end.
+func ReadMetadata(reader io.Reader) (Metadata, error) {
+	var metadataReader MetadataReader
+	bufferedReader := bufio.NewReader(reader)
+	for {
+		line, err := bufferedReader.ReadString('\n')
+		metadataReader.ReadLine(strings.TrimRight(line, "\r\n"))
+		if err == io.EOF {
+			return metadataReader.Metadata(), nil
+		} else if err != nil {
+			return Metadata{}, err
+		}
+	}
+}
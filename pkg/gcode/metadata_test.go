@@ -0,0 +1,123 @@
+package gcode
+
+import (
+	"strings"
+	"testing"
+)
+
+const curaGcode = `;FLAVOR:Marlin
+;TIME:1234
+;Filament used: 1.2m
+;Layer height: 0.2
+;MINX:10
+;MATERIAL:PLA
+;TARGET_MACHINE.NAME:Creality Ender-3
+;Generated with Cura_SteamEngine 5.4.0
+M140 S60
+M105
+M190 S60
+M104 S205
+M109 S205
+G28
+G1 X10 Y10 Z0.2 F3000
+G1 X50 E2
+`
+
+const prusaSlicerGcode = `; generated by PrusaSlicer 2.6.0 on 2023-05-01 at 12:00:00 UTC
+; external perimeters extrusion width = 0.45mm
+M107
+M190 S60
+M104 S215
+M109 S215
+G28
+G1 X10 Y10 Z0.2 F3000
+G1 X50 E2
+M104 S0
+; filament used [mm] = 1234.5
+; prusaslicer_config = begin
+; first_layer_temperature = 220,230
+; filament_type = PETG;PLA
+; temperature = 230,215
+; prusaslicer_config = end
+`
+
+const orcaSlicerGcode = `; HEADER_BLOCK_START
+; generated by OrcaSlicer 1.8.0 on 2023-11-01 at 12:00:00
+; total layer number: 50
+; HEADER_BLOCK_END
+
+; CONFIG_BLOCK_START
+; filament_type = "ABS"
+; nozzle_temperature = 250
+; nozzle_temperature_initial_layer = 255
+; CONFIG_BLOCK_END
+
+M104 S255
+G28
+G1 X10 Y10 Z0.2 F3000
+G1 X50 E2
+`
+
+const flashPrintGcode = `;generated by ffslicer
+;right_extruder_material: PLA
+;right_extruder_temperature: 210
+;filament_diameter0: 1.75
+M140 S50
+M104 S210 T0
+G28
+G1 X10 Y10 Z0.2 F3000
+`
+
+func TestReadMetadata(t *testing.T) {
+	tests := []struct {
+		name  string
+		gcode string
+		want  Metadata
+	}{
+		// The temperature comes from M104 as Cura doesn't comment it
+		{"Cura header", curaGcode, Metadata{FilamentType: "PLA", NozzleTemperature: 205}},
+		// The settings comments at the end take priority over the commands, and the first extruder's settings are used
+		{"PrusaSlicer footer", prusaSlicerGcode, Metadata{FilamentType: "PETG", NozzleTemperature: 230}},
+		{"OrcaSlicer", orcaSlicerGcode, Metadata{FilamentType: "ABS", NozzleTemperature: 250}},
+		{"FlashPrint", flashPrintGcode, Metadata{FilamentType: "PLA", NozzleTemperature: 210}},
+		// The first layer temperature is only used if there is no other temperature comment
+		{"first layer temperature", "; first_layer_temperature = 220\nM104 S200\n", Metadata{NozzleTemperature: 220}},
+		// Cura's UltiGCode flavour uses MATERIAL for the volume of filament
+		{"UltiGCode", ";FLAVOR:UltiGCode\n;MATERIAL:1234\n;MATERIAL2:0\n", Metadata{}},
+		{"CRLF", "; filament_type = TPU\r\n; temperature = 225\r\n", Metadata{FilamentType: "TPU", NozzleTemperature: 225}},
+		{"none", "G28\nG1 X10 Y10 Z0.2\nM104 S0\n", Metadata{}},
+	}
+	for _, test := range tests {
+		metadata, err := ReadMetadata(strings.NewReader(test.gcode))
+		if err != nil {
+			t.Errorf("%s: ReadMetadata failed: %v", test.name, err)
+		} else if metadata != test.want {
+			t.Errorf("%s: ReadMetadata = %+v, want %+v", test.name, metadata, test.want)
+		}
+	}
+}
+
+func TestMetadataReaderBeforeFirstMove(t *testing.T) {
+	// Reading line by line gives the metadata found so far, which for PrusaSlicer doesn't include the footer
+	tests := []struct {
+		name  string
+		gcode string
+		want  Metadata
+	}{
+		{"Cura header", curaGcode, Metadata{FilamentType: "PLA", NozzleTemperature: 205}},
+		{"PrusaSlicer footer", prusaSlicerGcode, Metadata{NozzleTemperature: 215}},
+		{"OrcaSlicer", orcaSlicerGcode, Metadata{FilamentType: "ABS", NozzleTemperature: 250}},
+	}
+	for _, test := range tests {
+		var reader MetadataReader
+		for _, line := range strings.Split(test.gcode, "\n") {
+			if strings.HasPrefix(line, "G1") {
+				break
+			}
+			reader.ReadLine(line)
+		}
+		if metadata := reader.Metadata(); metadata != test.want {
+			t.Errorf("%s: Metadata = %+v, want %+v", test.name, metadata, test.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package mesh
+
+import (
+	"math"
+	"mesh-levelling/pkg/gcode"
+)
+
+const ArcTolerance = 0.01 // Maximum distance in mm that the line segments of an arc are allowed to stray from the true arc
+
+// arc turns a G2 (clockwise) or G3 (counterclockwise) arc into line segments, which are then each levelled like any other move.
+// Both the I/J (centre offset) and R (radius) forms are supported, as well as helical arcs that move in Z.
+func (processor *processor) arc(command gcode.Command, newExtruder, newSpeed, newX, newY, newZ float64) (string, error) {
+	x, y := processor.x, processor.y
+	clockwise := command.Is('G', 2)
+
+	// The offset of the centre of the arc from the starting position
+	var centreOffsetX, centreOffsetY float64
+	if radius, ok := command.Param('R'); ok {
+		changeInX := newX - x
+		changeInY := newY - y
+		distance := math.Sqrt(math.Pow(changeInX, 2) + math.Pow(changeInY, 2))
+		if distance != 0 {
+			// Positive radius means the shorter of the two possible arcs, negative means the longer
+			direction := 1.0
+			if clockwise != (radius < 0) {
+				direction = -1
+			}
+			// Distance from the midpoint of the two positions to the centre of the arc
+			centreDistance := math.Sqrt(math.Max(0, math.Pow(radius, 2)-math.Pow(distance/2, 2)))
+			centreX := (x+newX)/2 - direction*centreDistance*changeInY/distance
+			centreY := (y+newY)/2 + direction*centreDistance*changeInX/distance
+			centreOffsetX = centreX - x
+			centreOffsetY = centreY - y
+		}
+	} else {
+		centreOffsetX, _ = command.Param('I')
+		centreOffsetY, _ = command.Param('J')
+	}
+	radius := math.Sqrt(math.Pow(centreOffsetX, 2) + math.Pow(centreOffsetY, 2))
+
+	if !isValid(x) || !isValid(y) || !isValid(newX) || !isValid(newY) || radius == 0 {
+		// We don't know enough to follow the arc, so leave it as it is
+		return processor.moveTo(command, newExtruder, newSpeed, newX, newY, newZ)
+	}
+
+	centreX := x + centreOffsetX
+	centreY := y + centreOffsetY
+	startAngle := math.Atan2(y-centreY, x-centreX)
+	endAngle := math.Atan2(newY-centreY, newX-centreX)
+	// The angle swept by the arc, which is always positive. An arc that ends where it starts is a full circle.
+	var sweep float64
+	if clockwise {
+		sweep = startAngle - endAngle
+	} else {
+		sweep = endAngle - startAngle
+	}
+	if sweep <= 0 {
+		sweep += 2 * math.Pi
+	}
+	if turns, ok := command.Param('P'); ok && turns > 1 {
+		sweep += 2 * math.Pi * math.Floor(turns-1)
+	}
+
+	// Find the number of segments that keeps every segment within ArcTolerance of the arc
+	segmentAngle := math.Pi
+	if ArcTolerance < radius {
+		segmentAngle = 2 * math.Acos(1-ArcTolerance/radius)
+	}
+	numberOfSegments := int(math.Ceil(sweep / segmentAngle))
+
+	lineCommand := gcode.NewCommand('G', 1)
+	for _, param := range command.Params {
+		switch param.Letter {
+		case 'I', 'J', 'R', 'P':
+		default:
+			lineCommand.Params = append(lineCommand.Params, param)
+		}
+	}
+
+	extruder, z := processor.extruder, processor.z
+	for i := 1; i < numberOfSegments; i++ {
+		progress := float64(i) / float64(numberOfSegments)
+		angle := startAngle + sweep*progress
+		if clockwise {
+			angle = startAngle - sweep*progress
+		}
+		segment := lineCommand
+		segment.Comment = " ARC"
+		segment.HasComment = true
+		line, err := processor.moveTo(
+			segment,
+			extruder+(newExtruder-extruder)*progress,
+			newSpeed,
+			centreX+radius*math.Cos(angle),
+			centreY+radius*math.Sin(angle),
+			z+(newZ-z)*progress,
+		)
+		if err != nil {
+			return "", err
+		}
+		if err := processor.writeLine(line, processor.lineEnding); err != nil {
+			return "", err
+		}
+	}
+
+	// Finish exactly at the end of the arc, rather than a rounded version of it.
+	// Like a segmented G1, only this last line keeps the arc's line number and checksum.
+	lineCommand.LineNumber = command.LineNumber
+	lineCommand.HasLineNumber = command.HasLineNumber
+	lineCommand.HasChecksum = command.HasChecksum
+	lineCommand.Comment = command.Comment
+	lineCommand.HasComment = command.HasComment
+	return processor.moveTo(lineCommand, newExtruder, newSpeed, newX, newY, newZ)
+}
@@ -0,0 +1,109 @@
+package mesh
+
+import (
+	"math"
+	"mesh-levelling/pkg/gcode"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestProcessArcs(t *testing.T) {
+	// A sloped bed, which the lines of an arc follow exactly without being segmented any further
+	height := func(x, y float64) float64 { return x/100 + y/200 }
+	mesh := gridMesh(3, height)
+	const centreX, centreY, radius = 50.0, 50.0, 30.0
+	tests := []struct {
+		name      string
+		move      string
+		clockwise bool
+		sweep     float64
+		endZ      float64
+	}{
+		{"I/J counter-clockwise", "G3 X50 Y80 I-30 J0 E10", false, math.Pi / 2, 1},
+		{"I/J clockwise", "G2 X50 Y80 I-30 J0 E10", true, 3 * math.Pi / 2, 1},
+		{"R shorter arc", "G2 X50 Y20 R30 E10", true, math.Pi / 2, 1},
+		{"R longer arc", "G3 X50 Y20 R-30 E10", false, 3 * math.Pi / 2, 1},
+		{"full circle", "G3 X80 Y50 I-30 J0 E10", false, 2 * math.Pi, 1},
+		{"full circles with P", "G3 X80 Y50 I-30 J0 P3 E10", false, 6 * math.Pi, 1},
+		{"helical", "G2 X80 Y50 I-30 J0 Z3 E10", true, 2 * math.Pi, 3},
+	}
+	for _, test := range tests {
+		output := process(t, mesh, ProcessOptions{}, "G28\nG90\nM82\nG1 X80 Y50 Z1\n"+test.move+" ; arc\n")
+		commands := parseLines(t, output)[4:]
+		if minimumLines := int(math.Ceil(test.sweep / (2 * math.Acos(1-ArcTolerance/radius)))); len(commands) < minimumLines {
+			t.Errorf("%s: the arc was split into %d lines, want at least %d to stay within ArcTolerance", test.name, len(commands), minimumLines)
+		}
+
+		lastX, lastY, lastE, lastAngle, swept := 80.0, 50.0, 0.0, 0.0, 0.0
+		lastZ := 1 + height(lastX, lastY)
+		for _, command := range commands {
+			// Axes that don't change are left out
+			x := handleMoveArgument(command, 'X', false, lastX)
+			y := handleMoveArgument(command, 'Y', false, lastY)
+			z := handleMoveArgument(command, 'Z', false, lastZ)
+			e := handleMoveArgument(command, 'E', false, lastE)
+			if !command.Is('G', 1) {
+				t.Fatalf("%s: the arc was not converted to lines: %q", test.name, command.String())
+			}
+
+			// Each point is on the arc, and the line to it doesn't cut the corner by more than ArcTolerance
+			if distance := math.Hypot(x-centreX, y-centreY); math.Abs(distance-radius) > 0.001 {
+				t.Errorf("%s: X%.3f Y%.3f is %.4fmm from the centre, want %v", test.name, x, y, distance, radius)
+			}
+			if distance := math.Hypot((x+lastX)/2-centreX, (y+lastY)/2-centreY); radius-distance > ArcTolerance+0.001 {
+				t.Errorf("%s: the line to X%.3f Y%.3f strays %.4fmm from the arc", test.name, x, y, radius-distance)
+			}
+
+			// Each point goes around the arc in the right direction
+			angle := math.Atan2(y-centreY, x-centreX)
+			step := math.Remainder(angle-lastAngle, 2*math.Pi)
+			if test.clockwise {
+				step = -step
+			}
+			if step <= 0 {
+				t.Errorf("%s: X%.3f Y%.3f goes the wrong way around the arc", test.name, x, y)
+			}
+			swept += step
+			lastX, lastY, lastZ, lastE, lastAngle = x, y, z, e, angle
+
+			// Each point follows the mesh, and moves up and extrudes in proportion to how far around the arc it is
+			progress := swept / test.sweep
+			if wantZ := 1 + (test.endZ-1)*progress + height(x, y); math.Abs(z-wantZ) > 0.002 {
+				t.Errorf("%s: X%.3f Y%.3f has Z%.3f, want Z%.3f", test.name, x, y, z, wantZ)
+			}
+			if wantE := 10 * progress; math.Abs(e-wantE) > 0.001 {
+				t.Errorf("%s: X%.3f Y%.3f has E%.5f, want E%.5f", test.name, x, y, e, wantE)
+			}
+		}
+		if math.Abs(swept-test.sweep) > 0.001 {
+			t.Errorf("%s: the arc swept %.4f radians, want %.4f", test.name, swept, test.sweep)
+		}
+		if last := commands[len(commands)-1]; last.Comment != " arc" {
+			t.Errorf("%s: the arc doesn't end with the original command's comment: %q", test.name, last.String())
+		}
+	}
+}
+
+func TestProcessNumberedArc(t *testing.T) {
+	input := "N1 G28*18\nN2 G90*18\nN3 G1 X80 Y50 Z1*" + strconv.Itoa(int(gcode.Checksum("N3 G1 X80 Y50 Z1"))) + "\nN4 G3 X50 Y80 I-30 J0*" + strconv.Itoa(int(gcode.Checksum("N4 G3 X50 Y80 I-30 J0"))) + "\n"
+	output := process(t, gridMesh(3, flat), ProcessOptions{}, input)
+	commands := parseLines(t, output)
+	arc := commands[3:]
+	if len(arc) < 2 {
+		t.Fatalf("the arc was not converted to lines: %q", output)
+	}
+	for _, command := range arc[:len(arc)-1] {
+		if command.HasLineNumber || command.HasChecksum {
+			t.Errorf("line %q of the arc has a line number or checksum", command.String())
+		}
+	}
+	if last := arc[len(arc)-1]; !last.HasLineNumber || last.LineNumber != 4 || !last.HasChecksum {
+		t.Errorf("the last line of the arc is %q, want N4 with a checksum", last.String())
+	}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if line, checksum, ok := strings.Cut(line, "*"); ok && checksum != strconv.Itoa(int(gcode.Checksum(line))) {
+			t.Errorf("line %q has the wrong checksum %s", line, checksum)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package mesh
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+)
+
+// Bounds is a rectangular area of the bed.
+type Bounds struct {
+	MinX float64
+	MinY float64
+	MaxX float64
+	MaxY float64
+}
+
+func emptyBounds() Bounds {
+	return Bounds{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+}
+
+func (bounds *Bounds) add(x, y float64) {
+	bounds.MinX = math.Min(bounds.MinX, x)
+	bounds.MinY = math.Min(bounds.MinY, y)
+	bounds.MaxX = math.Max(bounds.MaxX, x)
+	bounds.MaxY = math.Max(bounds.MaxY, y)
+}
+
+// IsEmpty returns whether the bounds contain no positions at all.
+func (bounds Bounds) IsEmpty() bool {
+	return bounds.MinX > bounds.MaxX || bounds.MinY > bounds.MaxY
+}
+
+// Contains returns whether the position is inside (or on the edge of) the bounds.
+func (bounds Bounds) Contains(x, y float64) bool {
+	return x >= bounds.MinX && x <= bounds.MaxX && y >= bounds.MinY && y <= bounds.MaxY
+}
+
+// Expand returns the bounds with margin added to every side.
+func (bounds Bounds) Expand(margin float64) Bounds {
+	return Bounds{bounds.MinX - margin, bounds.MinY - margin, bounds.MaxX + margin, bounds.MaxY + margin}
+}
+
+// PrintBounds returns the area of the bed covered by the extruding moves in gcode, including arcs.
+func PrintBounds(reader io.Reader) (Bounds, error) {
+	processor := newProcessor(nil, ProcessOptions{}, io.Discard)
+	if err := processor.run(reader); err != nil {
+		return Bounds{}, err
+	}
+	if processor.printBounds.IsEmpty() {
+		return Bounds{}, errors.New("the gcode has no extruding moves")
+	}
+	return processor.printBounds, nil
+}
+
+// PrintBoundsOfFile returns the area of the bed covered by the extruding moves in a gcode file.
+func PrintBoundsOfFile(filename string) (Bounds, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return Bounds{}, err
+	}
+	defer file.Close()
+
+	return PrintBounds(file)
+}
+
+// MergePoints replaces the points of the mesh in area with points from a new probing session.
+// Each probing session measures Z from a different reference, so the new points are first shifted to line up with the mesh on average.
+// The interpolation method is checked against the merged points, see SetPoints.
+func (mesh *Mesh) MergePoints(points []Point, area Bounds) error {
+	if len(points) == 0 {
+		return errors.New("no points to merge")
+	}
+	var shift float64
+	for _, point := range points {
+		bedHeight, err := mesh.bedHeight(point.X, point.Y)
+		if err != nil {
+			return err
+		}
+		shift += bedHeight - point.Z
+	}
+	shift /= float64(len(points))
+
+	mergedPoints := make([]Point, 0, len(mesh.Points)+len(points))
+	for _, point := range mesh.Points {
+		if !area.Contains(point.X, point.Y) {
+			mergedPoints = append(mergedPoints, point)
+		}
+	}
+	for _, point := range points {
+		point.Z += shift
+		shiftedSamples := make([]float64, len(point.Samples))
+		for i, sample := range point.Samples {
+			shiftedSamples[i] = sample + shift
+		}
+		point.Samples = shiftedSamples
+		mergedPoints = append(mergedPoints, point)
+	}
+
+	mesh.SetPoints(mergedPoints)
+	return nil
+}
@@ -0,0 +1,151 @@
+package mesh
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMergePoints(t *testing.T) {
+	mesh := gridMesh(5, plane)
+	area := Bounds{MinX: 30, MinY: 30, MaxX: 70, MaxY: 70}
+
+	// A probe of the print area, measured from a reference 0.5mm lower, with a bump in the middle that the old mesh missed
+	var points []Point
+	for _, x := range []float64{30, 50, 70} {
+		for _, y := range []float64{30, 50, 70} {
+			z := plane(x, y) - 0.5
+			if x == 50 && y == 50 {
+				z += 0.09
+			}
+			points = append(points, Point{X: x, Y: y, Z: z, Samples: []float64{z - 0.01, z + 0.01}})
+		}
+	}
+	if err := mesh.MergePoints(points, area); err != nil {
+		t.Fatalf("MergePoints failed: %v", err)
+	}
+
+	// The points are shifted by the average difference from the old mesh, which is 0.5 less the bump spread over 9 points
+	shift := 0.5 - 0.09/9
+	if len(mesh.Points) != 25-1+9 {
+		t.Errorf("the mesh has %d points, want %d", len(mesh.Points), 25-1+9)
+	}
+	for _, point := range mesh.Points {
+		want := plane(point.X, point.Y)
+		if area.Contains(point.X, point.Y) {
+			want = plane(point.X, point.Y) - 0.5 + shift
+			if point.X == 50 && point.Y == 50 {
+				want += 0.09
+			}
+			if len(point.Samples) != 2 || math.Abs(point.Samples[0]-(want-0.01)) > 1e-9 || math.Abs(point.Samples[1]-(want+0.01)) > 1e-9 {
+				t.Errorf("the samples at X%v Y%v were not shifted: %v", point.X, point.Y, point.Samples)
+			}
+		}
+		if math.Abs(point.Z-want) > 1e-9 {
+			t.Errorf("Z at X%v Y%v = %v, want %v", point.X, point.Y, point.Z, want)
+		}
+	}
+
+	// The bed height comes from the merged points, not the old cached interpolator
+	if z, err := mesh.bedHeight(50, 50); err != nil || math.Abs(z-(plane(50, 50)-0.5+shift+0.09)) > 1e-9 {
+		t.Errorf("bedHeight at the bump = %v, %v", z, err)
+	}
+	if mesh.Interpolation != "" {
+		t.Errorf("Interpolation = %q, want it unchanged", mesh.Interpolation)
+	}
+}
+
+func TestMergePointsChangesInterpolation(t *testing.T) {
+	// Scattered points can't be interpolated bilinearly, so the mesh switches to thin plate spline with a warning
+	mesh := gridMesh(5, flat)
+	mesh.Interpolation = InterpolationBilinear
+	points := []Point{{X: 40, Y: 40}, {X: 50, Y: 60}, {X: 60, Y: 40}}
+	logged := captureLog(func() {
+		if err := mesh.MergePoints(points, Bounds{MinX: 40, MinY: 40, MaxX: 60, MaxY: 60}); err != nil {
+			t.Fatalf("MergePoints failed: %v", err)
+		}
+	})
+	if mesh.Interpolation != "" || DefaultInterpolationMethod(mesh.Points) != InterpolationThinPlateSpline {
+		t.Errorf("Interpolation = %q, want the default for scattered points", mesh.Interpolation)
+	}
+	if !strings.Contains(logged, "now uses thin-plate-spline interpolation instead of bilinear") {
+		t.Errorf("the change of interpolation was not logged: %q", logged)
+	}
+	if _, err := mesh.bedHeight(50, 50); err != nil {
+		t.Errorf("the merged mesh can't be interpolated: %v", err)
+	}
+
+	// A method that works with the merged points is kept without a warning
+	mesh = gridMesh(5, flat)
+	mesh.Interpolation = InterpolationInverseDistanceWeighting
+	logged = captureLog(func() {
+		if err := mesh.MergePoints(points, Bounds{MinX: 40, MinY: 40, MaxX: 60, MaxY: 60}); err != nil {
+			t.Fatalf("MergePoints failed: %v", err)
+		}
+	})
+	if mesh.Interpolation != InterpolationInverseDistanceWeighting || logged != "" {
+		t.Errorf("Interpolation = %q and logged %q, want it unchanged without a warning", mesh.Interpolation, logged)
+	}
+}
+
+func TestSetPoints(t *testing.T) {
+	// Adaptive probing adds points between the columns of the grid, so a mesh that was bilinear switches to the default with a warning
+	mesh := gridMesh(3, flat)
+	mesh.Interpolation = InterpolationBilinear
+	if _, err := mesh.bedHeight(50, 50); err != nil {
+		t.Fatal(err)
+	}
+	points := append(gridMesh(3, func(x, y float64) float64 { return 1 }).Points, Point{X: 25, Y: 25, Z: 1})
+	logged := captureLog(func() {
+		mesh.SetPoints(points)
+	})
+	if mesh.Interpolation != "" || len(mesh.Points) != len(points) {
+		t.Errorf("Interpolation = %q with %d points, want the default for %d irregular points", mesh.Interpolation, len(mesh.Points), len(points))
+	}
+	if !strings.Contains(logged, "now uses thin-plate-spline interpolation instead of bilinear") {
+		t.Errorf("the change of interpolation was not logged: %q", logged)
+	}
+	// The interpolator for the old points isn't used
+	if z, err := mesh.bedHeight(50, 50); err != nil || math.Abs(z-1) > 1e-9 {
+		t.Errorf("bedHeight = %v, %v, want the height of the new points", z, err)
+	}
+	if err := mesh.Validate(); err != nil {
+		t.Errorf("the mesh is invalid: %v", err)
+	}
+
+	// Points in columns keep the method without a warning
+	mesh = gridMesh(3, flat)
+	mesh.Interpolation = InterpolationBicubic
+	logged = captureLog(func() {
+		mesh.SetPoints(gridMesh(4, flat).Points)
+	})
+	if mesh.Interpolation != InterpolationBicubic || logged != "" {
+		t.Errorf("Interpolation = %q and logged %q, want it unchanged without a warning", mesh.Interpolation, logged)
+	}
+}
+
+func TestMergePointsErrors(t *testing.T) {
+	mesh := gridMesh(3, flat)
+	if err := mesh.MergePoints(nil, Bounds{MaxX: 10, MaxY: 10}); err == nil {
+		t.Error("merging no points was accepted")
+	}
+	mesh.Extrapolation = ExtrapolationFail
+	if err := mesh.MergePoints([]Point{{X: 150, Y: 50}}, Bounds{MinX: 140, MaxX: 160, MaxY: 100}); err == nil {
+		t.Error("merging points that the mesh can't be compared with was accepted")
+	}
+}
+
+func TestPrintBounds(t *testing.T) {
+	gcode := "G28\nG90\nG1 X5 Y5 Z0.2\nG1 X100 Y5\nG1 X20 Y30 E1\nG1 X60 Y40 E2\nG1 X150 Y150\n"
+	bounds, err := PrintBounds(strings.NewReader(gcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first extruding move starts at X100 Y5
+	if want := (Bounds{MinX: 20, MinY: 5, MaxX: 100, MaxY: 40}); bounds != want {
+		t.Errorf("PrintBounds = %+v, want %+v", bounds, want)
+	}
+	if _, err := PrintBounds(strings.NewReader("G28\nG1 X10 Y10\n")); err == nil {
+		t.Error("gcode without extrusion has print bounds")
+	}
+}
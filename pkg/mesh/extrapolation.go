@@ -0,0 +1,189 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"sort"
+)
+
+// ExtrapolationPolicy decides the height of the bed outside the probed area, which is the convex hull of the mesh points.
+type ExtrapolationPolicy string
+
+const (
+	// Use the height at the nearest point on the edge of the probed area
+	ExtrapolationClamp ExtrapolationPolicy = "clamp"
+	// Continue the slope of the mesh at the nearest point on the edge of the probed area
+	ExtrapolationLinear ExtrapolationPolicy = "linear"
+	// Use a plane fitted through all the mesh points
+	ExtrapolationPlane ExtrapolationPolicy = "plane"
+	// Fail the job
+	ExtrapolationFail ExtrapolationPolicy = "fail"
+)
+
+var ExtrapolationPolicies = []ExtrapolationPolicy{ExtrapolationClamp, ExtrapolationLinear, ExtrapolationPlane, ExtrapolationFail}
+
+var ErrOutsideMesh = errors.New("position is outside of the probed area")
+
+// The distance in mm inside the edge of the probed area that is used to find the slope of the mesh for linear extrapolation
+const extrapolationSlopeDistance = 1
+
+type hullPoint struct {
+	x, y float64
+}
+
+// convexHull returns the convex hull of the points in counterclockwise order, using Andrew's monotone chain algorithm.
+func convexHull(points []Point) []hullPoint {
+	hullPoints := make([]hullPoint, len(points))
+	for i, point := range points {
+		hullPoints[i] = hullPoint{point.X, point.Y}
+	}
+	sort.Slice(hullPoints, func(i, j int) bool {
+		if hullPoints[i].x == hullPoints[j].x {
+			return hullPoints[i].y < hullPoints[j].y
+		} else {
+			return hullPoints[i].x < hullPoints[j].x
+		}
+	})
+	if len(hullPoints) < 3 {
+		return hullPoints
+	}
+
+	cross := func(o, a, b hullPoint) float64 {
+		return (a.x-o.x)*(b.y-o.y) - (a.y-o.y)*(b.x-o.x)
+	}
+	hull := make([]hullPoint, 0, 2*len(hullPoints))
+	// Lower hull
+	for _, point := range hullPoints {
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], point) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, point)
+	}
+	// Upper hull
+	lowerHullLength := len(hull) + 1
+	for i := len(hullPoints) - 2; i >= 0; i-- {
+		for len(hull) >= lowerHullLength && cross(hull[len(hull)-2], hull[len(hull)-1], hullPoints[i]) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, hullPoints[i])
+	}
+	return hull[:len(hull)-1]
+}
+
+// hullContains returns whether the position is inside (or on the edge of) the counterclockwise convex hull.
+func hullContains(hull []hullPoint, x, y float64) bool {
+	if len(hull) < 3 {
+		return false
+	}
+	const epsilon = 1e-9
+	for i := range hull {
+		a := hull[i]
+		b := hull[(i+1)%len(hull)]
+		if (b.x-a.x)*(y-a.y)-(b.y-a.y)*(x-a.x) < -epsilon {
+			return false
+		}
+	}
+	return true
+}
+
+// nearestHullPoint returns the point on the edge of the hull that is closest to the position.
+func nearestHullPoint(hull []hullPoint, x, y float64) hullPoint {
+	nearest := hull[0]
+	nearestDistance := math.Inf(1)
+	for i := range hull {
+		a := hull[i]
+		b := hull[(i+1)%len(hull)]
+		// How far along the edge the closest point is, from 0 to 1
+		var progress float64
+		if edgeLengthSquared := math.Pow(b.x-a.x, 2) + math.Pow(b.y-a.y, 2); edgeLengthSquared != 0 {
+			progress = math.Max(0, math.Min(1, ((x-a.x)*(b.x-a.x)+(y-a.y)*(b.y-a.y))/edgeLengthSquared))
+		}
+		point := hullPoint{a.x + (b.x-a.x)*progress, a.y + (b.y-a.y)*progress}
+		if distance := math.Hypot(x-point.x, y-point.y); distance < nearestDistance {
+			nearest = point
+			nearestDistance = distance
+		}
+	}
+	return nearest
+}
+
+// fitPlane returns the least squares fit of z = a + b*x + c*y through the points.
+func fitPlane(points []Point) (a, b, c float64, err error) {
+	A := mat.NewDense(len(points), 3, nil)
+	z := mat.NewVecDense(len(points), nil)
+	for i, point := range points {
+		A.Set(i, 0, 1)
+		A.Set(i, 1, point.X)
+		A.Set(i, 2, point.Y)
+		z.SetVec(i, point.Z)
+	}
+	var solution mat.VecDense
+	if err := solution.SolveVec(A, z); err != nil {
+		return 0, 0, 0, fmt.Errorf("could not fit plane to mesh: %w", err)
+	}
+	return solution.AtVec(0), solution.AtVec(1), solution.AtVec(2), nil
+}
+
+func (mesh *Mesh) extrapolationPolicy() ExtrapolationPolicy {
+	if mesh.Extrapolation == "" {
+		return ExtrapolationClamp
+	}
+	return mesh.Extrapolation
+}
+
+// IsInMesh returns whether the position is inside the probed area of the mesh.
+func (mesh *Mesh) IsInMesh(x, y float64) bool {
+	if mesh.hull == nil {
+		mesh.hull = convexHull(mesh.Points)
+	}
+	return hullContains(mesh.hull, x, y)
+}
+
+// bedHeight returns the height of the bed at the position, interpolating inside the probed area and extrapolating outside of it.
+func (mesh *Mesh) bedHeight(x, y float64) (float64, error) {
+	if mesh.interpolator == nil {
+		interpolator, err := NewInterpolator(mesh.Interpolation, mesh.Points)
+		if err != nil {
+			return 0, err
+		}
+		mesh.interpolator = interpolator
+	}
+	if mesh.IsInMesh(x, y) {
+		if z := mesh.interpolator.Interpolate(x, y); isValid(z) {
+			return z, nil
+		}
+	}
+
+	switch mesh.extrapolationPolicy() {
+	case ExtrapolationClamp:
+		edge := nearestHullPoint(mesh.hull, x, y)
+		return mesh.interpolator.Interpolate(edge.x, edge.y), nil
+	case ExtrapolationLinear:
+		edge := nearestHullPoint(mesh.hull, x, y)
+		edgeZ := mesh.interpolator.Interpolate(edge.x, edge.y)
+		distance := math.Hypot(x-edge.x, y-edge.y)
+		if distance == 0 {
+			return edgeZ, nil
+		}
+		// Step back inside the probed area, away from the position, to find the slope
+		insideX := edge.x - (x-edge.x)/distance*extrapolationSlopeDistance
+		insideY := edge.y - (y-edge.y)/distance*extrapolationSlopeDistance
+		slope := (edgeZ - mesh.interpolator.Interpolate(insideX, insideY)) / extrapolationSlopeDistance
+		return edgeZ + slope*distance, nil
+	case ExtrapolationPlane:
+		if mesh.plane == nil {
+			a, b, c, err := fitPlane(mesh.Points)
+			if err != nil {
+				return 0, err
+			}
+			mesh.plane = &[3]float64{a, b, c}
+		}
+		return mesh.plane[0] + mesh.plane[1]*x + mesh.plane[2]*y, nil
+	case ExtrapolationFail:
+		return 0, fmt.Errorf("%w: X%.3f Y%.3f", ErrOutsideMesh, x, y)
+	default:
+		return 0, fmt.Errorf("unknown extrapolation policy: %s", mesh.Extrapolation)
+	}
+}
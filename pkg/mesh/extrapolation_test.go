@@ -0,0 +1,105 @@
+package mesh
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestIsInMesh(t *testing.T) {
+	grid := gridMesh(3, flat)
+	// A triangle, with a point inside it that isn't part of the hull
+	triangle := &Mesh{Points: []Point{{X: 0, Y: 0}, {X: 100, Y: 0}, {X: 0, Y: 100}, {X: 20, Y: 20}}}
+	tests := []struct {
+		name string
+		mesh *Mesh
+		x, y float64
+		want bool
+	}{
+		{"grid centre", grid, 50, 50, true},
+		{"grid corner", grid, 0, 0, true},
+		{"grid edge", grid, 100, 37, true},
+		{"grid left", grid, -0.01, 50, false},
+		{"grid above", grid, 50, 100.01, false},
+		{"grid diagonal", grid, 101, 101, false},
+		{"triangle inside", triangle, 40, 40, true},
+		{"triangle hypotenuse", triangle, 50, 50, true},
+		{"triangle outside hypotenuse", triangle, 60, 60, false},
+		{"triangle outside", triangle, 90, 90, false},
+	}
+	for _, test := range tests {
+		if inMesh := test.mesh.IsInMesh(test.x, test.y); inMesh != test.want {
+			t.Errorf("%s: IsInMesh(%v, %v) = %v, want %v", test.name, test.x, test.y, inMesh, test.want)
+		}
+	}
+}
+
+func TestExtrapolationPolicies(t *testing.T) {
+	// The bed rises by 1mm from X0 to X100, and is flat along Y
+	slope := func(x, y float64) float64 { return x / 100 }
+	tests := []struct {
+		policy ExtrapolationPolicy
+		x, y   float64
+		want   float64
+	}{
+		{"", 150, 50, 1},
+		{ExtrapolationClamp, 150, 50, 1},
+		{ExtrapolationClamp, -50, 50, 0},
+		{ExtrapolationClamp, 50, 150, 0.5},
+		{ExtrapolationClamp, 150, 150, 1},
+		{ExtrapolationLinear, 150, 50, 1.5},
+		{ExtrapolationLinear, -50, 50, -0.5},
+		{ExtrapolationLinear, 50, 150, 0.5},
+		{ExtrapolationLinear, 150, 150, 1.5},
+		{ExtrapolationPlane, 150, 50, 1.5},
+		{ExtrapolationPlane, -50, -50, -0.5},
+		// Inside the mesh, every policy interpolates
+		{ExtrapolationLinear, 25, 75, 0.25},
+		{ExtrapolationPlane, 25, 75, 0.25},
+		{ExtrapolationFail, 25, 75, 0.25},
+	}
+	for _, test := range tests {
+		mesh := gridMesh(3, slope)
+		mesh.Extrapolation = test.policy
+		z, err := mesh.bedHeight(test.x, test.y)
+		if err != nil {
+			t.Errorf("%q at X%v Y%v failed: %v", test.policy, test.x, test.y, err)
+		} else if math.Abs(z-test.want) > 1e-9 {
+			t.Errorf("%q at X%v Y%v = %v, want %v", test.policy, test.x, test.y, z, test.want)
+		}
+	}
+}
+
+func TestExtrapolationPlaneFitsAllPoints(t *testing.T) {
+	// The plane is the least squares fit of the whole mesh, not the nearest edge, so it ignores the bump in the middle
+	mesh := gridMesh(3, func(x, y float64) float64 {
+		if x == 50 && y == 50 {
+			return 0.9
+		}
+		return 0
+	})
+	mesh.Extrapolation = ExtrapolationPlane
+	z, err := mesh.bedHeight(200, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 0.1; math.Abs(z-want) > 1e-9 {
+		t.Errorf("bedHeight = %v, want %v", z, want)
+	}
+}
+
+func TestExtrapolationFail(t *testing.T) {
+	mesh := gridMesh(3, flat)
+	mesh.Extrapolation = ExtrapolationFail
+	if _, err := mesh.bedHeight(100.5, 50); !errors.Is(err, ErrOutsideMesh) {
+		t.Errorf("bedHeight outside the mesh returned %v, want %v", err, ErrOutsideMesh)
+	}
+	if _, err := mesh.GetZOffsetAtPosition(-1, -1, 0.2, testMaterial, PrintState{}); !errors.Is(err, ErrOutsideMesh) {
+		t.Errorf("GetZOffsetAtPosition outside the mesh returned %v, want %v", err, ErrOutsideMesh)
+	}
+
+	mesh.Extrapolation = "wrap"
+	if _, err := mesh.bedHeight(150, 50); err == nil {
+		t.Error("an unknown policy was accepted")
+	}
+}
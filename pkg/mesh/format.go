@@ -0,0 +1,183 @@
+package mesh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// FormatVersion is the version of the mesh file format that is written by SaveMesh.
+// Files with an older version (or no version at all) are migrated when they are loaded.
+const FormatVersion = 3
+
+// migrations[i] migrates a mesh file from version i to version i+1.
+var migrations = []func(file map[string]json.RawMessage) error{
+	// Unversioned files have the same fields as version 1, just without a version or metadata.
+	func(file map[string]json.RawMessage) error {
+		return nil
+	},
+	// Version 2 replaced MaterialOffsets with Materials, which have more than just an offset.
+	func(file map[string]json.RawMessage) error {
+		rawMaterialOffsets, ok := file["MaterialOffsets"]
+		if !ok {
+			return nil
+		}
+		delete(file, "MaterialOffsets")
+		var materialOffsets map[string]float64
+		if err := json.Unmarshal(rawMaterialOffsets, &materialOffsets); err != nil {
+			return fmt.Errorf("invalid material offsets: %w", err)
+		}
+		materials := make(map[string]MaterialProfile, len(materialOffsets))
+		for material, offset := range materialOffsets {
+			materials[material] = MaterialProfile{ZOffset: offset}
+		}
+		rawMaterials, err := json.Marshal(materials)
+		if err != nil {
+			return err
+		}
+		file["Materials"] = rawMaterials
+		return nil
+	},
+	// Version 3 replaced NumberOfPointsPerSide in the probe grid with separate numbers of points along X and Y.
+	func(file map[string]json.RawMessage) error {
+		rawMetadata, ok := file["Metadata"]
+		if !ok {
+			return nil
+		}
+		var metadata map[string]json.RawMessage
+		if err := json.Unmarshal(rawMetadata, &metadata); err != nil {
+			return fmt.Errorf("invalid metadata: %w", err)
+		}
+		rawProbeGrid, ok := metadata["ProbeGrid"]
+		if !ok {
+			return nil
+		}
+		var probeGrid map[string]json.RawMessage
+		if err := json.Unmarshal(rawProbeGrid, &probeGrid); err != nil {
+			return fmt.Errorf("invalid probe grid: %w", err)
+		}
+		if numberOfPointsPerSide, ok := probeGrid["NumberOfPointsPerSide"]; ok {
+			probeGrid["NumberOfPointsX"] = numberOfPointsPerSide
+			probeGrid["NumberOfPointsY"] = numberOfPointsPerSide
+			delete(probeGrid, "NumberOfPointsPerSide")
+		}
+
+		var err error
+		if metadata["ProbeGrid"], err = json.Marshal(probeGrid); err != nil {
+			return err
+		}
+		file["Metadata"], err = json.Marshal(metadata)
+		return err
+	},
+}
+
+// Metadata describes how a mesh was created. It isn't used for processing.
+type Metadata struct {
+	PrinterName string
+	ProbeDate   time.Time
+	ProbeGrid   ProbeGridParameters
+	// The bed temperature in °C when the mesh was probed. 0 if unknown.
+	BedTemperature float64
+	// The position of the probe relative to the nozzle
+	ProbeOffsetX float64
+	ProbeOffsetY float64
+}
+
+// ReadMesh decodes a mesh file, migrating it to the current format version and validating it.
+func ReadMesh(reader io.Reader) (*Mesh, error) {
+	var file map[string]json.RawMessage
+	if err := json.NewDecoder(reader).Decode(&file); err != nil {
+		return nil, err
+	}
+
+	var version int
+	if rawVersion, ok := file["Version"]; ok {
+		if err := json.Unmarshal(rawVersion, &version); err != nil {
+			return nil, fmt.Errorf("invalid mesh file version: %w", err)
+		}
+	}
+	if version > FormatVersion {
+		return nil, fmt.Errorf("mesh file version %d is newer than the supported version %d", version, FormatVersion)
+	}
+	for ; version < FormatVersion; version++ {
+		if err := migrations[version](file); err != nil {
+			return nil, fmt.Errorf("could not migrate mesh file from version %d: %w", version, err)
+		}
+	}
+	file["Version"] = json.RawMessage(fmt.Sprint(FormatVersion))
+
+	migratedFile, err := json.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+	var mesh Mesh
+	if err := json.Unmarshal(migratedFile, &mesh); err != nil {
+		return nil, err
+	}
+	if err := mesh.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid mesh: %w", err)
+	}
+	return &mesh, nil
+}
+
+// Validate checks that the mesh can be used for processing.
+func (mesh *Mesh) Validate() error {
+	var errs []error
+	if len(mesh.Points) == 0 {
+		errs = append(errs, errors.New("mesh has no points"))
+	}
+	if !isValid(mesh.BLTouchHeight) {
+		errs = append(errs, fmt.Errorf("invalid BLTouch height: %f", mesh.BLTouchHeight))
+	}
+	seenPoints := make(map[[2]float64]bool, len(mesh.Points))
+	for i, point := range mesh.Points {
+		if !isValid(point.X) || !isValid(point.Y) || !isValid(point.Z) {
+			errs = append(errs, fmt.Errorf("point %d has an invalid value: X%f Y%f Z%f", i, point.X, point.Y, point.Z))
+			continue
+		}
+		for _, sample := range point.Samples {
+			if !isValid(sample) {
+				errs = append(errs, fmt.Errorf("point %d has an invalid sample: %f", i, sample))
+			}
+		}
+		if seenPoints[[2]float64{point.X, point.Y}] {
+			errs = append(errs, fmt.Errorf("point %d is a duplicate of another point at X%.3f Y%.3f", i, point.X, point.Y))
+		}
+		seenPoints[[2]float64{point.X, point.Y}] = true
+	}
+	for material, profile := range mesh.Materials {
+		errs = append(errs, profile.validate(material, mesh)...)
+	}
+	for i, alias := range mesh.MaterialAliases {
+		if alias.FilamentType == "" {
+			errs = append(errs, fmt.Errorf("material alias %d has an empty filament type", i))
+		}
+		if _, ok := mesh.Materials[alias.Material]; !ok {
+			errs = append(errs, fmt.Errorf("material alias %d is for material %s, which doesn't exist", i, alias.Material))
+		}
+	}
+	if !isValid(mesh.FadeHeight) || !isValid(mesh.FadeStartHeight) || mesh.FadeHeight < 0 || (mesh.FadeHeight > 0 && mesh.FadeStartHeight >= mesh.FadeHeight) {
+		errs = append(errs, fmt.Errorf("invalid fade heights: start %f, end %f", mesh.FadeStartHeight, mesh.FadeHeight))
+	}
+	switch mesh.FadeCurve {
+	case "", FadeCurveLinear, FadeCurveSmoothstep, FadeCurveCosine:
+	default:
+		errs = append(errs, fmt.Errorf("unknown fade curve: %s", mesh.FadeCurve))
+	}
+	switch mesh.Interpolation {
+	case "", InterpolationBilinear, InterpolationBicubic, InterpolationThinPlateSpline, InterpolationInverseDistanceWeighting:
+		if _, err := NewInterpolator(mesh.Interpolation, mesh.Points); err != nil && len(mesh.Points) > 0 {
+			errs = append(errs, err)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown interpolation method: %s", mesh.Interpolation))
+	}
+	switch mesh.Extrapolation {
+	case "", ExtrapolationClamp, ExtrapolationLinear, ExtrapolationPlane, ExtrapolationFail:
+	default:
+		errs = append(errs, fmt.Errorf("unknown extrapolation policy: %s", mesh.Extrapolation))
+	}
+	return errors.Join(errs...)
+}
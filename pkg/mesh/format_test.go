@@ -0,0 +1,175 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestReadMeshMigrations checks that each old version of the format is migrated to the mesh in its golden file.
+func TestReadMeshMigrations(t *testing.T) {
+	for _, version := range []string{"v0", "v1", "v2"} {
+		t.Run(version, func(t *testing.T) {
+			mesh, err := LoadMesh(filepath.Join("testdata", "mesh_"+version+".json"))
+			if err != nil {
+				t.Fatalf("LoadMesh failed: %v", err)
+			}
+			if mesh.Version != FormatVersion {
+				t.Errorf("Version = %d, want %d", mesh.Version, FormatVersion)
+			}
+			got, err := json.MarshalIndent(mesh, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			goldenFilename := filepath.Join("testdata", "mesh_"+version+".golden.json")
+			if *update {
+				if err := os.WriteFile(goldenFilename, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(goldenFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("migrated mesh does not match %s:\n%s", goldenFilename, got)
+			}
+		})
+	}
+}
+
+// TestReadMeshCurrentVersion checks that a mesh in the current format is read back unchanged.
+func TestReadMeshCurrentVersion(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", "mesh_v2.golden.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mesh, err := ReadMesh(bytes.NewReader(want))
+	if err != nil {
+		t.Fatalf("ReadMesh failed: %v", err)
+	}
+	got, err := json.MarshalIndent(mesh, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got)+"\n" != string(want) {
+		t.Errorf("mesh changed when read back:\n%s", got)
+	}
+}
+
+func TestReadMeshErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"newer version", `{"Version": 99, "Points": [{"X": 0, "Y": 0, "Z": 0}]}`, "newer than the supported version"},
+		{"invalid version", `{"Version": "3"}`, "invalid mesh file version"},
+		{"invalid material offsets", `{"Version": 1, "Points": [{"X": 0, "Y": 0, "Z": 0}], "MaterialOffsets": {"PLA": "0.1"}}`, "invalid material offsets"},
+		{"invalid probe grid", `{"Version": 2, "Points": [{"X": 0, "Y": 0, "Z": 0}], "Metadata": {"ProbeGrid": []}}`, "invalid probe grid"},
+		{"no points", `{"Version": 3}`, "mesh has no points"},
+		{"not JSON", `Points: []`, "invalid character"},
+	}
+	for _, test := range tests {
+		if _, err := ReadMesh(strings.NewReader(test.file)); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: ReadMesh returned %v, want an error containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Mesh {
+		mesh := gridMesh(2, flat)
+		mesh.Materials["PETG"] = MaterialProfile{BedTemperatureOffsets: []BedTemperatureOffset{{70, 0}, {85, 0.02}}}
+		mesh.MaterialAliases = []MaterialAlias{{FilamentType: "PET", Material: "PETG"}}
+		mesh.FadeHeight = 10
+		return mesh
+	}
+	tests := []struct {
+		name   string
+		change func(mesh *Mesh)
+		want   string
+	}{
+		{"valid", func(mesh *Mesh) {}, ""},
+		{"no points", func(mesh *Mesh) { mesh.Points = nil }, "mesh has no points"},
+		{"invalid BLTouch height", func(mesh *Mesh) { mesh.BLTouchHeight = math.NaN() }, "invalid BLTouch height"},
+		{"invalid point", func(mesh *Mesh) { mesh.Points[1].Z = math.Inf(1) }, "point 1 has an invalid value"},
+		{"invalid sample", func(mesh *Mesh) { mesh.Points[2].Samples = []float64{0, math.NaN()} }, "point 2 has an invalid sample"},
+		{"duplicate point", func(mesh *Mesh) { mesh.Points = append(mesh.Points, Point{X: 0, Y: 0}) }, "point 4 is a duplicate"},
+		{"empty material name", func(mesh *Mesh) { mesh.Materials[""] = MaterialProfile{} }, "material has an empty name"},
+		{"invalid material offset", func(mesh *Mesh) { mesh.Materials[testMaterial] = MaterialProfile{ZOffset: math.NaN()} }, "material PLA has an invalid offset"},
+		{"unordered bed temperatures", func(mesh *Mesh) {
+			mesh.Materials["PETG"] = MaterialProfile{BedTemperatureOffsets: []BedTemperatureOffset{{85, 0}, {70, 0}}}
+		}, "aren't in increasing order"},
+		{"invalid bed temperature", func(mesh *Mesh) {
+			mesh.Materials["PETG"] = MaterialProfile{BedTemperatureOffsets: []BedTemperatureOffset{{0, 0.1}}}
+		}, "invalid bed temperature offset"},
+		{"negative squish", func(mesh *Mesh) { mesh.Materials[testMaterial] = MaterialProfile{FirstLayerSquish: -1} }, "invalid first layer squish"},
+		{"material fade below start", func(mesh *Mesh) {
+			mesh.FadeStartHeight = 5
+			mesh.Materials[testMaterial] = MaterialProfile{FadeHeight: 2}
+		}, "material PLA has an invalid fade height"},
+		{"empty alias", func(mesh *Mesh) { mesh.MaterialAliases[0].FilamentType = "" }, "material alias 0 has an empty filament type"},
+		{"alias to missing material", func(mesh *Mesh) { mesh.MaterialAliases[0].Material = "ABS" }, "material ABS, which doesn't exist"},
+		{"negative fade height", func(mesh *Mesh) { mesh.FadeHeight = -1 }, "invalid fade heights"},
+		{"fade start above end", func(mesh *Mesh) { mesh.FadeStartHeight = 10 }, "invalid fade heights"},
+		{"unknown fade curve", func(mesh *Mesh) { mesh.FadeCurve = "cubic" }, "unknown fade curve"},
+		{"unknown interpolation", func(mesh *Mesh) { mesh.Interpolation = "nearest" }, "unknown interpolation method"},
+		{"bilinear for scattered points", func(mesh *Mesh) {
+			mesh.Interpolation = InterpolationBilinear
+			mesh.Points = []Point{{X: 0, Y: 0}, {X: 50, Y: 100}, {X: 100, Y: 0}}
+		}, "bilinear interpolation needs the points to be in columns"},
+		{"unknown extrapolation", func(mesh *Mesh) { mesh.Extrapolation = "wrap" }, "unknown extrapolation policy"},
+	}
+	for _, test := range tests {
+		mesh := valid()
+		test.change(mesh)
+		err := mesh.Validate()
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%s: Validate returned %v", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: Validate returned %v, want an error containing %q", test.name, err, test.want)
+		}
+	}
+
+	// Every problem is reported, not just the first
+	mesh := valid()
+	mesh.BLTouchHeight = math.NaN()
+	mesh.FadeCurve = "cubic"
+	if err := mesh.Validate(); err == nil || strings.Count(err.Error(), "\n") != 1 {
+		t.Errorf("Validate returned %v, want both errors", err)
+	}
+}
+
+func TestSaveMeshChecksInterpolation(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.mesh")
+	if err := SaveMesh(gridMesh(3, flat), filename); err != nil {
+		t.Fatalf("SaveMesh failed: %v", err)
+	}
+	saved, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A mesh that couldn't be used to process a file isn't saved, and the old file is kept
+	mesh := gridMesh(3, flat)
+	mesh.Interpolation = InterpolationBicubic
+	mesh.Points = []Point{{X: 0, Y: 0}, {X: 50, Y: 100}, {X: 100, Y: 0}}
+	if err := SaveMesh(mesh, filename); err == nil || !strings.Contains(err.Error(), "could not save mesh") {
+		t.Errorf("SaveMesh returned %v, want an error", err)
+	}
+	if kept, err := os.ReadFile(filename); err != nil || !bytes.Equal(kept, saved) {
+		t.Errorf("the old mesh file was changed: %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RobinRCM/sklearn/interpolate"
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"sort"
+)
+
+// Interpolator estimates the height of the bed between the probed points.
+type Interpolator interface {
+	// Interpolate returns the Z at the given position, or NaN if it can't be estimated.
+	Interpolate(x, y float64) float64
+}
+
+type InterpolationMethod string
+
+const (
+	InterpolationBilinear                 InterpolationMethod = "bilinear"
+	InterpolationBicubic                  InterpolationMethod = "bicubic"
+	InterpolationThinPlateSpline          InterpolationMethod = "thin-plate-spline"
+	InterpolationInverseDistanceWeighting InterpolationMethod = "inverse-distance-weighting"
+)
+
+var InterpolationMethods = []InterpolationMethod{
+	InterpolationBilinear,
+	InterpolationBicubic,
+	InterpolationThinPlateSpline,
+	InterpolationInverseDistanceWeighting,
+}
+
+const (
+	InverseDistanceWeightingPower = 2 // Higher values make the nearest points more important
+	ThinPlateSplineSmoothing      = 0 // 0 passes exactly through every point, higher values smooth out probe noise
+)
+
+// isInColumns returns whether the points are in columns of at least 2 points with the same X, like a grid (which may have gaps).
+func isInColumns(points []Point) bool {
+	columns := make(map[float64]int)
+	for _, point := range points {
+		columns[point.X]++
+	}
+	if len(columns) < 2 {
+		return false
+	}
+	for _, numberOfPoints := range columns {
+		if numberOfPoints < 2 {
+			return false
+		}
+	}
+	return true
+}
+
+// DefaultInterpolationMethod returns the method used when a mesh doesn't have one, which is bilinear for grids and thin plate spline for irregular points.
+func DefaultInterpolationMethod(points []Point) InterpolationMethod {
+	if isInColumns(points) {
+		return InterpolationBilinear
+	}
+	return InterpolationThinPlateSpline
+}
+
+// NewInterpolator creates an Interpolator using the given method. An empty method is DefaultInterpolationMethod.
+func NewInterpolator(method InterpolationMethod, points []Point) (Interpolator, error) {
+	if len(points) == 0 {
+		return nil, errors.New("mesh has no points")
+	}
+	if method == "" {
+		method = DefaultInterpolationMethod(points)
+	}
+	switch method {
+	case InterpolationBilinear:
+		return newBilinearInterpolator(points)
+	case InterpolationBicubic:
+		return newBicubicInterpolator(points)
+	case InterpolationThinPlateSpline:
+		return newThinPlateSplineInterpolator(points)
+	case InterpolationInverseDistanceWeighting:
+		return inverseDistanceWeightingInterpolator(points), nil
+	default:
+		return nil, fmt.Errorf("unknown interpolation method: %s", method)
+	}
+}
+
+type bilinearInterpolator func(x, y float64) float64
+
+func newBilinearInterpolator(points []Point) (Interpolator, error) {
+	if !isInColumns(points) {
+		return nil, errors.New("bilinear interpolation needs the points to be in columns of at least 2 points with the same X, use thin plate spline or inverse distance weighting for irregular points")
+	}
+	X := make([]float64, len(points))
+	Y := make([]float64, len(points))
+	Z := make([]float64, len(points))
+	for i := 0; i < len(points); i++ {
+		X[i] = points[i].X
+		Y[i] = points[i].Y
+		Z[i] = points[i].Z
+	}
+	return bilinearInterpolator(interpolate.Interp2d(X, Y, Z)), nil
+}
+
+func (interpolator bilinearInterpolator) Interpolate(x, y float64) float64 {
+	return interpolator(x, y)
+}
+
+// bicubicInterpolator fits a cubic spline along Y through each column of points, and then a cubic spline along X through the columns.
+type bicubicInterpolator struct {
+	columnXs      []float64
+	columnSplines []func(y float64) float64
+}
+
+func newBicubicInterpolator(points []Point) (Interpolator, error) {
+	columns := make(map[float64][]Point)
+	for _, point := range points {
+		columns[point.X] = append(columns[point.X], point)
+	}
+	if len(columns) < 2 {
+		return nil, errors.New("bicubic interpolation needs at least 2 columns of points")
+	}
+
+	var interpolator bicubicInterpolator
+	for x := range columns {
+		interpolator.columnXs = append(interpolator.columnXs, x)
+	}
+	sort.Float64s(interpolator.columnXs)
+	for _, x := range interpolator.columnXs {
+		column := columns[x]
+		if len(column) < 2 {
+			return nil, fmt.Errorf("bicubic interpolation needs at least 2 points in each column, but X=%.3f has %d", x, len(column))
+		}
+		ys := make([]float64, len(column))
+		zs := make([]float64, len(column))
+		for i, point := range column {
+			ys[i] = point.Y
+			zs[i] = point.Z
+		}
+		interpolator.columnSplines = append(interpolator.columnSplines, interpolate.CubicSpline(ys, zs))
+	}
+	return &interpolator, nil
+}
+
+func (interpolator *bicubicInterpolator) Interpolate(x, y float64) float64 {
+	columnZs := make([]float64, len(interpolator.columnSplines))
+	for i, columnSpline := range interpolator.columnSplines {
+		columnZs[i] = columnSpline(y)
+	}
+	return interpolate.CubicSpline(interpolator.columnXs, columnZs)(x)
+}
+
+// thinPlateSplineInterpolator fits the smoothest surface that passes through every point, which suits scattered points.
+type thinPlateSplineInterpolator struct {
+	points  []Point
+	weights []float64
+	// The affine part of the surface, z = a0 + a1*x + a2*y
+	a0, a1, a2 float64
+}
+
+func thinPlateSplineKernel(distance float64) float64 {
+	if distance == 0 {
+		return 0
+	}
+	return distance * distance * math.Log(distance)
+}
+
+func newThinPlateSplineInterpolator(points []Point) (Interpolator, error) {
+	if len(points) < 3 {
+		return nil, errors.New("thin plate spline interpolation needs at least 3 points")
+	}
+	// Solve the system:
+	// [K+λI P] [w] = [z]
+	// [P^T  0] [a]   [0]
+	n := len(points)
+	A := mat.NewDense(n+3, n+3, nil)
+	b := mat.NewVecDense(n+3, nil)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			distance := math.Hypot(points[i].X-points[j].X, points[i].Y-points[j].Y)
+			A.Set(i, j, thinPlateSplineKernel(distance))
+		}
+		A.Set(i, i, ThinPlateSplineSmoothing)
+		A.Set(i, n, 1)
+		A.Set(i, n+1, points[i].X)
+		A.Set(i, n+2, points[i].Y)
+		A.Set(n, i, 1)
+		A.Set(n+1, i, points[i].X)
+		A.Set(n+2, i, points[i].Y)
+		b.SetVec(i, points[i].Z)
+	}
+	var solution mat.VecDense
+	if err := solution.SolveVec(A, b); err != nil {
+		return nil, fmt.Errorf("could not fit thin plate spline (are all the points in a line?): %w", err)
+	}
+
+	interpolator := thinPlateSplineInterpolator{
+		points:  points,
+		weights: make([]float64, n),
+		a0:      solution.AtVec(n),
+		a1:      solution.AtVec(n + 1),
+		a2:      solution.AtVec(n + 2),
+	}
+	for i := range interpolator.weights {
+		interpolator.weights[i] = solution.AtVec(i)
+	}
+	return &interpolator, nil
+}
+
+func (interpolator *thinPlateSplineInterpolator) Interpolate(x, y float64) float64 {
+	z := interpolator.a0 + interpolator.a1*x + interpolator.a2*y
+	for i, point := range interpolator.points {
+		z += interpolator.weights[i] * thinPlateSplineKernel(math.Hypot(x-point.X, y-point.Y))
+	}
+	return z
+}
+
+// inverseDistanceWeightingInterpolator averages all the points, weighted by how close they are.
+type inverseDistanceWeightingInterpolator []Point
+
+func (points inverseDistanceWeightingInterpolator) Interpolate(x, y float64) float64 {
+	var weightedZ, totalWeight float64
+	for _, point := range points {
+		distance := math.Hypot(x-point.X, y-point.Y)
+		if distance == 0 {
+			return point.Z
+		}
+		weight := 1 / math.Pow(distance, InverseDistanceWeightingPower)
+		weightedZ += weight * point.Z
+		totalWeight += weight
+	}
+	return weightedZ / totalWeight
+}
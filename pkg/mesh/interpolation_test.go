@@ -0,0 +1,113 @@
+package mesh
+
+import (
+	"math"
+	"testing"
+)
+
+// plane is a tilted bed that every interpolation method should reproduce exactly.
+func plane(x, y float64) float64 {
+	return 0.1 + 0.002*x - 0.003*y
+}
+
+// saddle is a bed that bilinear interpolation reproduces exactly, as it is linear along X and Y.
+func saddle(x, y float64) float64 {
+	return (x - 50) * (y - 50) / 5000
+}
+
+// bowl is a curved bed that only passes through the probed points exactly.
+func bowl(x, y float64) float64 {
+	return (math.Pow(x-50, 2) + math.Pow(y-50, 2)) / 10000
+}
+
+func newTestInterpolator(t *testing.T, method InterpolationMethod, points []Point) Interpolator {
+	t.Helper()
+	interpolator, err := NewInterpolator(method, points)
+	if err != nil {
+		t.Fatalf("NewInterpolator(%s) failed: %v", method, err)
+	}
+	return interpolator
+}
+
+func TestInterpolatorsPassThroughPoints(t *testing.T) {
+	points := gridMesh(5, bowl).Points
+	for _, method := range InterpolationMethods {
+		interpolator := newTestInterpolator(t, method, points)
+		for _, point := range points {
+			if z := interpolator.Interpolate(point.X, point.Y); math.Abs(z-point.Z) > 1e-9 {
+				t.Errorf("%s at X%v Y%v = %v, want %v", method, point.X, point.Y, z, point.Z)
+			}
+		}
+	}
+}
+
+func TestInterpolatorsOnAnalyticSurfaces(t *testing.T) {
+	positions := [][2]float64{{10, 10}, {12.5, 37.5}, {50, 50}, {62.5, 87.5}, {99, 1}}
+	tests := []struct {
+		method    InterpolationMethod
+		surface   func(x, y float64) float64
+		tolerance float64
+	}{
+		{InterpolationBilinear, plane, 1e-9},
+		{InterpolationBilinear, saddle, 1e-9},
+		{InterpolationBicubic, plane, 1e-9},
+		{InterpolationThinPlateSpline, plane, 1e-9},
+		// Splines through a curved surface are close but not exact, as they flatten out towards the edges.
+		// Bilinear interpolation is out by up to 0.03mm between these points.
+		{InterpolationBicubic, bowl, 0.02},
+		{InterpolationThinPlateSpline, bowl, 0.02},
+	}
+	for _, test := range tests {
+		interpolator := newTestInterpolator(t, test.method, gridMesh(5, test.surface).Points)
+		for _, position := range positions {
+			want := test.surface(position[0], position[1])
+			if z := interpolator.Interpolate(position[0], position[1]); math.Abs(z-want) > test.tolerance {
+				t.Errorf("%s at X%v Y%v = %v, want %v", test.method, position[0], position[1], z, want)
+			}
+		}
+	}
+}
+
+func TestInverseDistanceWeighting(t *testing.T) {
+	points := []Point{{X: 0, Y: 0, Z: 0}, {X: 100, Y: 0, Z: 1}, {X: 0, Y: 100, Z: 2}, {X: 100, Y: 100, Z: 3}}
+	interpolator := newTestInterpolator(t, InterpolationInverseDistanceWeighting, points)
+	tests := []struct {
+		x, y, z float64
+	}{
+		// Equally far from every point, so the average of them
+		{50, 50, 1.5},
+		// The near points (average 0.5) are 2600mm² away and the far points (average 2.5) 10600mm², weighted by 1/distance²
+		{50, 10, (0.5/2600 + 2.5/10600) / (1/2600.0 + 1/10600.0)},
+		{0, 0, 0},
+	}
+	for _, test := range tests {
+		if z := interpolator.Interpolate(test.x, test.y); math.Abs(z-test.z) > 1e-9 {
+			t.Errorf("at X%v Y%v = %v, want %v", test.x, test.y, z, test.z)
+		}
+	}
+}
+
+func TestNewInterpolator(t *testing.T) {
+	grid := gridMesh(3, flat).Points
+	irregular := []Point{{X: 0, Y: 0}, {X: 100, Y: 10}, {X: 40, Y: 100}, {X: 60, Y: 50}}
+	if method := DefaultInterpolationMethod(grid); method != InterpolationBilinear {
+		t.Errorf("DefaultInterpolationMethod(grid) = %s, want %s", method, InterpolationBilinear)
+	}
+	if method := DefaultInterpolationMethod(irregular); method != InterpolationThinPlateSpline {
+		t.Errorf("DefaultInterpolationMethod(irregular) = %s, want %s", method, InterpolationThinPlateSpline)
+	}
+	if _, err := NewInterpolator("", irregular); err != nil {
+		t.Errorf("the default method failed on irregular points: %v", err)
+	}
+	for _, method := range []InterpolationMethod{InterpolationBilinear, InterpolationBicubic} {
+		if _, err := NewInterpolator(method, irregular); err == nil {
+			t.Errorf("%s accepted irregular points", method)
+		}
+	}
+	if _, err := NewInterpolator("nearest", grid); err == nil {
+		t.Error("an unknown method was accepted")
+	}
+	if _, err := NewInterpolator(InterpolationBilinear, nil); err == nil {
+		t.Error("a mesh without points was accepted")
+	}
+}
@@ -0,0 +1,137 @@
+package mesh
+
+import (
+	"fmt"
+	"math"
+)
+
+// ProbeLayout is how the points that are probed are arranged on the bed.
+type ProbeLayout string
+
+const (
+	// A rectangular grid, for normal beds
+	ProbeLayoutGrid ProbeLayout = "grid"
+	// A point in the centre surrounded by rings of 6, 12, 18... points, for round (eg. delta) beds
+	ProbeLayoutCircular ProbeLayout = "circular"
+	// An explicit list of points
+	ProbeLayoutPoints ProbeLayout = "points"
+)
+
+var ProbeLayouts = []ProbeLayout{ProbeLayoutGrid, ProbeLayoutCircular, ProbeLayoutPoints}
+
+// Position is a position on the bed.
+type Position struct {
+	X float64
+	Y float64
+}
+
+// ExclusionZone is an area of the bed that isn't probed, eg. because there is a clip or magnet in the way.
+type ExclusionZone struct {
+	MinX float64
+	MinY float64
+	MaxX float64
+	MaxY float64
+}
+
+// Contains returns whether the position is inside (or on the edge of) the zone.
+func (zone ExclusionZone) Contains(x, y float64) bool {
+	return x >= zone.MinX && x <= zone.MaxX && y >= zone.MinY && y <= zone.MaxY
+}
+
+// ProbeGridParameters describes the points that were probed to create a mesh.
+type ProbeGridParameters struct {
+	// Empty means grid
+	Layout ProbeLayout
+	// The area covered by a grid layout
+	MinX            float64
+	MinY            float64
+	MaxX            float64
+	MaxY            float64
+	NumberOfPointsX uint8
+	NumberOfPointsY uint8
+	// The circle covered by a circular layout
+	CentreX       float64
+	CentreY       float64
+	Radius        float64
+	NumberOfRings uint8
+	// The points of a points layout
+	Points []Position
+	// Points in these zones are skipped
+	ExclusionZones          []ExclusionZone
+	NumberOfRepeatsPerPoint uint8
+}
+
+// Validate checks that the parameters describe some points.
+func (grid ProbeGridParameters) Validate() error {
+	switch grid.Layout {
+	case "", ProbeLayoutGrid:
+		if grid.NumberOfPointsX < 2 || grid.NumberOfPointsY < 2 {
+			return fmt.Errorf("a grid needs at least 2 points along X and Y, not %d by %d", grid.NumberOfPointsX, grid.NumberOfPointsY)
+		}
+		if grid.MinX >= grid.MaxX || grid.MinY >= grid.MaxY {
+			return fmt.Errorf("the grid X%.3f Y%.3f to X%.3f Y%.3f is empty", grid.MinX, grid.MinY, grid.MaxX, grid.MaxY)
+		}
+	case ProbeLayoutCircular:
+		if grid.NumberOfRings < 1 || grid.Radius <= 0 {
+			return fmt.Errorf("a circular layout needs at least 1 ring and a radius, not %d rings and a radius of %.3f", grid.NumberOfRings, grid.Radius)
+		}
+	case ProbeLayoutPoints:
+	default:
+		return fmt.Errorf("unknown probe layout: %s", grid.Layout)
+	}
+	if numberOfPositions := len(grid.Positions()); numberOfPositions < 3 {
+		return fmt.Errorf("a mesh needs at least 3 points, but there are only %d outside of the exclusion zones", numberOfPositions)
+	}
+	return nil
+}
+
+// Positions returns the positions to probe in the order that they should be probed, leaving out any in the exclusion zones.
+func (grid ProbeGridParameters) Positions() []Position {
+	var positions []Position
+	add := func(x, y float64) {
+		for _, zone := range grid.ExclusionZones {
+			if zone.Contains(x, y) {
+				return
+			}
+		}
+		positions = append(positions, Position{x, y})
+	}
+
+	switch grid.Layout {
+	case "", ProbeLayoutGrid:
+		if grid.NumberOfPointsX < 2 || grid.NumberOfPointsY < 2 {
+			return nil
+		}
+		// Go up and down the columns alternately to avoid moving back across the bed
+		reverseYDirection := false
+		for xIndex := uint8(0); xIndex < grid.NumberOfPointsX; xIndex++ {
+			x := grid.MinX + ((grid.MaxX - grid.MinX) * (float64(xIndex) / float64(grid.NumberOfPointsX-1)))
+			for yIndex := uint8(0); yIndex < grid.NumberOfPointsY; yIndex++ {
+				actualYIndex := yIndex
+				if reverseYDirection {
+					actualYIndex = grid.NumberOfPointsY - 1 - yIndex
+				}
+				add(x, grid.MinY+((grid.MaxY-grid.MinY)*(float64(actualYIndex)/float64(grid.NumberOfPointsY-1))))
+			}
+			reverseYDirection = !reverseYDirection
+		}
+	case ProbeLayoutCircular:
+		add(grid.CentreX, grid.CentreY)
+		for ring := 1; ring <= int(grid.NumberOfRings); ring++ {
+			radius := grid.Radius * float64(ring) / float64(grid.NumberOfRings)
+			numberOfPoints := 6 * ring
+			for i := 0; i < numberOfPoints; i++ {
+				angle := 2 * math.Pi * float64(i) / float64(numberOfPoints)
+				// Rounded so that points that should be on the same line are exactly on it
+				x := math.Round((grid.CentreX+radius*math.Cos(angle))*1000) / 1000
+				y := math.Round((grid.CentreY+radius*math.Sin(angle))*1000) / 1000
+				add(x, y)
+			}
+		}
+	case ProbeLayoutPoints:
+		for _, point := range grid.Points {
+			add(point.X, point.Y)
+		}
+	}
+	return positions
+}
@@ -0,0 +1,131 @@
+package mesh
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPositionsGrid(t *testing.T) {
+	grid := ProbeGridParameters{MinX: 0, MinY: 10, MaxX: 100, MaxY: 30, NumberOfPointsX: 3, NumberOfPointsY: 2}
+	// Up the first column, down the second and up the third
+	want := []Position{{0, 10}, {0, 30}, {50, 30}, {50, 10}, {100, 10}, {100, 30}}
+	if got := grid.Positions(); !equalPositions(got, want) {
+		t.Errorf("Positions = %v, want %v", got, want)
+	}
+}
+
+func TestPositionsCircular(t *testing.T) {
+	tests := []struct {
+		numberOfRings int
+		want          int
+	}{
+		{1, 1 + 6},
+		{2, 1 + 6 + 12},
+		{3, 1 + 6 + 12 + 18},
+	}
+	for _, test := range tests {
+		grid := ProbeGridParameters{Layout: ProbeLayoutCircular, CentreX: 10, CentreY: -5, Radius: 60, NumberOfRings: uint8(test.numberOfRings)}
+		positions := grid.Positions()
+		if len(positions) != test.want {
+			t.Errorf("%d rings: %d positions, want %d", test.numberOfRings, len(positions), test.want)
+			continue
+		}
+		if positions[0] != (Position{10, -5}) {
+			t.Errorf("%d rings: the first position is %v, want the centre", test.numberOfRings, positions[0])
+		}
+
+		// Each ring is evenly spaced around the centre, with the outermost ring at the radius
+		start := 1
+		for ring := 1; ring <= test.numberOfRings; ring++ {
+			radius := 60 * float64(ring) / float64(test.numberOfRings)
+			for i, position := range positions[start : start+6*ring] {
+				if distance := math.Hypot(position.X-10, position.Y+5); math.Abs(distance-radius) > 0.001 {
+					t.Errorf("%d rings: point %d of ring %d is %.4f from the centre, want %v", test.numberOfRings, i, ring, distance, radius)
+				}
+				wantAngle := 2 * math.Pi * float64(i) / float64(6*ring)
+				if angle := math.Atan2(position.Y+5, position.X-10); math.Abs(math.Remainder(angle-wantAngle, 2*math.Pi)) > 0.0001 {
+					t.Errorf("%d rings: point %d of ring %d is at %.4f radians, want %.4f", test.numberOfRings, i, ring, angle, wantAngle)
+				}
+			}
+			start += 6 * ring
+		}
+	}
+}
+
+func TestPositionsExclusionZones(t *testing.T) {
+	grid := ProbeGridParameters{MinX: 0, MinY: 0, MaxX: 100, MaxY: 100, NumberOfPointsX: 3, NumberOfPointsY: 3}
+	tests := []struct {
+		name  string
+		zones []ExclusionZone
+		want  []Position
+	}{
+		{"none", nil, []Position{{0, 0}, {0, 50}, {0, 100}, {50, 100}, {50, 50}, {50, 0}, {100, 0}, {100, 50}, {100, 100}}},
+		{"clip in a corner", []ExclusionZone{{MinX: -10, MinY: -10, MaxX: 10, MaxY: 10}}, []Position{{0, 50}, {0, 100}, {50, 100}, {50, 50}, {50, 0}, {100, 0}, {100, 50}, {100, 100}}},
+		// Points on the edge of a zone are excluded
+		{"edge of a zone", []ExclusionZone{{MinX: 50, MinY: 50, MaxX: 60, MaxY: 60}}, []Position{{0, 0}, {0, 50}, {0, 100}, {50, 100}, {50, 0}, {100, 0}, {100, 50}, {100, 100}}},
+		{"several zones", []ExclusionZone{{MinX: -1, MinY: 99, MaxX: 101, MaxY: 101}, {MinX: 40, MinY: -1, MaxX: 60, MaxY: 60}}, []Position{{0, 0}, {0, 50}, {100, 0}, {100, 50}}},
+		{"a zone between the points", []ExclusionZone{{MinX: 10, MinY: 10, MaxX: 40, MaxY: 40}}, []Position{{0, 0}, {0, 50}, {0, 100}, {50, 100}, {50, 50}, {50, 0}, {100, 0}, {100, 50}, {100, 100}}},
+		{"everything", []ExclusionZone{{MinX: 0, MinY: 0, MaxX: 100, MaxY: 100}}, nil},
+	}
+	for _, test := range tests {
+		grid.ExclusionZones = test.zones
+		if got := grid.Positions(); !equalPositions(got, test.want) {
+			t.Errorf("%s: Positions = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// The centre of a circular layout can be excluded too
+	circular := ProbeGridParameters{Layout: ProbeLayoutCircular, Radius: 50, NumberOfRings: 1, ExclusionZones: []ExclusionZone{{MinX: -1, MinY: -1, MaxX: 1, MaxY: 1}}}
+	if positions := circular.Positions(); len(positions) != 6 {
+		t.Errorf("Positions = %v, want the ring without the centre", positions)
+	}
+}
+
+func TestProbeGridParametersValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		grid ProbeGridParameters
+		want string
+	}{
+		{"grid", ProbeGridParameters{MaxX: 100, MaxY: 100, NumberOfPointsX: 2, NumberOfPointsY: 3}, ""},
+		{"circular", ProbeGridParameters{Layout: ProbeLayoutCircular, Radius: 50, NumberOfRings: 1}, ""},
+		{"points", ProbeGridParameters{Layout: ProbeLayoutPoints, Points: []Position{{0, 0}, {10, 0}, {0, 10}}}, ""},
+		{"grid with 1 column", ProbeGridParameters{MaxX: 100, MaxY: 100, NumberOfPointsX: 1, NumberOfPointsY: 3}, "at least 2 points along X and Y"},
+		{"empty grid", ProbeGridParameters{MinX: 100, MaxX: 100, MaxY: 100, NumberOfPointsX: 2, NumberOfPointsY: 2}, "is empty"},
+		{"no rings", ProbeGridParameters{Layout: ProbeLayoutCircular, Radius: 50}, "at least 1 ring"},
+		{"no radius", ProbeGridParameters{Layout: ProbeLayoutCircular, NumberOfRings: 2}, "at least 1 ring and a radius"},
+		{"too few points", ProbeGridParameters{Layout: ProbeLayoutPoints, Points: []Position{{0, 0}, {10, 0}}}, "only 2"},
+		{"unknown layout", ProbeGridParameters{Layout: "hexagonal"}, "unknown probe layout"},
+		{"everything excluded", ProbeGridParameters{
+			MaxX: 100, MaxY: 100, NumberOfPointsX: 3, NumberOfPointsY: 3,
+			ExclusionZones: []ExclusionZone{{MinX: -1, MinY: -1, MaxX: 101, MaxY: 101}},
+		}, "only 0 outside of the exclusion zones"},
+		{"all but 2 excluded", ProbeGridParameters{
+			Layout: ProbeLayoutCircular, Radius: 50, NumberOfRings: 1,
+			ExclusionZones: []ExclusionZone{{MinX: -100, MinY: -100, MaxX: 100, MaxY: 1}},
+		}, "only 2 outside of the exclusion zones"},
+	}
+	for _, test := range tests {
+		err := test.grid.Validate()
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%s: Validate returned %v", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: Validate returned %v, want an error containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+func equalPositions(a, b []Position) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i].X-b[i].X) > 1e-9 || math.Abs(a[i].Y-b[i].Y) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package mesh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mesh-levelling/pkg/gcode"
+	"sort"
+	"strings"
+)
+
+// MaterialProfile is how a material changes the levelling.
+type MaterialProfile struct {
+	// Added to the Z of every move
+	ZOffset float64
+	// Added to ZOffset depending on the bed temperature, as the bed and the probe move as they heat up.
+	// Offsets are interpolated between temperatures, and the nearest temperature is used outside of them.
+	// Not used if the gcode doesn't set the bed temperature.
+	BedTemperatureOffsets []BedTemperatureOffset
+	// Multiplies the height of the first layer, eg. 0.9 squishes it by 10%. 0 means 1.
+	FirstLayerSquish float64
+	// Overrides the mesh's FadeHeight if set
+	FadeHeight float64
+}
+
+type BedTemperatureOffset struct {
+	// In °C
+	BedTemperature float64
+	ZOffset        float64
+}
+
+// PrintState is what is known about the print at a position, which changes how a material profile is applied.
+type PrintState struct {
+	// In °C. 0 if unknown.
+	BedTemperature float64
+	// Whether the position is on the first layer
+	FirstLayer bool
+}
+
+// zOffset returns the offset of the material, not including the mesh.
+func (profile *MaterialProfile) zOffset(z float64, state PrintState) float64 {
+	offset := profile.ZOffset + profile.bedTemperatureOffset(state.BedTemperature)
+	if state.FirstLayer && profile.FirstLayerSquish != 0 {
+		offset += z * (profile.FirstLayerSquish - 1)
+	}
+	return offset
+}
+
+func (profile *MaterialProfile) bedTemperatureOffset(bedTemperature float64) float64 {
+	offsets := profile.BedTemperatureOffsets
+	if bedTemperature <= 0 || len(offsets) == 0 {
+		return 0
+	}
+	index := sort.Search(len(offsets), func(i int) bool {
+		return offsets[i].BedTemperature >= bedTemperature
+	})
+	if index == 0 {
+		return offsets[0].ZOffset
+	} else if index == len(offsets) {
+		return offsets[len(offsets)-1].ZOffset
+	}
+	below := offsets[index-1]
+	above := offsets[index]
+	progress := (bedTemperature - below.BedTemperature) / (above.BedTemperature - below.BedTemperature)
+	return below.ZOffset + (above.ZOffset-below.ZOffset)*progress
+}
+
+// fadeHeight returns the fade height of the mesh when printing with the material.
+func (profile *MaterialProfile) fadeHeight(mesh *Mesh) float64 {
+	if profile.FadeHeight > 0 {
+		return profile.FadeHeight
+	}
+	return mesh.FadeHeight
+}
+
+// validate checks the profile of the named material.
+func (profile *MaterialProfile) validate(name string, mesh *Mesh) []error {
+	var errs []error
+	if name == "" {
+		errs = append(errs, errors.New("material has an empty name"))
+	}
+	if !isValid(profile.ZOffset) {
+		errs = append(errs, fmt.Errorf("material %s has an invalid offset: %f", name, profile.ZOffset))
+	}
+	for i, offset := range profile.BedTemperatureOffsets {
+		if !isValid(offset.BedTemperature) || offset.BedTemperature <= 0 || !isValid(offset.ZOffset) {
+			errs = append(errs, fmt.Errorf("material %s has an invalid bed temperature offset: %f at %f°C", name, offset.ZOffset, offset.BedTemperature))
+		} else if i > 0 && offset.BedTemperature <= profile.BedTemperatureOffsets[i-1].BedTemperature {
+			errs = append(errs, fmt.Errorf("material %s has bed temperature offsets that aren't in increasing order of temperature", name))
+		}
+	}
+	if !isValid(profile.FirstLayerSquish) || profile.FirstLayerSquish < 0 {
+		errs = append(errs, fmt.Errorf("material %s has an invalid first layer squish: %f", name, profile.FirstLayerSquish))
+	}
+	if !isValid(profile.FadeHeight) || profile.FadeHeight < 0 || (profile.FadeHeight > 0 && mesh.FadeStartHeight >= profile.FadeHeight) {
+		errs = append(errs, fmt.Errorf("material %s has an invalid fade height: %f", name, profile.FadeHeight))
+	}
+	return errs
+}
+
+// MaterialAlias maps a filament type from the metadata in gcode to a material in Materials.
+type MaterialAlias struct {
+	// The filament type given by the slicer, case insensitive
+	FilamentType string
+	// The range of nozzle temperatures that this alias applies to. 0 means no limit.
+	MinimumNozzleTemperature float64
+	MaximumNozzleTemperature float64
+	// The key in Materials
+	Material string
+}
+
+func (alias MaterialAlias) matches(metadata gcode.Metadata) bool {
+	if !strings.EqualFold(alias.FilamentType, metadata.FilamentType) {
+		return false
+	}
+	if alias.MinimumNozzleTemperature != 0 && metadata.NozzleTemperature < alias.MinimumNozzleTemperature {
+		return false
+	}
+	if alias.MaximumNozzleTemperature != 0 && metadata.NozzleTemperature > alias.MaximumNozzleTemperature {
+		return false
+	}
+	return true
+}
+
+// ResolveMaterial finds the material in Materials for the metadata of some gcode.
+// The first matching alias is used, otherwise a material with the same name as the filament type.
+func (mesh *Mesh) ResolveMaterial(metadata gcode.Metadata) (string, bool) {
+	if metadata.FilamentType == "" {
+		return "", false
+	}
+	for _, alias := range mesh.MaterialAliases {
+		if alias.matches(metadata) {
+			return alias.Material, true
+		}
+	}
+	for material := range mesh.Materials {
+		if strings.EqualFold(material, metadata.FilamentType) {
+			return material, true
+		}
+	}
+	return "", false
+}
+
+// detectMetadata reads the metadata of gcode, and returns a reader that reads the gcode from the start.
+// If the reader can seek, the whole gcode is read and then it seeks back.
+// Otherwise only the gcode up to the first move is read, as the gcode can't be read twice, so metadata at the end (eg. PrusaSlicer's settings) is missed.
+// complete is whether the whole gcode was read.
+func detectMetadata(reader io.Reader) (metadata gcode.Metadata, gcodeReader io.Reader, complete bool, err error) {
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			metadata, err := gcode.ReadMetadata(seeker)
+			if err != nil {
+				return gcode.Metadata{}, nil, false, err
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return gcode.Metadata{}, nil, false, err
+			}
+			return metadata, seeker, true, nil
+		}
+	}
+
+	var metadataReader gcode.MetadataReader
+	bufferedReader := bufio.NewReader(reader)
+	header := new(strings.Builder)
+	for {
+		line, err := bufferedReader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return gcode.Metadata{}, nil, false, err
+		}
+		header.WriteString(line)
+		line = strings.TrimRight(line, "\r\n")
+		metadataReader.ReadLine(line)
+		if err == io.EOF {
+			return metadataReader.Metadata(), strings.NewReader(header.String()), true, nil
+		}
+		if command, err := gcode.Parse(line); err == nil && (command.Is('G', 0) || command.Is('G', 1) || command.Is('G', 2) || command.Is('G', 3)) {
+			return metadataReader.Metadata(), io.MultiReader(strings.NewReader(header.String()), bufferedReader), false, nil
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package mesh
+
+import (
+	"bytes"
+	"io"
+	"mesh-levelling/pkg/gcode"
+	"strings"
+	"testing"
+)
+
+const prusaSlicerGcode = "M104 S215\nG28\nG90\nG1 X10 Y10 Z0.2\n; filament_type = PETG\n"
+
+func TestResolveMaterial(t *testing.T) {
+	mesh := gridMesh(2, flat)
+	mesh.Materials = map[string]MaterialProfile{"PLA": {}, "PETG": {}, "PLA hot": {}}
+	mesh.MaterialAliases = []MaterialAlias{
+		{FilamentType: "PLA", MinimumNozzleTemperature: 220, Material: "PLA hot"},
+		{FilamentType: "PET", Material: "PETG"},
+	}
+	tests := []struct {
+		metadata gcode.Metadata
+		want     string
+	}{
+		{gcode.Metadata{FilamentType: "PLA", NozzleTemperature: 205}, "PLA"},
+		{gcode.Metadata{FilamentType: "pla", NozzleTemperature: 225}, "PLA hot"},
+		{gcode.Metadata{FilamentType: "PET"}, "PETG"},
+		{gcode.Metadata{FilamentType: "petg"}, "PETG"},
+		{gcode.Metadata{FilamentType: "ABS"}, ""},
+		{gcode.Metadata{}, ""},
+	}
+	for _, test := range tests {
+		material, ok := mesh.ResolveMaterial(test.metadata)
+		if material != test.want || ok != (test.want != "") {
+			t.Errorf("ResolveMaterial(%+v) = %q, %v, want %q", test.metadata, material, ok, test.want)
+		}
+	}
+}
+
+func TestDetectMetadata(t *testing.T) {
+	// A file can seek, so the footer is read and then the gcode is read from the start
+	metadata, reader, complete, err := detectMetadata(strings.NewReader(prusaSlicerGcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.FilamentType != "PETG" || !complete {
+		t.Errorf("detectMetadata from a file = %+v, complete %v, want PETG, complete", metadata, complete)
+	}
+	if gcode, _ := io.ReadAll(reader); string(gcode) != prusaSlicerGcode {
+		t.Errorf("the gcode was not read from the start: %q", gcode)
+	}
+
+	// A stream can't seek, so only the start is read, and then the gcode is read from the start
+	metadata, reader, complete, err = detectMetadata(io.MultiReader(strings.NewReader(prusaSlicerGcode)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.FilamentType != "" || metadata.NozzleTemperature != 215 || complete {
+		t.Errorf("detectMetadata from a stream = %+v, complete %v, want only the temperature, incomplete", metadata, complete)
+	}
+	if gcode, _ := io.ReadAll(reader); string(gcode) != prusaSlicerGcode {
+		t.Errorf("the gcode was not read from the start: %q", gcode)
+	}
+
+	// A stream without moves is read to the end
+	if _, _, complete, _ := detectMetadata(io.MultiReader(strings.NewReader("; filament_type = PLA\nM84\n"))); !complete {
+		t.Error("a stream without moves was not read completely")
+	}
+}
+
+func TestProcessDetectsMaterial(t *testing.T) {
+	mesh := gridMesh(2, flat)
+	mesh.Materials = map[string]MaterialProfile{"PLA": {}, "PETG": {ZOffset: 0.1}}
+
+	output := new(bytes.Buffer)
+	if err := Process(strings.NewReader(prusaSlicerGcode), output, mesh, ProcessOptions{}); err != nil {
+		t.Fatalf("Process from a file failed: %v", err)
+	}
+	if !strings.Contains(output.String(), "G1 X10 Y10 Z0.3\n") {
+		t.Errorf("the PETG offset was not applied: %q", output)
+	}
+
+	// The filament type is at the end, which can't be read from a stream
+	err := Process(io.MultiReader(strings.NewReader(prusaSlicerGcode)), io.Discard, mesh, ProcessOptions{})
+	if err == nil || !strings.Contains(err.Error(), "can't be read from a stream") {
+		t.Errorf("Process from a stream returned %v, want an error explaining that the end of the gcode wasn't read", err)
+	}
+	logged := captureLog(func() {
+		err = Process(io.MultiReader(strings.NewReader(prusaSlicerGcode)), io.Discard, mesh, ProcessOptions{FallbackMaterial: "PLA"})
+	})
+	if err != nil {
+		t.Errorf("Process from a stream with a fallback failed: %v", err)
+	}
+	if !strings.Contains(logged, "can't be read from a stream), using PLA") {
+		t.Errorf("the fallback was used without explaining that the end of the gcode wasn't read: %q", logged)
+	}
+}
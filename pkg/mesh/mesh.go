@@ -3,7 +3,9 @@ package mesh
 import (
 	"encoding/json"
 	"errors"
-	"github.com/RobinRCM/sklearn/interpolate"
+	"fmt"
+	"log"
+	"math"
 	"os"
 )
 
@@ -11,14 +13,48 @@ type Point struct {
 	X float64
 	Y float64
 	Z float64
+	// Every Z that was probed at this point, which were aggregated into Z. Empty if unknown.
+	Samples []float64
+	// The standard deviation of Samples
+	StandardDeviation float64
 }
 
+type FadeCurve string
+
+const (
+	FadeCurveLinear     FadeCurve = "linear"
+	FadeCurveSmoothstep FadeCurve = "smoothstep"
+	FadeCurveCosine     FadeCurve = "cosine"
+)
+
+var FadeCurves = []FadeCurve{FadeCurveLinear, FadeCurveSmoothstep, FadeCurveCosine}
+
+// DefaultFadeHeight is the fade height given to newly created meshes.
+const DefaultFadeHeight = 10
+
 type Mesh struct {
+	// The version of the file format, see FormatVersion
+	Version       int
+	Metadata      Metadata
 	BLTouchHeight float64
 	Points        []Point
-	Interpolator  func(x, y float64) (z float64) `json:"-"`
-	// The adjustment for this material.
-	MaterialOffsets map[string]float64
+	// How to estimate the height of the bed between the points. Empty means DefaultInterpolationMethod, which is bilinear for grids and thin plate spline otherwise.
+	Interpolation InterpolationMethod
+	interpolator  Interpolator
+	// How to estimate the height of the bed outside the probed area. Empty means clamp.
+	Extrapolation ExtrapolationPolicy
+	hull          []hullPoint
+	plane         *[3]float64
+	// The adjustments for each material, by name
+	Materials map[string]MaterialProfile
+	// Maps the materials that slicers put in gcode to Materials
+	MaterialAliases []MaterialAlias
+	// At this Z in the original, unadjusted print, the mesh should no longer have any effect. 0 disables fading.
+	FadeHeight float64
+	// Below this Z in the original, unadjusted print, the mesh has its full effect.
+	FadeStartHeight float64
+	// How the mesh is phased out between FadeStartHeight and FadeHeight. Empty means linear.
+	FadeCurve FadeCurve
 }
 
 func LoadMesh(filename string) (*Mesh, error) {
@@ -28,48 +64,108 @@ func LoadMesh(filename string) (*Mesh, error) {
 	}
 	defer file.Close()
 
-	var mesh Mesh
-	if err := json.NewDecoder(file).Decode(&mesh); err != nil {
-		return nil, err
-	}
-
-	return &mesh, nil
+	return ReadMesh(file)
 }
 
 func SaveMesh(mesh *Mesh, filename string) error {
+	// A mesh that can't be interpolated would only fail later when a file is processed, so it isn't saved (and the old file is kept)
+	if _, err := NewInterpolator(mesh.Interpolation, mesh.Points); err != nil {
+		return fmt.Errorf("could not save mesh: %w", err)
+	}
 	file, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	mesh.Version = FormatVersion
 	return json.NewEncoder(file).Encode(&mesh)
 }
 
-func (mesh *Mesh) GetZOffsetAtPosition(x, y, z float64, material string) (float64, error) {
-	materialOffset, ok := mesh.MaterialOffsets[material]
+// SetInterpolation changes the interpolation method of the mesh.
+func (mesh *Mesh) SetInterpolation(method InterpolationMethod) error {
+	interpolator, err := NewInterpolator(method, mesh.Points)
+	if err != nil {
+		return err
+	}
+	mesh.Interpolation = method
+	mesh.interpolator = interpolator
+	return nil
+}
+
+// SetPoints replaces the points of the mesh.
+// If the interpolation method can't be used with the new points (eg. bilinear for points that aren't in columns), the mesh switches to the default method for them and a warning is logged.
+func (mesh *Mesh) SetPoints(points []Point) {
+	oldMethod := mesh.Interpolation
+	if oldMethod == "" {
+		oldMethod = DefaultInterpolationMethod(mesh.Points)
+	}
+	mesh.Points = points
+	// Bilinear and bicubic interpolation need the points in columns, which the new points may not be
+	if _, err := NewInterpolator(mesh.Interpolation, mesh.Points); err != nil && mesh.Interpolation != "" {
+		mesh.Interpolation = ""
+	}
+	if newMethod := DefaultInterpolationMethod(mesh.Points); mesh.Interpolation == "" && newMethod != oldMethod {
+		log.Printf("Warning: the new points aren't in columns, so the mesh now uses %s interpolation instead of %s\n", newMethod, oldMethod)
+	}
+	// The cached interpolator, hull and plane are for the old points
+	mesh.interpolator = nil
+	mesh.hull = nil
+	mesh.plane = nil
+}
+
+// BedHeightAtPosition returns the height of the bed at the position relative to BLTouchHeight, without any material offset or fading.
+func (mesh *Mesh) BedHeightAtPosition(x, y float64) (float64, error) {
+	bedHeight, err := mesh.bedHeight(x, y)
+	if err != nil {
+		return 0, err
+	}
+	return bedHeight - mesh.BLTouchHeight, nil
+}
+
+func (mesh *Mesh) GetZOffsetAtPosition(x, y, z float64, material string, state PrintState) (float64, error) {
+	profile, ok := mesh.Materials[material]
 	if !ok {
 		return 0, errors.New("material not found")
 	}
-	if mesh.Interpolator == nil {
-		X := make([]float64, len(mesh.Points))
-		Y := make([]float64, len(mesh.Points))
-		Z := make([]float64, len(mesh.Points))
-		for i := 0; i < len(mesh.Points); i++ {
-			X[i] = mesh.Points[i].X
-			Y[i] = mesh.Points[i].Y
-			Z[i] = mesh.Points[i].Z - mesh.BLTouchHeight
-		}
-		mesh.Interpolator = interpolate.Interp2d(X, Y, Z)
-	}
-	offset := mesh.Interpolator(x, y) + materialOffset
-	if isValid(offset) {
-		// Slowly phase out the mesh as we move up the print.
-		const ZeroMeshEffectZ = 10 // At 10mm Z in the original, unadjusted print, the mesh should no longer have any effect.
-		//offsetMultiplier := math.Min(1, math.Max(0, 1 - (z / ZeroMeshEffectZ)))
-		//return offset * offsetMultiplier, nil
-		return offset, nil
-	} else {
+	if !isValid(x) || !isValid(y) {
+		// The position isn't known (eg. just after homing), so there is nothing to level
 		return 0, nil
 	}
+	bedHeight, err := mesh.bedHeight(x, y)
+	if err != nil {
+		return 0, err
+	}
+	// Slowly phase out the mesh as we move up the print.
+	fadeMultiplier, err := mesh.fadeMultiplier(z, profile.fadeHeight(mesh))
+	if err != nil {
+		return 0, err
+	}
+	offset := (bedHeight-mesh.BLTouchHeight)*fadeMultiplier + profile.zOffset(z, state)
+	if !isValid(offset) {
+		return 0, fmt.Errorf("could not calculate Z offset at X%.3f Y%.3f", x, y)
+	}
+	return offset, nil
+}
+
+// fadeMultiplier returns how much of the mesh should be applied at z, between 0 (none) and 1 (all of it).
+func (mesh *Mesh) fadeMultiplier(z, fadeHeight float64) (float64, error) {
+	if fadeHeight <= 0 || z <= mesh.FadeStartHeight {
+		return 1, nil
+	}
+	if z >= fadeHeight || mesh.FadeStartHeight >= fadeHeight {
+		return 0, nil
+	}
+	// How far through the fade we are, from 0 to 1
+	progress := (z - mesh.FadeStartHeight) / (fadeHeight - mesh.FadeStartHeight)
+	switch mesh.FadeCurve {
+	case "", FadeCurveLinear:
+		return 1 - progress, nil
+	case FadeCurveSmoothstep:
+		return 1 - progress*progress*(3-2*progress), nil
+	case FadeCurveCosine:
+		return (1 + math.Cos(math.Pi*progress)) / 2, nil
+	default:
+		return 0, fmt.Errorf("unknown fade curve: %s", mesh.FadeCurve)
+	}
 }
@@ -2,36 +2,29 @@ package mesh
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
+	"io"
+	"log"
 	"math"
+	"mesh-levelling/pkg/gcode"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
-var (
-	absolutePositioningCommandRegex         = regexp.MustCompile("\\s*G90")
-	relativePositioningCommandRegex         = regexp.MustCompile("\\s*G91")
-	absoluteExtruderPositioningCommandRegex = regexp.MustCompile("\\s*M82")
-	relativeExtruderPositioningCommandRegex = regexp.MustCompile("\\s*M83")
-	homeAllCommandRegex                     = regexp.MustCompile("\\s*G28")
-	homeMinimumCommandRegex                 = regexp.MustCompile("\\s*G161")
-	homeMaximumCommandRegex                 = regexp.MustCompile("\\s*G162")
-	moveCommandRegex                        = regexp.MustCompile("\\s*(G[0-3] |G92)")
-	speedRegex                              = regexp.MustCompile("F([-.\\d]+)")
-	extruderRegex                           = regexp.MustCompile("E([-.\\d]+)")
-	xRegex                                  = regexp.MustCompile("X([-.\\d]+)")
-	yRegex                                  = regexp.MustCompile("Y([-.\\d]+)")
-	zRegex                                  = regexp.MustCompile("Z([-.\\d]+)")
-)
-
 const (
-	Resolution           = 1    // Minimum move distance in mm
-	MaximumMeshDeviation = 0.02 // Maximum distance that extruder is allowed to deviate from the mesh due to gcode being too simple
+	MinimumSegmentLength = 1     // Default minimum length in mm of the segments that a move is split into
+	MaximumMeshDeviation = 0.02  // Default maximum distance that extruder is allowed to deviate from the mesh due to gcode being too simple
+	SampleResolution     = 0.25  // Distance in mm between the points along a move that are checked against the mesh
+	firstLayerTolerance  = 0.001 // Moves up to this far in mm above the first extruding move are on the first layer
+	maximumFirstLayerZ   = 1     // Before the first extruding move, moves up to this Z in mm may be going to the first layer
 )
 
+// Matches lines that start with G0, G1, G2 or G3, which may have a line number
+var moveRegex = regexp.MustCompile(`^\s*([Nn]\d+\s*)?[Gg]0*[0-3](\D|$)`)
+
 func isValid(value float64) bool {
 	return !(math.IsNaN(value) || math.IsInf(value, -1) || math.IsInf(value, 1))
 }
@@ -40,255 +33,580 @@ func calculateDistance(x, y, z float64) float64 {
 	return math.Sqrt(math.Pow(x, 2) + math.Pow(y, 2) + math.Pow(z, 2))
 }
 
-func writeGcodeMoveCommand(gcodeCommand string, newExtruder, oldExtruder, newSpeed, oldSpeed, newX, oldX, newY, oldY, newZ, oldZ float64, relativePositioning, relativeExtruderPositioning bool) string {
-	newCommand := new(strings.Builder)
-	newCommand.WriteString(gcodeCommand)
-	newCommand.WriteRune(' ')
-
-	writeParameter := func(oldValue, newValue float64, parameterPrefix rune, precision int, useRelativePositioning bool) {
+// writeGcodeMoveCommand updates the E, F, X, Y and Z parameters of a move command, leaving out any that haven't changed.
+// Any other parameters and the comment of the command are kept.
+func writeGcodeMoveCommand(command gcode.Command, newExtruder, oldExtruder, newSpeed, oldSpeed, newX, oldX, newY, oldY, newZ, oldZ float64, relativePositioning, relativeExtruderPositioning bool) string {
+	writeParameter := func(oldValue, newValue float64, parameterLetter byte, precision int, useRelativePositioning bool) {
 		tenPowPrecision := math.Pow10(precision)
 		newValueRounded := math.Round(newValue*tenPowPrecision) / tenPowPrecision
 		oldValueRounded := math.Round(oldValue*tenPowPrecision) / tenPowPrecision
 		if newValueRounded != oldValueRounded && isValid(newValue) && (!useRelativePositioning || isValid(oldValue)) {
-			newCommand.WriteRune(parameterPrefix)
 			if useRelativePositioning {
-				newCommand.WriteString(strconv.FormatFloat(newValue-oldValue, 'f', precision, 64))
+				command.SetParam(parameterLetter, math.Round((newValue-oldValue)*tenPowPrecision)/tenPowPrecision)
 			} else {
-				newCommand.WriteString(strconv.FormatFloat(newValue, 'f', precision, 64))
+				command.SetParam(parameterLetter, newValueRounded)
 			}
-			newCommand.WriteRune(' ')
+		} else {
+			command.RemoveParam(parameterLetter)
 		}
 	}
 
+	command.Params = append([]gcode.Param(nil), command.Params...)
 	writeParameter(oldExtruder, newExtruder, 'E', 5, relativeExtruderPositioning)
 	writeParameter(oldSpeed, newSpeed, 'F', 0, false)
 	writeParameter(oldX, newX, 'X', 3, relativePositioning)
 	writeParameter(oldY, newY, 'Y', 3, relativePositioning)
 	writeParameter(oldZ, newZ, 'Z', 3, relativePositioning)
-	return strings.TrimSpace(newCommand.String())
+	return command.String()
+}
+
+type ProcessOptions struct {
+	// The material being printed, which must be a key of Mesh.Materials.
+	// If empty, the material is detected from the metadata that the slicer put in the gcode.
+	// If the gcode is read from a stream that can't seek (eg. a pipe), only the metadata before the first move can be detected.
+	Material string
+	// The material to use if Material is empty and the material can't be detected. If this is also empty, processing fails.
+	FallbackMaterial string
+	// Whether to increase extrusion and speed to make up for the extra distance moved when the mesh adds Z movement to a move.
+	CompensateExtrusion bool
+	// Overrides MaximumMeshDeviation if set
+	MaximumMeshDeviation float64
+	// Overrides MinimumSegmentLength if set
+	MinimumSegmentLength float64
+}
+
+// LevelledFilename returns the default filename for the levelled version of a gcode file.
+func LevelledFilename(filename string) string {
+	extension := filepath.Ext(filename)
+	filenameWithoutExtension := strings.TrimSuffix(filename, extension)
+	if extension != ".gx" {
+		extension = ".g"
+	}
+	return filenameWithoutExtension + "_ML" + extension
 }
 
-func ProcessFile(filename string, mesh *Mesh, material string) (string, error) {
-	file, err := os.Open(filename)
+// ProcessFile levels the gcode in inputFilename and writes the result to outputFilename.
+// The output is written to a temporary file first, so inputFilename and outputFilename may be the same file.
+func ProcessFile(inputFilename, outputFilename string, mesh *Mesh, options ProcessOptions) error {
+	inputFile, err := os.Open(inputFilename)
 	if err != nil {
-		return "", err
+		return err
+	}
+	defer inputFile.Close()
+	inputFileInfo, err := inputFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	outputFile, err := os.CreateTemp(filepath.Dir(outputFilename), filepath.Base(outputFilename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outputFile.Name())
+	if err := outputFile.Chmod(inputFileInfo.Mode().Perm()); err != nil {
+		_ = outputFile.Close()
+		return err
+	}
+
+	if err := Process(inputFile, outputFile, mesh, options); err != nil {
+		_ = outputFile.Close()
+		return err
+	}
+	if err := outputFile.Close(); err != nil {
+		return err
+	}
+	if err := inputFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(outputFile.Name(), outputFilename)
+}
+
+// Process levels the gcode read from reader and writes the result to writer line by line as it is processed.
+// If reader can't seek and the material isn't given, the material must be in the gcode before the first move, see ProcessOptions.Material.
+func Process(reader io.Reader, writer io.Writer, mesh *Mesh, options ProcessOptions) error {
+	if options.Material == "" {
+		metadata, metadataReader, complete, err := detectMetadata(reader)
+		if err != nil {
+			return err
+		}
+		reader = metadataReader
+		// Explains why detection may have failed when only the start of the gcode could be read
+		var incomplete string
+		if !complete {
+			incomplete = " before the first move (metadata after it, eg. PrusaSlicer's settings at the end, can't be read from a stream)"
+		}
+		if material, ok := mesh.ResolveMaterial(metadata); ok {
+			log.Printf("Detected material %s (filament type %s, nozzle temperature %.0f°C)\n", material, metadata.FilamentType, metadata.NozzleTemperature)
+			options.Material = material
+		} else if options.FallbackMaterial != "" {
+			log.Printf("Could not detect material (filament type %q)%s, using %s\n", metadata.FilamentType, incomplete, options.FallbackMaterial)
+			options.Material = options.FallbackMaterial
+		} else {
+			return fmt.Errorf("could not detect material (filament type %q)%s and no fallback material was given", metadata.FilamentType, incomplete)
+		}
+	}
+	if _, ok := mesh.Materials[options.Material]; !ok {
+		return fmt.Errorf("material %s not found in mesh", options.Material)
+	}
+
+	processor := newProcessor(mesh, options, writer)
+	if err := processor.run(reader); err != nil {
+		return err
+	}
+
+	if len(processor.unparsedMoveLines) > 0 {
+		log.Printf("Warning: %d moves could not be parsed, so they were not levelled. Lines: %s\n", len(processor.unparsedMoveLines), formatLineNumbers(processor.unparsedMoveLines))
+	}
+	if len(processor.outsideMeshLines) > 0 {
+		log.Printf("Warning: %d extruding moves are outside of the probed area of the mesh, so the mesh was extrapolated (%s). Lines: %s\n", len(processor.outsideMeshLines), mesh.extrapolationPolicy(), formatLineNumbers(processor.outsideMeshLines))
+	}
+	if len(processor.outsideMeshTravelLines) > 0 {
+		log.Printf("%d travel moves (which don't extrude) are outside of the probed area of the mesh, so the mesh was extrapolated (%s). Lines: %s\n", len(processor.outsideMeshTravelLines), mesh.extrapolationPolicy(), formatLineNumbers(processor.outsideMeshTravelLines))
+	}
+	if options.CompensateExtrusion {
+		log.Printf("Extrusion compensation added %.3fmm of filament\n", processor.extraFilament)
+	}
+	return processor.writer.Flush()
+}
+
+// formatLineNumbers lists line numbers for a warning, leaving out most of them if there are a lot.
+func formatLineNumbers(lineNumbers []int) string {
+	const maximumLinesListed = 20
+	lines := make([]string, 0, maximumLinesListed)
+	for _, lineNumber := range lineNumbers[:min(len(lineNumbers), maximumLinesListed)] {
+		lines = append(lines, strconv.Itoa(lineNumber))
+	}
+	if len(lineNumbers) > maximumLinesListed {
+		lines = append(lines, fmt.Sprintf("and %d more", len(lineNumbers)-maximumLinesListed))
+	}
+	return strings.Join(lines, ", ")
+}
+
+func newProcessor(mesh *Mesh, options ProcessOptions, writer io.Writer) *processor {
+	return &processor{
+		mesh:                        mesh,
+		options:                     options,
+		writer:                      bufio.NewWriter(writer),
+		lineEnding:                  "\n",
+		relativePositioning:         true,
+		relativeExtruderPositioning: true,
+		firstLayerZ:                 math.NaN(),
+		printBounds:                 emptyBounds(),
+	}
+}
+
+// run processes every line read from reader.
+func (processor *processor) run(reader io.Reader) error {
+	bufferedReader := bufio.NewReader(reader)
+	for {
+		line, readErr := bufferedReader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		if readErr == io.EOF && line == "" {
+			return nil
+		}
+		if err := processor.processLine(splitLineEnding(line)); err != nil {
+			return err
+		}
+		if readErr == io.EOF {
+			return nil
+		}
 	}
-	defer file.Close()
+}
 
-	scanner := bufio.NewScanner(file)
-	var newLines []string
+func splitLineEnding(line string) (string, string) {
+	if strings.HasSuffix(line, "\r\n") {
+		return line[:len(line)-2], "\r\n"
+	} else if strings.HasSuffix(line, "\n") {
+		return line[:len(line)-1], "\n"
+	}
+	return line, ""
+}
+
+type processor struct {
+	// nil if the gcode is only being tracked, not levelled
+	mesh    *Mesh
+	options ProcessOptions
+	writer  *bufio.Writer
+	// The line ending used for lines that are added (eg. segments)
+	lineEnding string
 
 	// Current printer positions
-	relativePositioning := true
-	relativeExtruderPositioning := true
+	relativePositioning         bool
+	relativeExtruderPositioning bool
 	// The current printer position **without offset**
-	var extruder, x, y, z float64
+	extruder, x, y, z float64
+	speed             float64
 	// The current printer position **with offset**
-	var speed, adjustedZ float64
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(strings.TrimSpace(line), ";") {
-			if moveCommandRegex.MatchString(line) {
-				// This is a gcode move instruction!
-				matches := moveCommandRegex.FindAllStringSubmatch(line, -1)
-				if len(matches) != 1 {
-					return "", fmt.Errorf("invalid argument count (%d): %s", len(matches), line)
-				}
-				if len(matches[0]) != 2 {
-					return "", errors.New("regex error")
-				}
-				gcodeCommand := strings.TrimSpace(matches[0][1])
-
-				handleMoveArgument := func(regex *regexp.Regexp, useRelativePositioning bool, oldValue float64) (float64, error) {
-					if regex.MatchString(line) {
-						matches := regex.FindAllStringSubmatch(line, -1)
-						if len(matches) != 1 {
-							return 0, fmt.Errorf("invalid argument count (%d): %s", len(matches), line)
-						}
-						if len(matches[0]) != 2 {
-							return 0, errors.New("regex error")
-						}
-
-						newValue, err := strconv.ParseFloat(matches[0][1], 64)
-						if err != nil {
-							return 0, err
-						}
-						if useRelativePositioning {
-							return oldValue + newValue, nil
-						} else {
-							return newValue, nil
-						}
-					} else {
-						return oldValue, nil
-					}
-				}
-
-				// The absolute extruder position **after** this command
-				newExtruder, err := handleMoveArgument(extruderRegex, relativeExtruderPositioning, extruder)
-				if err != nil {
-					return "", err
-				}
-				// The speed **after and during** this command
-				newSpeed, err := handleMoveArgument(speedRegex, false, speed)
-				if err != nil {
-					return "", err
-				}
-				// The absolute x position **after** this command
-				newX, err := handleMoveArgument(xRegex, relativePositioning, x)
-				if err != nil {
-					return "", err
-				}
-				// The absolute y position **after** this command
-				newY, err := handleMoveArgument(yRegex, relativePositioning, y)
-				if err != nil {
-					return "", err
-				}
-				// The absolute z position **after** this command
-				newZ, err := handleMoveArgument(zRegex, relativePositioning, z)
-				if err != nil {
-					return "", err
-				}
-
-				zOffset, err := mesh.GetZOffsetAtPosition(newX, newY, newZ, material)
-				if err != nil {
-					return "", err
-				}
-				// The adjusted absolute z position **after** this command
-				newAdjustedZ := newZ + zOffset
-
-				// Detect the maximum deviation from the mesh to ensure that the mesh is followed accurately.
-				// This avoids issues where eg. the bed is a perfect hill, and a command to move from one side to the other would crash into the hill.
-				if (gcodeCommand == "G1" || gcodeCommand == "G2") && isValid(x) && isValid(newX) && isValid(y) && isValid(newY) && isValid(z) && isValid(newZ) && isValid(adjustedZ) && isValid(newAdjustedZ) {
-				segmentingBeginning:
-					changeInX := newX - x
-					changeInY := newY - y
-					// The angle of the moment in the XY plane
-					angle := math.Atan2(changeInY, changeInX)
-					// The distance of the movement in the XY plane
-					distance := math.Sqrt(math.Pow(changeInX, 2) + math.Pow(changeInY, 2))
-
-					// Slowly move along the line, trying to detect if the line strays too far from the mesh
-					for partialDistance := float64(0); partialDistance < distance; partialDistance += Resolution {
-						partialX := x + math.Cos(angle)*partialDistance
-						partialY := y + math.Sin(angle)*partialDistance
-
-						// The Z position of the partial unadjusted move
-						partialZ := z + ((newZ - z) * (partialDistance / distance))
-						// The Z offset at this point
-						partialZOffset, err := mesh.GetZOffsetAtPosition(partialX, partialY, partialZ, material)
-						if err != nil {
-							return "", err
-						}
-						adjustedPartialZ := partialZ + partialZOffset
-
-						// The Z position the extruder will be at (at this partial position) if this line is not segmented
-						unsegmentedPartialZ := adjustedZ + ((newAdjustedZ - adjustedZ) * (partialDistance / distance))
-
-						// Deviation from the mesh
-						deviation := math.Abs(unsegmentedPartialZ - adjustedPartialZ)
-
-						if deviation > MaximumMeshDeviation {
-							// The movement has deviated too far from the mesh. We need to turn it into 2 movements.
-							partialExtruder := extruder + ((newExtruder - extruder) * (partialDistance / distance))
-							partialCommand := writeGcodeMoveCommand(gcodeCommand, partialExtruder, extruder, newSpeed, speed, partialX, x, partialY, y, adjustedPartialZ, adjustedZ, relativePositioning, relativeExtruderPositioning) + " ; SEGMENT"
-							newLines = append(newLines, partialCommand)
-
-							// Update variables for the next check on the remaining section of the movement.
-							extruder = partialExtruder
-							x = partialX
-							y = partialY
-							z = partialZ
-							adjustedZ = adjustedPartialZ
-
-							// Reset, process the rest of this movement
-							goto segmentingBeginning
-						}
-					}
-				}
-
-				// Compensate for any increases in distance by increasing extrusion length and speed.
-				// Increases in distance come about due to the Z moving along with X and Y once mesh levelled, when only X and Y were supposed to move in the slicer's output.
-				// To calculate the distance we need to know the change in X, change in Y, change in Z without adjustment and change in Z with adjustment.
-				// TODO this needs to take into account the move segmenting. Maybe move this into writeGcodeMoveCommand?
-				//if isValid(x) && isValid(newX) && isValid(y) && isValid(newY) && isValid(z) && isValid(newZ) && isValid(adjustedZ) && isValid(newAdjustedZ) {
-				//	changeInX := newX - x
-				//	changeInY := newY - y
-				//	changeInZ := newZ - z
-				//	changeInAdjustedZ := newAdjustedZ - adjustedZ
-				//	oldDistance := calculateDistance(changeInX, changeInY, changeInZ)
-				//	if oldDistance != 0 { // prevent divide by 0
-				//		adjustedDistance := calculateDistance(changeInX, changeInY, changeInAdjustedZ)
-				//		distanceMultiplier := adjustedDistance / oldDistance
-				//		// Adjust speed to compensate for increase in distance
-				//		if isValid(newSpeed) {
-				//			newSpeed *= distanceMultiplier
-				//		}
-				//		if isValid(extruder) && isValid(newExtruder) {
-				//			// Adjust extrusion amount to compensate for increase in distance
-				//			newExtruder = extruder + ((newExtruder - extruder) * distanceMultiplier)
-				//		}
-				//	}
-				//}
-
-				line = writeGcodeMoveCommand(gcodeCommand, newExtruder, extruder, newSpeed, speed, newX, x, newY, y, newAdjustedZ, adjustedZ, relativePositioning, relativeExtruderPositioning)
-				extruder = newExtruder
-				speed = newSpeed
-				x = newX
-				y = newY
-				z = newZ
-				adjustedZ = newAdjustedZ
-			} else if homeAllCommandRegex.MatchString(line) || homeMinimumCommandRegex.MatchString(line) {
-				movex := strings.ContainsRune(line, 'X')
-				movey := strings.ContainsRune(line, 'Y')
-				movez := strings.ContainsRune(line, 'Z')
-				if !(movex || movey || movez) {
-					x = math.Inf(-1)
-					y = math.Inf(-1)
-					z = 0
-				} else {
-					if movex {
-						x = math.Inf(-1)
-					}
-					if movey {
-						y = math.Inf(-1)
-					}
-					if movez {
-						z = 0
-					}
-				}
-			} else if homeMaximumCommandRegex.MatchString(line) {
-				movex := strings.ContainsRune(line, 'X')
-				movey := strings.ContainsRune(line, 'Y')
-				movez := strings.ContainsRune(line, 'Z')
-				if !(movex || movey || movez) {
-					x = math.Inf(1)
-					y = math.Inf(1)
-					z = math.Inf(1)
-				} else {
-					if movex {
-						x = math.Inf(1)
-					}
-					if movey {
-						y = math.Inf(1)
-					}
-					if movez {
-						z = math.Inf(1)
-					}
-				}
-			} else if absolutePositioningCommandRegex.MatchString(line) {
-				relativePositioning = false
-				relativeExtruderPositioning = false
-			} else if relativePositioningCommandRegex.MatchString(line) {
-				relativePositioning = true
-				relativeExtruderPositioning = true
-			} else if absoluteExtruderPositioningCommandRegex.MatchString(line) {
-				relativeExtruderPositioning = false
-			} else if relativeExtruderPositioningCommandRegex.MatchString(line) {
-				relativeExtruderPositioning = true
+	adjustedExtruder, adjustedSpeed, adjustedZ float64
+
+	// The bed temperature set by the gcode in °C, 0 if unknown
+	bedTemperature float64
+	// The Z of the first extruding move, NaN until there is one
+	firstLayerZ float64
+
+	// Total length of filament added by extrusion compensation
+	extraFilament float64
+	// The line currently being processed, starting at 1
+	lineNumber int
+	// The lines with extruding moves that go outside the probed area of the mesh
+	outsideMeshLines []int
+	// The lines with moves that don't extrude (eg. travel to a purge line at the edge of the bed) that go outside the probed area of the mesh
+	outsideMeshTravelLines []int
+	// The lines that look like moves but couldn't be parsed, so weren't levelled
+	unparsedMoveLines []int
+	// The area covered by extruding moves
+	printBounds Bounds
+}
+
+func (processor *processor) writeLine(line, lineEnding string) error {
+	if _, err := processor.writer.WriteString(line); err != nil {
+		return err
+	}
+	_, err := processor.writer.WriteString(lineEnding)
+	return err
+}
+
+// processLine processes a single line of gcode and writes the result.
+// Each line is written with the line ending that it was read with, so lines that are not modified are passed through unchanged.
+func (processor *processor) processLine(line, lineEnding string) error {
+	processor.lineNumber++
+	if lineEnding != "" {
+		processor.lineEnding = lineEnding
+	}
+
+	command, err := gcode.Parse(line)
+	if err != nil {
+		// Not something we understand (eg. the binary header of a .gx file), so leave it alone.
+		// A move that is left alone isn't levelled though, so it is worth a warning.
+		if moveRegex.MatchString(line) {
+			processor.unparsedMoveLines = append(processor.unparsedMoveLines, processor.lineNumber)
+		}
+		return processor.writeLine(line, lineEnding)
+	}
+
+	switch {
+	case command.Is('G', 0) || command.Is('G', 1) || command.Is('G', 2) || command.Is('G', 3):
+		newLine, err := processor.move(command)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", processor.lineNumber, err)
+		}
+		line = newLine
+	case command.Is('G', 92):
+		newLine, err := processor.setPosition(command)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", processor.lineNumber, err)
+		}
+		line = newLine
+	case command.Is('G', 28) || command.Is('G', 161):
+		processor.home(command, math.Inf(-1), 0)
+	case command.Is('G', 162):
+		processor.home(command, math.Inf(1), math.Inf(1))
+	case command.Is('G', 90):
+		processor.relativePositioning = false
+		processor.relativeExtruderPositioning = false
+	case command.Is('G', 91):
+		processor.relativePositioning = true
+		processor.relativeExtruderPositioning = true
+	case command.Is('M', 82):
+		processor.relativeExtruderPositioning = false
+	case command.Is('M', 83):
+		processor.relativeExtruderPositioning = true
+	case command.Is('M', 140) || command.Is('M', 190):
+		if temperature, ok := command.Param('S'); ok {
+			processor.bedTemperature = temperature
+		} else if temperature, ok := command.Param('R'); ok && command.Is('M', 190) {
+			processor.bedTemperature = temperature
+		}
+	}
+
+	return processor.writeLine(line, lineEnding)
+}
+
+// zOffset returns the offset at a position, taking into account the state of the print.
+func (processor *processor) zOffset(x, y, z float64) (float64, error) {
+	if processor.mesh == nil {
+		return 0, nil
+	}
+	// Before the first extrusion, low moves are treated as being on the first layer, so that moving to the start of the first layer is squished too.
+	// Higher moves (eg. "G1 Z10" in a start script) are travel, which must not be squished.
+	var firstLayer bool
+	if isValid(processor.firstLayerZ) {
+		firstLayer = z <= processor.firstLayerZ+firstLayerTolerance
+	} else {
+		firstLayer = z <= maximumFirstLayerZ
+	}
+	return processor.mesh.GetZOffsetAtPosition(x, y, z, processor.options.Material, PrintState{
+		BedTemperature: processor.bedTemperature,
+		FirstLayer:     firstLayer,
+	})
+}
+
+// handleMoveArgument returns the absolute position of an axis after command.
+func handleMoveArgument(command gcode.Command, parameterLetter byte, useRelativePositioning bool, oldValue float64) float64 {
+	newValue, ok := command.Param(parameterLetter)
+	if !ok {
+		return oldValue
+	}
+	if useRelativePositioning {
+		return oldValue + newValue
+	} else {
+		return newValue
+	}
+}
+
+// move handles G0, G1, G2 and G3.
+func (processor *processor) move(command gcode.Command) (string, error) {
+	relativePositioning := processor.relativePositioning
+	relativeExtruderPositioning := processor.relativeExtruderPositioning
+
+	// The absolute extruder position **after** this command
+	newExtruder := handleMoveArgument(command, 'E', relativeExtruderPositioning, processor.extruder)
+	// The speed **after and during** this command
+	newSpeed := handleMoveArgument(command, 'F', false, processor.speed)
+	// The absolute x position **after** this command
+	newX := handleMoveArgument(command, 'X', relativePositioning, processor.x)
+	// The absolute y position **after** this command
+	newY := handleMoveArgument(command, 'Y', relativePositioning, processor.y)
+	// The absolute z position **after** this command
+	newZ := handleMoveArgument(command, 'Z', relativePositioning, processor.z)
+
+	if command.Is('G', 2) || command.Is('G', 3) {
+		return processor.arc(command, newExtruder, newSpeed, newX, newY, newZ)
+	}
+	return processor.moveTo(command, newExtruder, newSpeed, newX, newY, newZ)
+}
+
+// moveTo moves in a straight line from the current position to the given absolute position, following the mesh.
+func (processor *processor) moveTo(command gcode.Command, newExtruder, newSpeed, newX, newY, newZ float64) (string, error) {
+	mesh := processor.mesh
+
+	if newExtruder > processor.extruder && !isValid(processor.firstLayerZ) && isValid(newZ) {
+		processor.firstLayerZ = newZ
+	}
+	zOffset, err := processor.zOffset(newX, newY, newZ)
+	if err != nil {
+		return "", err
+	}
+	// The adjusted absolute z position **after** this command
+	newAdjustedZ := newZ + zOffset
+
+	if isValid(processor.x) && isValid(processor.y) && isValid(newX) && isValid(newY) {
+		extruding := newExtruder > processor.extruder
+		if extruding {
+			processor.printBounds.add(processor.x, processor.y)
+			processor.printBounds.add(newX, newY)
+		}
+		// The probed area is convex, so a move is entirely inside of it if both ends are
+		if mesh != nil && (!mesh.IsInMesh(processor.x, processor.y) || !mesh.IsInMesh(newX, newY)) {
+			if extruding {
+				processor.outsideMeshLines = processor.addLine(processor.outsideMeshLines)
+			} else {
+				processor.outsideMeshTravelLines = processor.addLine(processor.outsideMeshTravelLines)
+			}
+		}
+	}
+
+	// Detect the maximum deviation from the mesh to ensure that the mesh is followed accurately.
+	// This avoids issues where eg. the bed is a perfect hill, and a command to move from one side to the other would crash into the hill.
+	if command.Is('G', 1) && isValid(processor.x) && isValid(newX) && isValid(processor.y) && isValid(newY) && isValid(processor.z) && isValid(newZ) && isValid(processor.adjustedZ) && isValid(newAdjustedZ) {
+		segments, err := processor.segment(newX, newY, newZ, newAdjustedZ)
+		if err != nil {
+			return "", err
+		}
+		extruder := processor.extruder
+		for _, segment := range segments {
+			segmentCommand := command
+			segmentCommand.Comment = " SEGMENT"
+			segmentCommand.HasComment = true
+			// Only the original command keeps its line number, as a host that numbers lines expects each number once
+			segmentCommand.HasLineNumber = false
+			segmentCommand.HasChecksum = false
+			partialExtruder := extruder + ((newExtruder - extruder) * segment.progress)
+			partialCommand := processor.moveCommand(segmentCommand, partialExtruder, newSpeed, segment.x, segment.y, segment.z, segment.adjustedZ)
+			if err := processor.writeLine(partialCommand, processor.lineEnding); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return processor.moveCommand(command, newExtruder, newSpeed, newX, newY, newZ, newAdjustedZ), nil
+}
+
+// addLine adds the current line to lines, unless it is already the last one (eg. an arc is split into several moves).
+func (processor *processor) addLine(lines []int) []int {
+	if len(lines) > 0 && lines[len(lines)-1] == processor.lineNumber {
+		return lines
+	}
+	return append(lines, processor.lineNumber)
+}
+
+// segmentPoint is a point along a move where the move is split.
+type segmentPoint struct {
+	// How far along the move the point is, from 0 to 1
+	progress           float64
+	x, y, z, adjustedZ float64
+}
+
+// segment finds the fewest points to split a move from the current position into, such that each segment follows the mesh to within the maximum mesh deviation.
+// The returned points are in order and don't include the start or end of the move.
+// The move is sampled at SampleResolution, and then simplified by recursively splitting it at the sample that deviates furthest from the mesh (Ramer-Douglas-Peucker).
+func (processor *processor) segment(newX, newY, newZ, newAdjustedZ float64) ([]segmentPoint, error) {
+	maximumMeshDeviation := processor.options.MaximumMeshDeviation
+	if maximumMeshDeviation <= 0 {
+		maximumMeshDeviation = MaximumMeshDeviation
+	}
+	minimumSegmentLength := processor.options.MinimumSegmentLength
+	if minimumSegmentLength <= 0 {
+		minimumSegmentLength = MinimumSegmentLength
+	}
+
+	x, y, z := processor.x, processor.y, processor.z
+	// The distance of the movement in the XY plane
+	distance := math.Sqrt(math.Pow(newX-x, 2) + math.Pow(newY-y, 2))
+	if distance < 2*minimumSegmentLength {
+		return nil, nil
+	}
+
+	numberOfSamples := int(math.Ceil(distance / SampleResolution))
+	samples := make([]segmentPoint, numberOfSamples+1)
+	samples[0] = segmentPoint{0, x, y, z, processor.adjustedZ}
+	samples[numberOfSamples] = segmentPoint{1, newX, newY, newZ, newAdjustedZ}
+	for i := 1; i < numberOfSamples; i++ {
+		progress := float64(i) / float64(numberOfSamples)
+		sample := segmentPoint{
+			progress: progress,
+			x:        x + (newX-x)*progress,
+			y:        y + (newY-y)*progress,
+			z:        z + (newZ-z)*progress,
+		}
+		zOffset, err := processor.zOffset(sample.x, sample.y, sample.z)
+		if err != nil {
+			return nil, err
+		}
+		sample.adjustedZ = sample.z + zOffset
+		samples[i] = sample
+	}
+
+	// Samples closer than this to either end of a segment can't be split at, as the resulting segment would be too short
+	minimumSamples := int(math.Ceil(minimumSegmentLength / distance * float64(numberOfSamples)))
+
+	var segments []segmentPoint
+	var split func(start, end int)
+	split = func(start, end int) {
+		if end-start < 2*minimumSamples {
+			return
+		}
+		// Find the sample that is furthest from where the extruder would be if this segment were not split any further
+		furthest := -1
+		furthestDeviation := maximumMeshDeviation
+		for i := start + 1; i < end; i++ {
+			progress := (samples[i].progress - samples[start].progress) / (samples[end].progress - samples[start].progress)
+			unsegmentedZ := samples[start].adjustedZ + (samples[end].adjustedZ-samples[start].adjustedZ)*progress
+			if deviation := math.Abs(unsegmentedZ - samples[i].adjustedZ); deviation > furthestDeviation {
+				furthest = i
+				furthestDeviation = deviation
 			}
 		}
-		newLines = append(newLines, line)
+		if furthest < 0 {
+			return
+		}
+		furthest = max(start+minimumSamples, min(end-minimumSamples, furthest))
+		split(start, furthest)
+		segments = append(segments, samples[furthest])
+		split(furthest, end)
 	}
+	split(0, numberOfSamples)
+	return segments, nil
+}
+
+// moveCommand writes a move from the current position to the given position, and updates the current position.
+func (processor *processor) moveCommand(command gcode.Command, newExtruder, newSpeed, newX, newY, newZ, newAdjustedZ float64) string {
+	extruder, x, y, z, adjustedZ := processor.extruder, processor.x, processor.y, processor.z, processor.adjustedZ
 
-	return strings.Join(newLines, "\n"), nil
+	newAdjustedExtruder := processor.adjustedExtruder + (newExtruder - extruder)
+	newAdjustedSpeed := newSpeed
+
+	// Compensate for any increases in distance by increasing extrusion length and speed.
+	// Increases in distance come about due to the Z moving along with X and Y once mesh levelled, when only X and Y were supposed to move in the slicer's output.
+	// To calculate the distance we need to know the change in X, change in Y, change in Z without adjustment and change in Z with adjustment.
+	// This is done per segment, as each segment has its own change in adjusted Z.
+	if processor.options.CompensateExtrusion && isValid(x) && isValid(newX) && isValid(y) && isValid(newY) && isValid(z) && isValid(newZ) && isValid(adjustedZ) && isValid(newAdjustedZ) {
+		changeInX := newX - x
+		changeInY := newY - y
+		changeInZ := newZ - z
+		changeInAdjustedZ := newAdjustedZ - adjustedZ
+		oldDistance := calculateDistance(changeInX, changeInY, changeInZ)
+		if oldDistance != 0 { // prevent divide by 0
+			adjustedDistance := calculateDistance(changeInX, changeInY, changeInAdjustedZ)
+			distanceMultiplier := adjustedDistance / oldDistance
+			// Adjust speed to compensate for increase in distance
+			if isValid(newSpeed) {
+				newAdjustedSpeed *= distanceMultiplier
+			}
+			// Adjust extrusion amount to compensate for increase in distance
+			extrusion := newExtruder - extruder
+			newAdjustedExtruder = processor.adjustedExtruder + extrusion*distanceMultiplier
+			processor.extraFilament += extrusion * (distanceMultiplier - 1)
+		}
+	}
+
+	line := writeGcodeMoveCommand(command, newAdjustedExtruder, processor.adjustedExtruder, newAdjustedSpeed, processor.adjustedSpeed, newX, x, newY, y, newAdjustedZ, adjustedZ, processor.relativePositioning, processor.relativeExtruderPositioning)
+	processor.extruder = newExtruder
+	processor.adjustedExtruder = newAdjustedExtruder
+	processor.speed = newSpeed
+	processor.adjustedSpeed = newAdjustedSpeed
+	processor.x = newX
+	processor.y = newY
+	processor.z = newZ
+	processor.adjustedZ = newAdjustedZ
+	return line
+}
+
+// setPosition handles G92, which sets the current position of the given axes without moving.
+// The Z position is offset so that the printer's idea of where the nozzle is stays consistent with the adjusted moves.
+func (processor *processor) setPosition(command gcode.Command) (string, error) {
+	if len(command.Params) == 0 {
+		// No axes given means all axes are set to 0
+		processor.extruder, processor.adjustedExtruder, processor.x, processor.y, processor.z, processor.adjustedZ = 0, 0, 0, 0, 0, 0
+		return command.String(), nil
+	}
+	if newExtruder, ok := command.Param('E'); ok {
+		processor.extruder = newExtruder
+		processor.adjustedExtruder = newExtruder
+	}
+	processor.x = handleMoveArgument(command, 'X', false, processor.x)
+	processor.y = handleMoveArgument(command, 'Y', false, processor.y)
+	if newZ, ok := command.Param('Z'); ok {
+		zOffset, err := processor.zOffset(processor.x, processor.y, newZ)
+		if err != nil {
+			return "", err
+		}
+		processor.z = newZ
+		processor.adjustedZ = newZ + zOffset
+		command.Params = append([]gcode.Param(nil), command.Params...)
+		command.SetParam('Z', math.Round(processor.adjustedZ*1000)/1000)
+	}
+	return command.String(), nil
+}
+
+// home handles the homing commands, which move the given axes (or all axes if none are given) to an endstop.
+func (processor *processor) home(command gcode.Command, xyPosition, zPosition float64) {
+	movex := command.HasParam('X')
+	movey := command.HasParam('Y')
+	movez := command.HasParam('Z')
+	if !(movex || movey || movez) {
+		movex, movey, movez = true, true, true
+	}
+	if movex {
+		processor.x = xyPosition
+	}
+	if movey {
+		processor.y = xyPosition
+	}
+	if movez {
+		processor.z = zPosition
+		processor.adjustedZ = zPosition
+	}
 }
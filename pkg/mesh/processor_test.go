@@ -0,0 +1,402 @@
+package mesh
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"mesh-levelling/pkg/gcode"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testMaterial = "PLA"
+
+// gridMesh returns a mesh with a grid of size×size points from 0 to 100 on both axes, with the bed height given by height.
+func gridMesh(size int, height func(x, y float64) float64) *Mesh {
+	mesh := &Mesh{
+		Version:   FormatVersion,
+		Materials: map[string]MaterialProfile{testMaterial: {}},
+	}
+	for i := 0; i < size; i++ {
+		for j := 0; j < size; j++ {
+			x := 100 * float64(i) / float64(size-1)
+			y := 100 * float64(j) / float64(size-1)
+			mesh.Points = append(mesh.Points, Point{X: x, Y: y, Z: height(x, y)})
+		}
+	}
+	return mesh
+}
+
+func flat(x, y float64) float64 {
+	return 0
+}
+
+func process(t *testing.T, mesh *Mesh, options ProcessOptions, input string) string {
+	t.Helper()
+	if options.Material == "" {
+		options.Material = testMaterial
+	}
+	output := new(bytes.Buffer)
+	if err := Process(strings.NewReader(input), output, mesh, options); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	return output.String()
+}
+
+// captureLog returns everything logged while f runs.
+func captureLog(f func()) string {
+	output := new(bytes.Buffer)
+	writer := log.Writer()
+	log.SetOutput(output)
+	defer log.SetOutput(writer)
+	f()
+	return output.String()
+}
+
+func parseLines(t *testing.T, output string) []gcode.Command {
+	t.Helper()
+	var commands []gcode.Command
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		command, err := gcode.Parse(strings.TrimSuffix(line, "\r"))
+		if err != nil {
+			t.Fatalf("could not parse output line %q: %v", line, err)
+		}
+		commands = append(commands, command)
+	}
+	return commands
+}
+
+func TestProcessPassesThroughLines(t *testing.T) {
+	input := "; generated by a slicer\nM104 S200\nM117 Printing X10 Y10\nG28\n\nG90\n"
+	if output := process(t, gridMesh(3, flat), ProcessOptions{}, input); output != input {
+		t.Errorf("output = %q, want %q", output, input)
+	}
+}
+
+func TestProcessOffsetsZ(t *testing.T) {
+	mesh := gridMesh(3, func(x, y float64) float64 { return 0.5 })
+	mesh.BLTouchHeight = 0.2
+	output := process(t, mesh, ProcessOptions{}, "G28\nG90\nG1 X10 Y10 Z0.2 F3000\nG1 Z0.4\n")
+	want := "G28\nG90\nG1 X10 Y10 Z0.5 F3000\nG1 Z0.7\n"
+	if output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
+
+func TestProcessRelativeAndAbsolute(t *testing.T) {
+	// The bed slopes up by 0.01mm per mm of X
+	mesh := gridMesh(3, func(x, y float64) float64 { return x / 100 })
+	options := ProcessOptions{MinimumSegmentLength: 100}
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"absolute", "G28\nG90\nG1 X0 Y0 Z1\nG1 X50\nG1 X100 Z2\n", "G28\nG90\nG1 X0 Y0 Z1\nG1 X50 Z1.5\nG1 X100 Z3\n"},
+		{"relative", "G28\nG90\nG1 X0 Y0 Z1\nG91\nG1 X50\nG1 X50 Z1\n", "G28\nG90\nG1 X0 Y0 Z1\nG91\nG1 X50 Z0.5\nG1 X50 Z1.5\n"},
+		{"relative extruder", "G28\nG90\nM83\nG1 X0 Y0 Z1\nG1 X50 E2\nG1 X100 E2\n", "G28\nG90\nM83\nG1 X0 Y0 Z1\nG1 X50 E2 Z1.5\nG1 X100 E2 Z2\n"},
+		{"absolute extruder", "G28\nG90\nM82\nG1 X0 Y0 Z1\nG1 X50 E2\nG1 X100 E4\n", "G28\nG90\nM82\nG1 X0 Y0 Z1\nG1 X50 E2 Z1.5\nG1 X100 E4 Z2\n"},
+	}
+	for _, test := range tests {
+		if output := process(t, mesh, options, test.input); output != test.want {
+			t.Errorf("%s: output = %q, want %q", test.name, output, test.want)
+		}
+	}
+}
+
+func TestProcessSegmentsAlongMesh(t *testing.T) {
+	// A hill in the middle of the bed, which a straight move from one side to the other would crash into
+	mesh := gridMesh(5, func(x, y float64) float64 { return 1 - math.Abs(x-50)/50 })
+	output := process(t, mesh, ProcessOptions{}, "G28\nG90\nM82\nG1 X0 Y50 Z0.2\nG1 X100 E10\n")
+	commands := parseLines(t, output)
+	segments := commands[4 : len(commands)-1]
+	if len(segments) == 0 {
+		t.Fatalf("the move was not segmented: %q", output)
+	}
+
+	// Each segment ends on the mesh, and the extrusion is split in proportion to the distance moved
+	for _, segment := range segments {
+		if segment.Comment != " SEGMENT" {
+			t.Errorf("segment %q has no SEGMENT comment", segment.String())
+		}
+		x, _ := segment.Param('X')
+		z, _ := segment.Param('Z')
+		e, _ := segment.Param('E')
+		if wantZ := 0.2 + 1 - math.Abs(x-50)/50; math.Abs(z-wantZ) > 0.001 {
+			t.Errorf("segment %q: Z = %.3f, want %.3f", segment.String(), z, wantZ)
+		}
+		if wantE := x / 10; math.Abs(e-wantE) > 0.0001 {
+			t.Errorf("segment %q: E = %.5f, want %.5f", segment.String(), e, wantE)
+		}
+	}
+	last := commands[len(commands)-1]
+	if x, _ := last.Param('X'); x != 100 || last.HasComment {
+		t.Errorf("the move does not end with the original command: %q", last.String())
+	}
+	if e, _ := last.Param('E'); e != 10 {
+		t.Errorf("the move extrudes to E%v, want E10", e)
+	}
+}
+
+func TestProcessSegmentTolerance(t *testing.T) {
+	// A gentle curve, which segments can follow to within any tolerance
+	height := func(x, y float64) float64 { return math.Sin(x/100*math.Pi) / 2 }
+	mesh := gridMesh(11, height)
+	if err := mesh.SetInterpolation(InterpolationBicubic); err != nil {
+		t.Fatal(err)
+	}
+	for _, maximumMeshDeviation := range []float64{0.1, 0.02, 0.005} {
+		options := ProcessOptions{MaximumMeshDeviation: maximumMeshDeviation, MinimumSegmentLength: 0.5}
+		output := process(t, mesh, options, "G28\nG90\nG1 X0 Y50 Z0\nG1 X100\n")
+		commands := parseLines(t, output)
+
+		// Check that the path of the nozzle is within the tolerance of the mesh at every sample between the points it moves through
+		lastX, lastZ := 0.0, 0.0
+		for _, command := range commands[3:] {
+			x, _ := command.Param('X')
+			z, ok := command.Param('Z')
+			if !ok {
+				z = lastZ
+			}
+			for sample := lastX; sample <= x; sample += SampleResolution {
+				nozzleZ := lastZ + (z-lastZ)*(sample-lastX)/(x-lastX)
+				bedZ, err := mesh.bedHeight(sample, 50)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if deviation := math.Abs(nozzleZ - bedZ); deviation > maximumMeshDeviation+0.001 {
+					t.Errorf("tolerance %v: the nozzle is %.4fmm from the mesh at X%.2f", maximumMeshDeviation, deviation, sample)
+				}
+			}
+			lastX, lastZ = x, z
+		}
+		if lastX != 100 {
+			t.Errorf("tolerance %v: the move ends at X%v", maximumMeshDeviation, lastX)
+		}
+	}
+}
+
+func TestProcessDoesNotSegmentFlatMoves(t *testing.T) {
+	input := "G28\nG90\nG1 X0 Y0 Z0.2\nG1 X100 Y100 E5\n"
+	if output := process(t, gridMesh(3, flat), ProcessOptions{}, input); output != input {
+		t.Errorf("output = %q, want %q", output, input)
+	}
+}
+
+func TestProcessKeepsLineEndings(t *testing.T) {
+	mesh := gridMesh(5, func(x, y float64) float64 { return 1 - math.Abs(x-50)/50 })
+	output := process(t, mesh, ProcessOptions{}, "G28\r\nG90\r\n; comment\r\nG1 X0 Y50 Z0.2\r\nG1 X100\r\nM84")
+	if strings.Count(output, "\n") != strings.Count(output, "\r\n") {
+		t.Errorf("output has mixed line endings: %q", output)
+	}
+	if !strings.HasSuffix(output, "\r\nM84") {
+		t.Errorf("the last line gained a line ending: %q", output)
+	}
+	if !strings.Contains(output, " SEGMENT\r\n") {
+		t.Errorf("the move was not segmented: %q", output)
+	}
+}
+
+func TestProcessNumberedLines(t *testing.T) {
+	mesh := gridMesh(3, func(x, y float64) float64 { return 0.5 })
+	output := process(t, mesh, ProcessOptions{}, "N1 G28*18\nN2 G90*18\nN3 G1 X10 Y10 Z0.2*124 ; first layer\n")
+	want := "N1 G28*18\nN2 G90*18\nN3 G1 X10 Y10 Z0.7*" + strconv.Itoa(int(gcode.Checksum("N3 G1 X10 Y10 Z0.7"))) + " ; first layer\n"
+	if output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+
+	// A numbered move that is split into segments keeps its number only on the last line, where it ends
+	hill := gridMesh(5, func(x, y float64) float64 { return 1 - math.Abs(x-50)/50 })
+	input := "N1 G28*18\nN2 G90*18\nN3 G1 X0 Y50 Z0.2*73\nN4 G1 X100 E10*1\n"
+	output = process(t, hill, ProcessOptions{}, input)
+	commands := parseLines(t, output)
+	segments := commands[3 : len(commands)-1]
+	if len(segments) == 0 {
+		t.Fatalf("the move was not segmented: %v", commands)
+	}
+	for _, segment := range segments {
+		if segment.HasLineNumber || segment.HasChecksum {
+			t.Errorf("segment %q has a line number or checksum", segment.String())
+		}
+	}
+	last := commands[len(commands)-1]
+	if !last.HasLineNumber || last.LineNumber != 4 || !last.HasChecksum {
+		t.Errorf("the last line of the move is %q, want N4 with a checksum", last.String())
+	}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if line, checksum, ok := strings.Cut(line, "*"); ok && checksum != strconv.Itoa(int(gcode.Checksum(line))) {
+			t.Errorf("line %q has the wrong checksum %s", line, checksum)
+		}
+	}
+}
+
+func TestProcessWarnsAboutUnparsedMoves(t *testing.T) {
+	input := "G28\nG90\nG1 X10 Y10 Z0.2\nG1 X(10) Y20\nG10\nN5 G0 X=5\nG28 X(1)\n"
+	var output string
+	logged := captureLog(func() {
+		output = process(t, gridMesh(3, flat), ProcessOptions{}, input)
+	})
+	if output != input {
+		t.Errorf("output = %q, want %q", output, input)
+	}
+	if !strings.Contains(logged, "2 moves could not be parsed") || !strings.Contains(logged, "Lines: 4, 6") {
+		t.Errorf("the unparsed moves were not reported: %q", logged)
+	}
+}
+
+func TestProcessWarnsAboutMovesOutsideMesh(t *testing.T) {
+	mesh := gridMesh(3, flat)
+	input := "G28\nG90\nG1 X50 Y50 Z0.2\nG1 X150 E1\nG1 X50\nG1 X-10 Y-10 Z5\n"
+	logged := captureLog(func() {
+		process(t, mesh, ProcessOptions{}, input)
+	})
+	if !strings.Contains(logged, "1 extruding moves are outside of the probed area of the mesh, so the mesh was extrapolated (clamp). Lines: 4\n") {
+		t.Errorf("the extruding move outside the mesh was not reported: %q", logged)
+	}
+	if !strings.Contains(logged, "2 travel moves (which don't extrude) are outside of the probed area of the mesh, so the mesh was extrapolated (clamp). Lines: 5, 6\n") {
+		t.Errorf("the travel moves outside the mesh were not reported: %q", logged)
+	}
+}
+
+func TestProcessFirstLayerSquish(t *testing.T) {
+	mesh := gridMesh(3, flat)
+	mesh.Materials[testMaterial] = MaterialProfile{FirstLayerSquish: 0.9}
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			"start script that travels high before printing",
+			"G28\nG90\nG1 Z10 F600\nG1 X10 Y10\nG1 Z0.2\nG1 X12 E2\nG1 Z0.4\nG1 X10 E4\n",
+			"G28\nG90\nG1 Z10 F600\nG1 X10 Y10\nG1 Z0.18\nG1 X12 E2\nG1 Z0.4\nG1 X10 E4\n",
+		},
+		{
+			"Z hop on the first layer",
+			"G28\nG90\nG1 X10 Y10 Z0.3\nG1 X12 E2\nG1 Z0.8\nG1 X10\nG1 Z0.3\nG1 X12 E4\n",
+			"G28\nG90\nG1 X10 Y10 Z0.27\nG1 X12 E2\nG1 Z0.8\nG1 X10\nG1 Z0.27\nG1 X12 E4\n",
+		},
+	}
+	for _, test := range tests {
+		if output := process(t, mesh, ProcessOptions{}, test.input); output != test.want {
+			t.Errorf("%s: output = %q, want %q", test.name, output, test.want)
+		}
+	}
+}
+
+func TestProcessCompensatesExtrusion(t *testing.T) {
+	// The bed slopes up by 0.1mm per mm of X, so moving along X also moves 0.1mm in Z per mm and needs more filament
+	mesh := gridMesh(3, func(x, y float64) float64 { return x / 10 })
+	multiplier := math.Sqrt(1 + 0.1*0.1)
+	var output string
+	logged := captureLog(func() {
+		output = process(t, mesh, ProcessOptions{CompensateExtrusion: true}, "G28\nG90\nM82\nG1 X0 Y50 Z0.2 F3000\nG1 X50 E5\nG1 Y60 E6\nG1 X0 E11 F1200\n")
+	})
+	want := []string{
+		"G1 X0 Y50 Z0.2 F3000",
+		// The feedrate is increased to cover the longer distance in the same time
+		"G1 X50 E" + strconv.FormatFloat(math.Round(5*multiplier*1e5)/1e5, 'f', -1, 64) + " F" + strconv.Itoa(int(math.Round(3000*multiplier))) + " Z5.2",
+		// Moving along Y doesn't change Z, so the feedrate is restored and the extrusion isn't compensated
+		"G1 Y60 E" + strconv.FormatFloat(math.Round((5*multiplier+1)*1e5)/1e5, 'f', -1, 64) + " F3000",
+		"G1 X0 E" + strconv.FormatFloat(math.Round((5*multiplier+1+5*multiplier)*1e5)/1e5, 'f', -1, 64) + " F" + strconv.Itoa(int(math.Round(1200*multiplier))) + " Z0.2",
+	}
+	if got := strings.Split(strings.TrimSpace(output), "\n")[3:]; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	if wantLog := "Extrusion compensation added " + strconv.FormatFloat(10*(multiplier-1), 'f', 3, 64) + "mm of filament"; !strings.Contains(logged, wantLog) {
+		t.Errorf("logged %q, want %q", logged, wantLog)
+	}
+
+	// Without compensation, the extrusion and feedrate are unchanged
+	output = process(t, mesh, ProcessOptions{}, "G28\nG90\nM82\nG1 X0 Y50 Z0.2 F3000\nG1 X50 E5\n")
+	if want := "G28\nG90\nM82\nG1 X0 Y50 Z0.2 F3000\nG1 X50 E5 Z5.2\n"; output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
+
+func TestProcessCompensatesSegmentedExtrusion(t *testing.T) {
+	// A hill in the middle of the bed, so each segment of a move across it has its own slope and compensation
+	mesh := gridMesh(5, func(x, y float64) float64 { return 5 - math.Abs(x-50)/10 })
+	var output string
+	logged := captureLog(func() {
+		output = process(t, mesh, ProcessOptions{CompensateExtrusion: true}, "G28\nG90\nM83\nG1 X0 Y50 Z0.2 F3000\nG1 X100 E10\n")
+	})
+	commands := parseLines(t, output)[4:]
+	if len(commands) < 2 {
+		t.Fatalf("the move was not segmented: %q", output)
+	}
+
+	lastX, lastZ, lastF, extruded := 0.0, 0.2, 3000.0, 0.0
+	for _, command := range commands {
+		x, _ := command.Param('X')
+		z := handleMoveArgument(command, 'Z', false, lastZ)
+		f := handleMoveArgument(command, 'F', false, lastF)
+		e, _ := command.Param('E')
+		multiplier := math.Hypot(x-lastX, z-lastZ) / (x - lastX)
+		if wantE := (x - lastX) / 10 * multiplier; math.Abs(e-wantE) > 0.0002 {
+			t.Errorf("%q: E = %.5f, want %.5f", command.String(), e, wantE)
+		}
+		if wantF := 3000 * multiplier; math.Abs(f-wantF) > 0.5+3000*0.0002 {
+			t.Errorf("%q: F = %v, want %.0f", command.String(), f, wantF)
+		}
+		extruded += e
+		lastX, lastZ, lastF = x, z, f
+	}
+	if lastX != 100 {
+		t.Errorf("the move ends at X%v, want X100", lastX)
+	}
+	if !strings.Contains(logged, "Extrusion compensation added "+strconv.FormatFloat(extruded-10, 'f', 3, 64)+"mm of filament") {
+		t.Errorf("logged %q, want the %.3fmm of filament that was added", logged, extruded-10)
+	}
+}
+
+func TestProcessFadesMesh(t *testing.T) {
+	// The bed is 1mm higher than where it was probed, and the mesh fades out between Z2 and Z10
+	heights := []float64{1, 2, 4, 6, 8, 10, 12}
+	tests := []struct {
+		curve FadeCurve
+		// How much of the mesh is applied at each of the heights
+		want []float64
+	}{
+		{"", []float64{1, 1, 0.75, 0.5, 0.25, 0, 0}},
+		{FadeCurveLinear, []float64{1, 1, 0.75, 0.5, 0.25, 0, 0}},
+		{FadeCurveSmoothstep, []float64{1, 1, 0.84375, 0.5, 0.15625, 0, 0}},
+		{FadeCurveCosine, []float64{1, 1, (1 + math.Sqrt2/2) / 2, 0.5, (1 - math.Sqrt2/2) / 2, 0, 0}},
+	}
+	input := "G28\nG90\nG1 X50 Y50 Z1\n"
+	for _, z := range heights[1:] {
+		input += "G1 Z" + strconv.FormatFloat(z, 'f', -1, 64) + "\n"
+	}
+	checkFade := func(name string, mesh *Mesh, want []float64) {
+		t.Helper()
+		commands := parseLines(t, process(t, mesh, ProcessOptions{}, input))[2:]
+		if len(commands) != len(heights) {
+			t.Fatalf("%s: %d moves, want %d", name, len(commands), len(heights))
+		}
+		for i, command := range commands {
+			z, _ := command.Param('Z')
+			if wantZ := heights[i] + want[i]; math.Abs(z-wantZ) > 0.0006 {
+				t.Errorf("%s: Z%v became Z%v, want Z%.3f", name, heights[i], z, wantZ)
+			}
+		}
+	}
+
+	for _, test := range tests {
+		mesh := gridMesh(3, func(x, y float64) float64 { return 1 })
+		mesh.FadeStartHeight = 2
+		mesh.FadeHeight = 10
+		mesh.FadeCurve = test.curve
+		checkFade("curve "+string(test.curve), mesh, test.want)
+	}
+
+	// A fade height of 0 applies the whole mesh at every height
+	mesh := gridMesh(3, func(x, y float64) float64 { return 1 })
+	checkFade("no fade", mesh, []float64{1, 1, 1, 1, 1, 1, 1})
+
+	// A material can fade out sooner than the mesh's fade height
+	mesh.FadeStartHeight = 2
+	mesh.FadeHeight = 10
+	mesh.Materials[testMaterial] = MaterialProfile{FadeHeight: 6}
+	checkFade("material fade height", mesh, []float64{1, 1, 0.5, 0, 0, 0, 0})
+}
@@ -0,0 +1,107 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// RefinementCriterion decides where adaptive probing adds points.
+type RefinementCriterion string
+
+const (
+	// Where the surface is most curved, so interpolating between the nearby points is least accurate
+	RefinementError RefinementCriterion = "error"
+	// Where the surface is steepest and furthest from a probed point
+	RefinementGradient RefinementCriterion = "gradient"
+)
+
+var RefinementCriteria = []RefinementCriterion{RefinementError, RefinementGradient}
+
+// The number of nearby points that a plane is fitted through to estimate the interpolation error
+const refinementNeighbours = 6
+
+// RefinementCandidates returns the positions in a grid with the given spacing that are inside the area covered by the points, leaving out any close to a point.
+func RefinementCandidates(points []Point, spacing float64) []Position {
+	hull := convexHull(points)
+	if len(hull) < 3 || spacing <= 0 {
+		return nil
+	}
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, point := range hull {
+		minX, minY = math.Min(minX, point.x), math.Min(minY, point.y)
+		maxX, maxY = math.Max(maxX, point.x), math.Max(maxY, point.y)
+	}
+
+	var candidates []Position
+	for x := minX; x <= maxX; x += spacing {
+		for y := minY; y <= maxY; y += spacing {
+			candidate := Position{math.Round(x*1000) / 1000, math.Round(y*1000) / 1000}
+			if !hullContains(hull, candidate.X, candidate.Y) || nearestDistance(points, candidate.X, candidate.Y) < spacing/2 {
+				continue
+			}
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+func nearestDistance(points []Point, x, y float64) float64 {
+	distance := math.Inf(1)
+	for _, point := range points {
+		distance = math.Min(distance, math.Hypot(x-point.X, y-point.Y))
+	}
+	return distance
+}
+
+// nearestPoints returns the n points closest to the position.
+func nearestPoints(points []Point, x, y float64, n int) []Point {
+	sorted := append([]Point(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return math.Hypot(x-sorted[i].X, y-sorted[i].Y) < math.Hypot(x-sorted[j].X, y-sorted[j].Y)
+	})
+	return sorted[:min(n, len(sorted))]
+}
+
+// ChooseRefinementPoint returns the candidate that would improve the mesh the most if it were probed, and an estimate in mm of how much it would improve it.
+func ChooseRefinementPoint(points []Point, candidates []Position, criterion RefinementCriterion) (Position, float64, error) {
+	if len(candidates) == 0 {
+		return Position{}, 0, errors.New("no candidates to refine the mesh with")
+	}
+	surface, err := newThinPlateSplineInterpolator(points)
+	if err != nil {
+		return Position{}, 0, err
+	}
+
+	var best Position
+	bestScore := math.Inf(-1)
+	for _, candidate := range candidates {
+		var score float64
+		switch criterion {
+		case "", RefinementError:
+			// A plane fits the nearby points exactly where the surface is flat (even if it is tilted), so the difference between it and the surface is how curved the surface is
+			a, b, c, err := fitPlane(nearestPoints(points, candidate.X, candidate.Y, refinementNeighbours))
+			if err != nil {
+				continue
+			}
+			score = math.Abs(surface.Interpolate(candidate.X, candidate.Y) - (a + b*candidate.X + c*candidate.Y))
+		case RefinementGradient:
+			const step = 0.5
+			gradientX := (surface.Interpolate(candidate.X+step, candidate.Y) - surface.Interpolate(candidate.X-step, candidate.Y)) / (2 * step)
+			gradientY := (surface.Interpolate(candidate.X, candidate.Y+step) - surface.Interpolate(candidate.X, candidate.Y-step)) / (2 * step)
+			score = math.Hypot(gradientX, gradientY) * nearestDistance(points, candidate.X, candidate.Y)
+		default:
+			return Position{}, 0, fmt.Errorf("unknown refinement criterion: %s", criterion)
+		}
+		if isValid(score) && score > bestScore {
+			best = candidate
+			bestScore = score
+		}
+	}
+	if math.IsInf(bestScore, -1) {
+		return Position{}, 0, errors.New("could not estimate the error at any of the candidates")
+	}
+	return best, bestScore, nil
+}
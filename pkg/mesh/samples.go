@@ -0,0 +1,95 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Aggregation combines the samples probed at a point into the Z of the point.
+type Aggregation string
+
+const (
+	AggregationMean        Aggregation = "mean"
+	AggregationMedian      Aggregation = "median"
+	AggregationTrimmedMean Aggregation = "trimmed-mean"
+)
+
+var Aggregations = []Aggregation{AggregationMean, AggregationMedian, AggregationTrimmedMean}
+
+// TrimmedMeanProportion is the proportion of samples that are discarded from each end before taking a trimmed mean.
+const TrimmedMeanProportion = 0.2
+
+// SampleStatistics describes the samples probed at a point.
+type SampleStatistics struct {
+	Minimum, Maximum, Mean, Median, StandardDeviation float64
+}
+
+// Spread returns the difference between the highest and lowest sample.
+func (statistics SampleStatistics) Spread() float64 {
+	return statistics.Maximum - statistics.Minimum
+}
+
+func (statistics SampleStatistics) String() string {
+	return fmt.Sprintf("min %.3f, max %.3f, range %.3f, mean %.3f, median %.3f, standard deviation %.4f",
+		statistics.Minimum, statistics.Maximum, statistics.Spread(), statistics.Mean, statistics.Median, statistics.StandardDeviation)
+}
+
+func sortedSamples(samples []float64) []float64 {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	return sorted
+}
+
+func mean(samples []float64) float64 {
+	var total float64
+	for _, sample := range samples {
+		total += sample
+	}
+	return total / float64(len(samples))
+}
+
+func median(sorted []float64) float64 {
+	if len(sorted)%2 == 0 {
+		return (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	}
+	return sorted[len(sorted)/2]
+}
+
+// CalculateSampleStatistics calculates the statistics of at least one sample.
+func CalculateSampleStatistics(samples []float64) SampleStatistics {
+	sorted := sortedSamples(samples)
+	statistics := SampleStatistics{
+		Minimum: sorted[0],
+		Maximum: sorted[len(sorted)-1],
+		Mean:    mean(sorted),
+		Median:  median(sorted),
+	}
+	var sumOfSquares float64
+	for _, sample := range sorted {
+		sumOfSquares += math.Pow(sample-statistics.Mean, 2)
+	}
+	// Population standard deviation, like Marlin's M48
+	statistics.StandardDeviation = math.Sqrt(sumOfSquares / float64(len(sorted)))
+	return statistics
+}
+
+// AggregateSamples combines at least one sample into a single Z. An empty aggregation is the mean.
+func AggregateSamples(samples []float64, aggregation Aggregation) (float64, error) {
+	if len(samples) == 0 {
+		return 0, errors.New("no samples to aggregate")
+	}
+	switch aggregation {
+	case "", AggregationMean:
+		return mean(samples), nil
+	case AggregationMedian:
+		return median(sortedSamples(samples)), nil
+	case AggregationTrimmedMean:
+		sorted := sortedSamples(samples)
+		trimmed := int(float64(len(sorted)) * TrimmedMeanProportion)
+		return mean(sorted[trimmed : len(sorted)-trimmed]), nil
+	default:
+		return 0, fmt.Errorf("unknown aggregation: %s", aggregation)
+	}
+}
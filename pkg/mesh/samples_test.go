@@ -0,0 +1,72 @@
+package mesh
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAggregateSamples(t *testing.T) {
+	tests := []struct {
+		name        string
+		samples     []float64
+		aggregation Aggregation
+		want        float64
+	}{
+		{"one sample", []float64{1.5}, AggregationTrimmedMean, 1.5},
+		{"default is mean", []float64{1, 2, 6}, "", 3},
+		{"mean", []float64{1, 2, 6}, AggregationMean, 3},
+		{"median of odd", []float64{6, 1, 2}, AggregationMedian, 2},
+		{"median of even", []float64{6, 1, 2, 3}, AggregationMedian, 2.5},
+		// Too few samples to trim any, so this is the mean
+		{"trimmed mean of 4", []float64{1, 2, 3, 10}, AggregationTrimmedMean, 4},
+		// One sample is trimmed from each end
+		{"trimmed mean of 5", []float64{10, 1, 2, 3, -20}, AggregationTrimmedMean, 2},
+		{"trimmed mean of 10", []float64{0, 5, 5, 5, 5, 5, 5, 5, 5, 100}, AggregationTrimmedMean, 5},
+	}
+	for _, test := range tests {
+		got, err := AggregateSamples(test.samples, test.aggregation)
+		if err != nil {
+			t.Errorf("%s: AggregateSamples failed: %v", test.name, err)
+		} else if math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: AggregateSamples = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	if _, err := AggregateSamples(nil, AggregationMedian); err == nil {
+		t.Error("AggregateSamples aggregated no samples")
+	}
+	if _, err := AggregateSamples([]float64{1}, "mode"); err == nil {
+		t.Error("AggregateSamples accepted an unknown aggregation")
+	}
+}
+
+func TestTrimmedMeanKeepsSamples(t *testing.T) {
+	if TrimmedMeanProportion < 0 || TrimmedMeanProportion >= 0.5 {
+		t.Fatalf("TrimmedMeanProportion = %v, which would trim every sample", TrimmedMeanProportion)
+	}
+	// However many samples there are, trimming leaves some, and the result is between the untrimmed samples
+	for numberOfSamples := 1; numberOfSamples <= 50; numberOfSamples++ {
+		samples := make([]float64, numberOfSamples)
+		for i := range samples {
+			samples[i] = float64(i * i)
+		}
+		got, err := AggregateSamples(samples, AggregationTrimmedMean)
+		if err != nil || !isValid(got) || got < samples[0] || got > samples[numberOfSamples-1] {
+			t.Errorf("%d samples: trimmed mean = %v, %v", numberOfSamples, got, err)
+		}
+	}
+}
+
+func TestCalculateSampleStatistics(t *testing.T) {
+	statistics := CalculateSampleStatistics([]float64{2, 4, 4, 4, 5, 5, 7, 9})
+	want := SampleStatistics{Minimum: 2, Maximum: 9, Mean: 5, Median: 4.5, StandardDeviation: 2}
+	if statistics != want {
+		t.Errorf("CalculateSampleStatistics = %+v, want %+v", statistics, want)
+	}
+	if spread := statistics.Spread(); spread != 7 {
+		t.Errorf("Spread = %v, want 7", spread)
+	}
+	if statistics := CalculateSampleStatistics([]float64{0.25}); statistics.StandardDeviation != 0 || statistics.Spread() != 0 || statistics.Median != 0.25 {
+		t.Errorf("CalculateSampleStatistics of one sample = %+v", statistics)
+	}
+}
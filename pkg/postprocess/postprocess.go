@@ -0,0 +1,131 @@
+package postprocess
+
+import (
+	"encoding/json"
+	"fmt"
+	"mesh-levelling/pkg/gcode"
+	"mesh-levelling/pkg/mesh"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ConfigFilename is the name of the config file, which is looked for next to the executable.
+	ConfigFilename = "mesh-level.json"
+	// ConfigEnvironmentVariable overrides the location of the config file.
+	ConfigEnvironmentVariable = "MESH_LEVEL_CONFIG"
+)
+
+// Extensions of the files that slicers may ask us to post-process
+var gcodeExtensions = map[string]bool{
+	".g":     true,
+	".gx":    true,
+	".gco":   true,
+	".gcode": true,
+}
+
+// Config configures how files are levelled when we are run by a slicer.
+type Config struct {
+	// The mesh file to level with. Relative paths are relative to the config file.
+	Mesh string
+	// The material to use if the slicer doesn't say what it is, or it isn't in the mesh
+	Material             string
+	CompensateExtrusion  bool
+	MaximumMeshDeviation float64
+	MinimumSegmentLength float64
+}
+
+// Detect returns the gcode file to post-process if the arguments look like we have been run by a slicer.
+// PrusaSlicer, SuperSlicer, OrcaSlicer and Cura's post-processing plugins all run the post-processing executable with the path of the gcode file as the only argument.
+func Detect(arguments []string) (string, bool) {
+	if len(arguments) != 1 {
+		return "", false
+	}
+	filename := arguments[0]
+	info, err := os.Stat(filename)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	// PrusaSlicer and its forks tell us the real output name, as the file we are given is a temporary file that may not have a gcode extension
+	if _, ok := os.LookupEnv("SLIC3R_PP_OUTPUT_NAME"); ok {
+		return filename, true
+	}
+	return filename, gcodeExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
+// LoadConfig loads the config file from ConfigEnvironmentVariable, or from next to the executable.
+func LoadConfig() (*Config, error) {
+	filename, ok := os.LookupEnv(ConfigEnvironmentVariable)
+	if !ok {
+		executable, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		filename = filepath.Join(filepath.Dir(executable), ConfigFilename)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open post-processing config: %w", err)
+	}
+	defer file.Close()
+
+	var config Config
+	if err := json.NewDecoder(file).Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid post-processing config %s: %w", filename, err)
+	}
+	if config.Mesh == "" {
+		return nil, fmt.Errorf("post-processing config %s has no mesh", filename)
+	}
+	if !filepath.IsAbs(config.Mesh) {
+		config.Mesh = filepath.Join(filepath.Dir(filename), config.Mesh)
+	}
+	return &config, nil
+}
+
+// SlicerMaterial returns the filament type that the slicer has put in the environment, if any.
+func SlicerMaterial() (string, bool) {
+	// PrusaSlicer and its forks export their config as SLIC3R_ environment variables.
+	// With multiple extruders the value is a list separated by ';', so the first extruder is used.
+	filamentType, ok := os.LookupEnv("SLIC3R_FILAMENT_TYPE")
+	if !ok {
+		return "", false
+	}
+	filamentType, _, _ = strings.Cut(filamentType, ";")
+	filamentType = strings.Trim(strings.TrimSpace(filamentType), "\"")
+	return filamentType, filamentType != ""
+}
+
+// slicerTemperature returns the nozzle temperature that the slicer has put in the environment, or 0.
+func slicerTemperature() float64 {
+	temperature, _, _ := strings.Cut(os.Getenv("SLIC3R_TEMPERATURE"), ",")
+	value, err := strconv.ParseFloat(strings.TrimSpace(temperature), 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// Run levels the gcode file in place.
+func Run(filename string, config *Config) error {
+	bedMesh, err := mesh.LoadMesh(config.Mesh)
+	if err != nil {
+		return fmt.Errorf("could not load mesh %s: %w", config.Mesh, err)
+	}
+
+	// If the material isn't in the environment, it is detected from the comments in the file
+	var material string
+	if filamentType, ok := SlicerMaterial(); ok {
+		material, _ = bedMesh.ResolveMaterial(gcode.Metadata{FilamentType: filamentType, NozzleTemperature: slicerTemperature()})
+	}
+
+	return mesh.ProcessFile(filename, filename, bedMesh, mesh.ProcessOptions{
+		Material:             material,
+		FallbackMaterial:     config.Material,
+		CompensateExtrusion:  config.CompensateExtrusion,
+		MaximumMeshDeviation: config.MaximumMeshDeviation,
+		MinimumSegmentLength: config.MinimumSegmentLength,
+	})
+}
@@ -0,0 +1,193 @@
+package postprocess
+
+import (
+	"mesh-levelling/pkg/mesh"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// unsetenv unsets an environment variable for the duration of the test.
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+func writeFile(t *testing.T, filename, contents string) string {
+	t.Helper()
+	if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// saveTestMesh saves a flat mesh where PLA is offset by 0.1mm and PETG by 0.3mm, so the material that was used can be told from the output.
+func saveTestMesh(t *testing.T, filename string) string {
+	t.Helper()
+	testMesh := &mesh.Mesh{
+		Points:    []mesh.Point{{X: 0, Y: 0}, {X: 0, Y: 100}, {X: 100, Y: 0}, {X: 100, Y: 100}},
+		Materials: map[string]mesh.MaterialProfile{"PLA": {ZOffset: 0.1}, "PETG": {ZOffset: 0.3}},
+	}
+	if err := mesh.SaveMesh(testMesh, filename); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestDetect(t *testing.T) {
+	unsetenv(t, "SLIC3R_PP_OUTPUT_NAME")
+	directory := t.TempDir()
+	gcodeFilename := writeFile(t, filepath.Join(directory, "print.gcode"), "G28\n")
+	upperCaseFilename := writeFile(t, filepath.Join(directory, "print.GX"), "G28\n")
+	temporaryFilename := writeFile(t, filepath.Join(directory, "print.tmp"), "G28\n")
+	tests := []struct {
+		name      string
+		arguments []string
+		want      bool
+	}{
+		{"no arguments", nil, false},
+		{"gcode file", []string{gcodeFilename}, true},
+		{"upper case extension", []string{upperCaseFilename}, true},
+		{"other extension", []string{temporaryFilename}, false},
+		{"missing file", []string{filepath.Join(directory, "missing.gcode")}, false},
+		{"directory", []string{directory}, false},
+		{"command", []string{"process"}, false},
+		{"several arguments", []string{gcodeFilename, gcodeFilename}, false},
+	}
+	for _, test := range tests {
+		filename, ok := Detect(test.arguments)
+		if ok != test.want || (ok && filename != test.arguments[0]) {
+			t.Errorf("%s: Detect(%q) = %q, %v, want %v", test.name, test.arguments, filename, ok, test.want)
+		}
+	}
+
+	// PrusaSlicer gives us a temporary file with any extension, but says that it is post-processing
+	t.Setenv("SLIC3R_PP_OUTPUT_NAME", filepath.Join(directory, "print.gcode"))
+	if filename, ok := Detect([]string{temporaryFilename}); !ok || filename != temporaryFilename {
+		t.Errorf("Detect from PrusaSlicer = %q, %v, want %q", filename, ok, temporaryFilename)
+	}
+	if _, ok := Detect([]string{directory}); ok {
+		t.Error("Detect from PrusaSlicer accepted a directory")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	directory := t.TempDir()
+	absoluteMesh := filepath.Join(t.TempDir(), "bed.mesh")
+	tests := []struct {
+		name     string
+		config   string
+		wantMesh string
+		wantErr  string
+	}{
+		{"relative mesh", `{"Mesh": "bed.mesh", "Material": "PLA", "CompensateExtrusion": true}`, filepath.Join(directory, "bed.mesh"), ""},
+		{"absolute mesh", `{"Mesh": ` + strings.ReplaceAll(`"`+absoluteMesh+`"`, `\`, `\\`) + `}`, absoluteMesh, ""},
+		{"no mesh", `{"Material": "PLA"}`, "", "has no mesh"},
+		{"not JSON", `Mesh = bed.mesh`, "", "invalid post-processing config"},
+	}
+	for _, test := range tests {
+		t.Setenv(ConfigEnvironmentVariable, writeFile(t, filepath.Join(directory, "config.json"), test.config))
+		config, err := LoadConfig()
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: LoadConfig returned %v, want an error containing %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: LoadConfig failed: %v", test.name, err)
+		} else if config.Mesh != test.wantMesh {
+			t.Errorf("%s: Mesh = %q, want %q", test.name, config.Mesh, test.wantMesh)
+		}
+	}
+
+	t.Setenv(ConfigEnvironmentVariable, filepath.Join(directory, "missing.json"))
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "could not open post-processing config") {
+		t.Errorf("LoadConfig returned %v for a missing config", err)
+	}
+}
+
+func TestLoadConfigNextToExecutable(t *testing.T) {
+	unsetenv(t, ConfigEnvironmentVariable)
+	executable, err := os.Executable()
+	if err != nil {
+		t.Skip("can't find the test executable:", err)
+	}
+	filename := filepath.Join(filepath.Dir(executable), ConfigFilename)
+	if err := os.WriteFile(filename, []byte(`{"Mesh": "bed.mesh"}`), 0644); err != nil {
+		t.Skip("can't write next to the test executable:", err)
+	}
+	t.Cleanup(func() { os.Remove(filename) })
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if want := filepath.Join(filepath.Dir(executable), "bed.mesh"); config.Mesh != want {
+		t.Errorf("Mesh = %q, want %q", config.Mesh, want)
+	}
+}
+
+func TestSlicerMaterial(t *testing.T) {
+	tests := []struct {
+		name         string
+		filamentType string
+		want         string
+		wantOK       bool
+	}{
+		{"one extruder", "PETG", "PETG", true},
+		{"several extruders", `"PLA";"PETG"`, "PLA", true},
+		{"spaces", " ASA ;PLA", "ASA", true},
+		{"empty", "", "", false},
+		{"empty first extruder", `"";PLA`, "", false},
+	}
+	for _, test := range tests {
+		t.Setenv("SLIC3R_FILAMENT_TYPE", test.filamentType)
+		if got, ok := SlicerMaterial(); got != test.want || ok != test.wantOK {
+			t.Errorf("%s: SlicerMaterial() with %q = %q, %v, want %q, %v", test.name, test.filamentType, got, ok, test.want, test.wantOK)
+		}
+	}
+
+	unsetenv(t, "SLIC3R_FILAMENT_TYPE")
+	if got, ok := SlicerMaterial(); ok {
+		t.Errorf("SlicerMaterial() without a slicer = %q, want nothing", got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	unsetenv(t, "SLIC3R_TEMPERATURE")
+	directory := t.TempDir()
+	config := &Config{Mesh: saveTestMesh(t, filepath.Join(directory, "bed.mesh")), Material: "PLA"}
+	tests := []struct {
+		name         string
+		filamentType string
+		want         string
+	}{
+		{"material from the slicer", "PETG", "G28\nG90\nG1 X10 Y10 Z5.3\n"},
+		// Materials that aren't in the mesh fall back to the config's material
+		{"unknown material", "TPU", "G28\nG90\nG1 X10 Y10 Z5.1\n"},
+		{"no slicer", "", "G28\nG90\nG1 X10 Y10 Z5.1\n"},
+	}
+	for _, test := range tests {
+		if test.filamentType == "" {
+			unsetenv(t, "SLIC3R_FILAMENT_TYPE")
+		} else {
+			t.Setenv("SLIC3R_FILAMENT_TYPE", test.filamentType)
+		}
+		filename := writeFile(t, filepath.Join(directory, "print.gcode"), "G28\nG90\nG1 X10 Y10 Z5\n")
+		if err := Run(filename, config); err != nil {
+			t.Errorf("%s: Run failed: %v", test.name, err)
+			continue
+		}
+		// The file is levelled in place
+		if got, err := os.ReadFile(filename); err != nil || string(got) != test.want {
+			t.Errorf("%s: the file is %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	if err := Run(filepath.Join(directory, "print.gcode"), &Config{Mesh: filepath.Join(directory, "missing.mesh")}); err == nil || !strings.Contains(err.Error(), "could not load mesh") {
+		t.Errorf("Run returned %v for a missing mesh", err)
+	}
+}
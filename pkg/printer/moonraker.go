@@ -0,0 +1,137 @@
+package printer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How many of Klipper's recent gcode responses are searched for the response to a command
+const moonrakerGcodeStoreCount = 100
+
+// moonrakerTransport sends gcode to Klipper with Moonraker's JSON-RPC API over HTTP.
+type moonrakerTransport struct {
+	client *http.Client
+	url    string
+	apiKey string
+	nextID int
+}
+
+// NewMoonraker creates a Transport for Moonraker at the URL, eg. http://printer.lan:7125.
+// The API key is only needed if Moonraker requires authorization.
+func NewMoonraker(url, apiKey string) Transport {
+	return &moonrakerTransport{
+		client: &http.Client{},
+		url:    strings.TrimSuffix(url, "/"),
+		apiKey: apiKey,
+	}
+}
+
+type jsonRPCRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+	ID      int    `json:"id"`
+}
+
+type jsonRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type jsonRPCResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *jsonRPCError   `json:"error"`
+	ID     int             `json:"id"`
+}
+
+// call calls a JSON-RPC method and decodes its result. Errors returned by the method are *jsonRPCError.
+func (transport *moonrakerTransport) call(method string, params any, result any, timeout time.Duration) error {
+	transport.nextID++
+	body, err := json.Marshal(jsonRPCRequest{"2.0", method, params, transport.nextID})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, transport.url+"/server/jsonrpc", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if transport.apiKey != "" {
+		request.Header.Set("X-Api-Key", transport.apiKey)
+	}
+	client := *transport.client
+	client.Timeout = timeout
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var rpcResponse jsonRPCResponse
+	if err := json.NewDecoder(response.Body).Decode(&rpcResponse); err != nil {
+		return fmt.Errorf("invalid response from Moonraker (%s): %w", response.Status, err)
+	}
+	if rpcResponse.Error != nil {
+		return rpcResponse.Error
+	}
+	if rpcResponse.ID != transport.nextID {
+		return fmt.Errorf("Moonraker replied to request %d instead of %d", rpcResponse.ID, transport.nextID)
+	}
+	return json.Unmarshal(rpcResponse.Result, result)
+}
+
+func (err *jsonRPCError) Error() string {
+	return fmt.Sprintf("%s (%d)", err.Message, err.Code)
+}
+
+type gcodeStoreEntry struct {
+	Message string  `json:"message"`
+	Time    float64 `json:"time"`
+	// "command" or "response"
+	Type string `json:"type"`
+}
+
+// Exec runs the gcode with printer.gcode.script, which only returns once Klipper has run it, and then finds its response in server.gcode_store.
+func (transport *moonrakerTransport) Exec(gcode string, timeout time.Duration) ([]string, error) {
+	var result string
+	if err := transport.call("printer.gcode.script", map[string]string{"script": gcode}, &result, timeout); err != nil {
+		if rpcErr, ok := err.(*jsonRPCError); ok {
+			return nil, &CommandError{gcode, []string{rpcErr.Message}}
+		}
+		if isTimeout(err) {
+			return nil, &TimeoutError{gcode, false, timeout}
+		}
+		return nil, fmt.Errorf("could not send %q: %w", gcode, err)
+	}
+
+	var store struct {
+		GcodeStore []gcodeStoreEntry `json:"gcode_store"`
+	}
+	if err := transport.call("server.gcode_store", map[string]int{"count": moonrakerGcodeStoreCount}, &store, ResponseTimeout); err != nil {
+		return nil, fmt.Errorf("could not read the response to %q: %w", gcode, err)
+	}
+	// The response is everything after the last time the command was sent
+	for i := len(store.GcodeStore) - 1; i >= 0; i-- {
+		entry := store.GcodeStore[i]
+		if entry.Type != "command" || !strings.EqualFold(strings.TrimSpace(entry.Message), gcode) {
+			continue
+		}
+		var data []string
+		for _, entry := range store.GcodeStore[i+1:] {
+			if entry.Type == "response" {
+				data = append(data, strings.TrimSpace(entry.Message))
+			}
+		}
+		return data, nil
+	}
+	return nil, nil
+}
+
+func (transport *moonrakerTransport) Close() error {
+	transport.client.CloseIdleConnections()
+	return nil
+}
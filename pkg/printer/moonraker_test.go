@@ -0,0 +1,120 @@
+package printer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMoonraker runs gcode with printer.gcode.script and records it in a gcode store like Moonraker.
+type fakeMoonraker struct {
+	mutex sync.Mutex
+	store []gcodeStoreEntry
+}
+
+func (moonraker *fakeMoonraker) addToStore(entryType string, messages ...string) {
+	moonraker.mutex.Lock()
+	defer moonraker.mutex.Unlock()
+	for _, message := range messages {
+		moonraker.store = append(moonraker.store, gcodeStoreEntry{Message: message, Time: float64(len(moonraker.store)), Type: entryType})
+	}
+}
+
+func (moonraker *fakeMoonraker) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.URL.Path != "/server/jsonrpc" || request.Method != http.MethodPost {
+		http.NotFound(writer, request)
+		return
+	}
+	if request.Header.Get("X-Api-Key") != "secret" {
+		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var rpcRequest struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+		ID     int             `json:"id"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&rpcRequest); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := map[string]any{"jsonrpc": "2.0", "id": rpcRequest.ID}
+	switch rpcRequest.Method {
+	case "printer.gcode.script":
+		var params struct {
+			Script string `json:"script"`
+		}
+		_ = json.Unmarshal(rpcRequest.Params, &params)
+		moonraker.addToStore("command", params.Script)
+		switch params.Script {
+		case "G999":
+			moonraker.addToStore("response", `!! Unknown command:"G999"`)
+			response["error"] = jsonRPCError{400, `Unknown command:"G999"`}
+		case "M400":
+			// Takes longer than the timeout, and its response is stored after the next command is sent
+			time.Sleep(150 * time.Millisecond)
+			moonraker.addToStore("response", "// late")
+			response["result"] = "ok"
+		case "M114":
+			moonraker.addToStore("response", "X:10.000 Y:20.000 Z:5.000 E:0.000")
+			response["result"] = "ok"
+		default:
+			response["result"] = "ok"
+		}
+	case "server.gcode_store":
+		moonraker.mutex.Lock()
+		response["result"] = map[string]any{"gcode_store": moonraker.store}
+		moonraker.mutex.Unlock()
+	default:
+		response["error"] = jsonRPCError{-32601, "Method not found"}
+	}
+	_ = json.NewEncoder(writer).Encode(response)
+}
+
+func TestMoonrakerTransport(t *testing.T) {
+	moonraker := new(fakeMoonraker)
+	server := httptest.NewServer(moonraker)
+	defer server.Close()
+	transport := NewMoonraker(server.URL+"/", "secret")
+	defer transport.Close()
+
+	// Other clients (eg. the web interface) also send commands, which are in the store before this one
+	moonraker.addToStore("command", "M114")
+	moonraker.addToStore("response", "X:0.000 Y:0.000 Z:0.000 E:0.000")
+
+	if data, err := transport.Exec("G1 X10 Y20", time.Second); err != nil || len(data) != 0 {
+		t.Errorf("Exec(G1) = %q, %v, want no data", data, err)
+	}
+	if data, err := transport.Exec("M114", time.Second); err != nil || !slices.Equal(data, []string{"X:10.000 Y:20.000 Z:5.000 E:0.000"}) {
+		t.Errorf("Exec(M114) = %q, %v, want only the latest position", data, err)
+	}
+
+	var commandErr *CommandError
+	if _, err := transport.Exec("G999", time.Second); !errors.As(err, &commandErr) || !slices.Equal(commandErr.Messages, []string{`Unknown command:"G999"`}) {
+		t.Errorf("Exec(G999) returned %v, want a CommandError", err)
+	}
+
+	if _, err := transport.Exec("M400", 50*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Exec(M400) returned %v, want a TimeoutError", err)
+	}
+	// The late response to M400 must not be mistaken for the response to M114
+	time.Sleep(150 * time.Millisecond)
+	if data, err := transport.Exec("M114", time.Second); err != nil || !slices.Equal(data, []string{"X:10.000 Y:20.000 Z:5.000 E:0.000"}) {
+		t.Errorf("Exec(M114) = %q, %v, want only its own response", data, err)
+	}
+}
+
+func TestMoonrakerTransportUnauthorized(t *testing.T) {
+	server := httptest.NewServer(new(fakeMoonraker))
+	defer server.Close()
+	transport := NewMoonraker(server.URL, "wrong")
+	if _, err := transport.Exec("G28", time.Second); err == nil || !strings.Contains(err.Error(), "401 Unauthorized") {
+		t.Errorf("Exec with the wrong API key returned %v, want it to fail with the status", err)
+	}
+}
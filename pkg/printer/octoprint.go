@@ -0,0 +1,197 @@
+package printer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// OctoPrint logs the lines that it sends with their line number and checksum, eg. "N12 G28*18"
+var octoPrintLineNumber = regexp.MustCompile(`^N\d+\s+(.*?)\*\d+$`)
+
+// Matches the temperature reports that OctoPrint polls for with M105 (eg. "ok T:210.0 /210.0 B:60.0 /60.0"), or that the printer sends by itself
+var temperatureReport = regexp.MustCompile(`(?i)^(ok\s+)?(T\d*|B):\s*-?\d`)
+
+// Starts the marker that is echoed with M118 after each command
+const octoPrintMarkerPrefix = "mesh-levelling-"
+
+// octoPrintTransport sends gcode with OctoPrint's REST API, and reads the response from the terminal log that OctoPrint pushes over its websocket.
+type octoPrintTransport struct {
+	client *http.Client
+	url    string
+	apiKey string
+	ws     *websocket.Conn
+	// Lines of the terminal log that have been received but not looked at yet
+	logs []string
+	// Makes the marker sent after each command unique
+	markerID int64
+}
+
+// DialOctoPrint connects to OctoPrint at the URL, eg. http://octopi.lan.
+func DialOctoPrint(url, apiKey string) (Transport, error) {
+	transport := octoPrintTransport{
+		client: &http.Client{Timeout: ResponseTimeout},
+		url:    strings.TrimSuffix(url, "/"),
+		apiKey: apiKey,
+		// Markers from an earlier connection may still be in the log
+		markerID: time.Now().UnixNano(),
+	}
+	// The websocket is authenticated with a session from a passive login, which doesn't set a cookie
+	var login struct {
+		Name    string `json:"name"`
+		Session string `json:"session"`
+	}
+	if err := transport.post("/api/login", map[string]bool{"passive": true}, &login); err != nil {
+		return nil, fmt.Errorf("could not log in to OctoPrint: %w", err)
+	}
+	// http:// becomes ws:// and https:// becomes wss://
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(transport.url, "http")+"/sockjs/websocket", "", transport.url)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to OctoPrint's websocket: %w", err)
+	}
+	if err := websocket.JSON.Send(ws, map[string]string{"auth": login.Name + ":" + login.Session}); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	transport.ws = ws
+	return &transport, nil
+}
+
+// post sends a request to the REST API and decodes the response into result, unless it is nil.
+func (transport *octoPrintTransport) post(path string, body any, result any) error {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, transport.url+path, bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Api-Key", transport.apiKey)
+	response, err := transport.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("OctoPrint replied %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// isSent returns whether a line of the terminal log is OctoPrint sending the gcode to the printer.
+func isSent(logLine, gcode string) bool {
+	sent, ok := strings.CutPrefix(logLine, "Send: ")
+	if !ok {
+		return false
+	}
+	if match := octoPrintLineNumber.FindStringSubmatch(sent); match != nil {
+		sent = match[1]
+	}
+	return strings.EqualFold(strings.TrimSpace(sent), gcode)
+}
+
+// Exec sends the gcode followed by "M118 <marker>", and reads the terminal log until the printer echoes the marker.
+// The log has replies to other commands in it (eg. OctoPrint's M105 polls), so the marker shows where the response ends, rather than the first "ok".
+func (transport *octoPrintTransport) Exec(gcode string, timeout time.Duration) ([]string, error) {
+	transport.markerID++
+	marker := fmt.Sprintf("%s%d", octoPrintMarkerPrefix, transport.markerID)
+	markerCommand := "M118 " + marker
+	// Anything logged before the command was sent isn't its response
+	transport.logs = nil
+	if err := transport.post("/api/printer/command", map[string][]string{"commands": {gcode, markerCommand}}, nil); err != nil {
+		return nil, fmt.Errorf("could not send %q: %w", gcode, err)
+	}
+
+	var data, errorMessages []string
+	// Whether OctoPrint has sent the command, the printer has replied "ok" to it, and OctoPrint has sent the marker
+	sent, acknowledged, markerSent := false, false, false
+	// OctoPrint pushes updates regularly even when the printer is silent, so the deadline is only moved when the printer replies
+	deadline := time.Now().Add(timeout)
+	for {
+		for len(transport.logs) > 0 {
+			logLine := transport.logs[0]
+			transport.logs = transport.logs[1:]
+			if !sent {
+				sent = isSent(logLine, gcode)
+				continue
+			}
+			if !markerSent && isSent(logLine, markerCommand) {
+				markerSent = true
+				continue
+			}
+			if strings.HasPrefix(logLine, "Send: ") && strings.Contains(logLine, "M118 "+octoPrintMarkerPrefix) && !markerSent {
+				// The marker of an earlier command that timed out, which was the same as this one, so everything so far was its response
+				sent, acknowledged = false, false
+				data, errorMessages = nil, nil
+				continue
+			}
+			received, ok := strings.CutPrefix(logLine, "Recv: ")
+			if !ok || temperatureReport.MatchString(strings.TrimSpace(received)) {
+				continue
+			}
+			deadline = time.Now().Add(timeout)
+			done := strings.Contains(received, marker)
+			if !done {
+				kind, value := parseResponseLine(received)
+				switch {
+				case kind == responseOk && acknowledged:
+					// The "ok" to the marker, from firmware that doesn't echo M118
+					done = markerSent
+				case kind == responseOk:
+					acknowledged = true
+				case acknowledged:
+					// Anything else after the "ok" is the response to the marker (eg. if M118 is an unknown command)
+				case kind == responseError:
+					errorMessages = append(errorMessages, value)
+				case kind == responseData && value != "":
+					data = append(data, value)
+				}
+			}
+			if done {
+				if len(errorMessages) > 0 {
+					return nil, &CommandError{gcode, errorMessages}
+				}
+				return data, nil
+			}
+		}
+
+		if err := transport.ws.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		var message struct {
+			Current *struct {
+				Logs []string `json:"logs"`
+			} `json:"current"`
+		}
+		if err := websocket.JSON.Receive(transport.ws, &message); isTimeout(err) {
+			if len(errorMessages) > 0 {
+				return nil, &CommandError{gcode, errorMessages}
+			}
+			return nil, &TimeoutError{gcode, sent, timeout}
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read the response to %q: %w", gcode, err)
+		}
+		if message.Current != nil {
+			transport.logs = append(transport.logs, message.Current.Logs...)
+		}
+	}
+}
+
+func (transport *octoPrintTransport) Close() error {
+	transport.client.CloseIdleConnections()
+	return transport.ws.Close()
+}
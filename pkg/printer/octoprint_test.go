@@ -0,0 +1,209 @@
+package printer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// fakeOctoPrint accepts commands with the REST API and pushes the terminal log over the websocket like OctoPrint.
+type fakeOctoPrint struct {
+	// Returns the lines logged when OctoPrint sends the command, and then the marker command
+	respond func(command, markerCommand string) []string
+	logs    chan []string
+	mutex   sync.Mutex
+	// The lines that OctoPrint sent, and the next line number
+	sent       []string
+	lineNumber int
+}
+
+func newFakeOctoPrint(respond func(command, markerCommand string) []string) *httptest.Server {
+	octoPrint := &fakeOctoPrint{respond: respond, logs: make(chan []string, 10)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/login", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("X-Api-Key") != "secret" {
+			http.Error(writer, "Forbidden", http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(writer).Encode(map[string]string{"name": "_api", "session": "session"})
+	})
+	mux.HandleFunc("/api/printer/command", func(writer http.ResponseWriter, request *http.Request) {
+		var body struct {
+			Commands []string `json:"commands"`
+		}
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil || len(body.Commands) != 2 {
+			http.Error(writer, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+		if logs := octoPrint.respond(body.Commands[0], body.Commands[1]); len(logs) > 0 {
+			octoPrint.logs <- logs
+		}
+	})
+	mux.Handle("/sockjs/websocket", websocket.Handler(func(ws *websocket.Conn) {
+		var auth map[string]string
+		if err := websocket.JSON.Receive(ws, &auth); err != nil || auth["auth"] != "_api:session" {
+			return
+		}
+		// OctoPrint pushes the state regularly, even when nothing has been logged
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			var logs []string
+			select {
+			case logs = <-octoPrint.logs:
+			case <-ticker.C:
+			}
+			if err := websocket.JSON.Send(ws, map[string]any{"current": map[string]any{"logs": logs}}); err != nil {
+				return
+			}
+		}
+	}))
+	return httptest.NewServer(mux)
+}
+
+// octoPrintSend logs sending a line to the printer with a line number and checksum, like OctoPrint.
+func octoPrintSend(lineNumber int, line string) string {
+	numberedLine := fmt.Sprintf("N%d %s", lineNumber, line)
+	var checksum byte
+	for i := 0; i < len(numberedLine); i++ {
+		checksum ^= numberedLine[i]
+	}
+	return fmt.Sprintf("Send: %s*%d", numberedLine, checksum)
+}
+
+// octoPrintExchange logs the printer replying to the command and then echoing the marker.
+func octoPrintExchange(lineNumber int, command, markerCommand string, replies ...string) []string {
+	logs := []string{octoPrintSend(lineNumber, command)}
+	for _, reply := range replies {
+		logs = append(logs, "Recv: "+reply)
+	}
+	return append(logs, octoPrintSend(lineNumber+1, markerCommand), "Recv: "+strings.TrimPrefix(markerCommand, "M118 "), "Recv: ok")
+}
+
+func TestOctoPrintTransport(t *testing.T) {
+	lineNumber := 0
+	var lateLogs []string
+	server := newFakeOctoPrint(func(command, markerCommand string) []string {
+		lineNumber += 2
+		switch command {
+		case "G1 X10 Y20":
+			// OctoPrint polls the temperature between commands
+			return append([]string{"Send: M105", "Recv: ok T:210.0 /210.0 B:60.0 /60.0"}, octoPrintExchange(lineNumber, command, markerCommand, "ok")...)
+		case "M114":
+			// A temperature report can be logged after the command is sent, before the printer replies
+			logs := append(lateLogs, octoPrintExchange(lineNumber, command, markerCommand, "ok T:210.0 /210.0 B:60.0 /60.0", "X:10.00 Y:20.00 Z:5.00 E:0.00 Count X:800 Y:1600 Z:2000", "ok")...)
+			lateLogs = nil
+			return logs
+		case "M400":
+			// Times out, and is logged along with the response to the next command
+			lateLogs = octoPrintExchange(lineNumber, command, markerCommand, "ok")
+			return nil
+		case "G999":
+			return octoPrintExchange(lineNumber, command, markerCommand, `echo:Unknown command: "G999"`, "ok")
+		case "M17":
+			// Firmware without M118 only replies "ok" to the marker
+			return []string{octoPrintSend(lineNumber, command), "Recv: ok", octoPrintSend(lineNumber+1, markerCommand), "Recv: ok"}
+		case "M84":
+			// Firmware that doesn't know M118 rejects it
+			return []string{octoPrintSend(lineNumber, command), "Recv: ok", octoPrintSend(lineNumber+1, markerCommand), `Recv: echo:Unknown command: "M118"`, "Recv: ok"}
+		}
+		return nil
+	})
+	defer server.Close()
+	transport, err := DialOctoPrint(server.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	if data, err := transport.Exec("G1 X10 Y20", time.Second); err != nil || len(data) != 0 {
+		t.Errorf("Exec(G1) = %q, %v, want no data", data, err)
+	}
+	if data, err := transport.Exec("M114", time.Second); err != nil || !slices.Equal(data, []string{"X:10.00 Y:20.00 Z:5.00 E:0.00 Count X:800 Y:1600 Z:2000"}) {
+		t.Errorf("Exec(M114) = %q, %v, want the position", data, err)
+	}
+
+	var commandErr *CommandError
+	if _, err := transport.Exec("G999", time.Second); !errors.As(err, &commandErr) || !slices.Equal(commandErr.Messages, []string{`Unknown command: "G999"`}) {
+		t.Errorf("Exec(G999) returned %v, want a CommandError", err)
+	}
+	for _, command := range []string{"M17", "M84"} {
+		if data, err := transport.Exec(command, time.Second); err != nil || len(data) != 0 {
+			t.Errorf("Exec(%s) without M118 = %q, %v, want no data", command, data, err)
+		}
+	}
+
+	// The regular pushes of the state don't stop the command from timing out
+	var timeoutErr *TimeoutError
+	if _, err := transport.Exec("M400", 50*time.Millisecond); !errors.As(err, &timeoutErr) || timeoutErr.Acknowledged {
+		t.Errorf("Exec(M400) returned %v, want a TimeoutError", err)
+	}
+	if data, err := transport.Exec("M114", time.Second); err != nil || !slices.Equal(data, []string{"X:10.00 Y:20.00 Z:5.00 E:0.00 Count X:800 Y:1600 Z:2000"}) {
+		t.Errorf("Exec(M114) after a timeout = %q, %v, want only its own response", data, err)
+	}
+}
+
+func TestOctoPrintTransportStaleResponse(t *testing.T) {
+	// The same command times out and is sent again, so its late response must be told apart by the marker
+	lineNumber := 0
+	var lateLogs []string
+	server := newFakeOctoPrint(func(command, markerCommand string) []string {
+		lineNumber += 2
+		if lateLogs == nil {
+			lateLogs = octoPrintExchange(lineNumber, command, markerCommand, "X:0.00 Y:0.00 Z:0.00 E:0.00", "ok")
+			return nil
+		}
+		return append(lateLogs, octoPrintExchange(lineNumber, command, markerCommand, "X:10.00 Y:20.00 Z:5.00 E:0.00", "ok")...)
+	})
+	defer server.Close()
+	transport, err := DialOctoPrint(server.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	if _, err := transport.Exec("M114", 50*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Exec(M114) returned %v, want a TimeoutError", err)
+	}
+	if data, err := transport.Exec("M114", time.Second); err != nil || !slices.Equal(data, []string{"X:10.00 Y:20.00 Z:5.00 E:0.00"}) {
+		t.Errorf("Exec(M114) = %q, %v, want only the latest response", data, err)
+	}
+}
+
+func TestDialOctoPrintWrongAPIKey(t *testing.T) {
+	server := newFakeOctoPrint(func(command, markerCommand string) []string { return nil })
+	defer server.Close()
+	if _, err := DialOctoPrint(server.URL, "wrong"); err == nil || !strings.Contains(err.Error(), "403 Forbidden") {
+		t.Errorf("DialOctoPrint with the wrong API key returned %v, want it to fail with the status", err)
+	}
+}
+
+func TestIsSent(t *testing.T) {
+	tests := []struct {
+		logLine, gcode string
+		want           bool
+	}{
+		{"Send: G28", "G28", true},
+		{"Send: N12 G28*18", "G28", true},
+		{"Send: N13 M118 mesh-levelling-5*99", "M118 mesh-levelling-5", true},
+		{"Send: N13 M118 mesh-levelling-5*99", "M118 mesh-levelling-50", false},
+		{"Send: g1 x10", "G1 X10", true},
+		{"Recv: G28", "G28", false},
+		{"Send: M105", "G28", false},
+	}
+	for _, test := range tests {
+		if sent := isSent(test.logLine, test.gcode); sent != test.want {
+			t.Errorf("isSent(%q, %q) = %v, want %v", test.logLine, test.gcode, sent, test.want)
+		}
+	}
+}
@@ -3,81 +3,174 @@ package printer
 import (
 	"fmt"
 	"math"
-	"net"
+	"mesh-levelling/pkg/profile"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	MovementTimeMultiplier = 1.5
+	// How long the printer may be silent while we wait for the response to a command
+	ResponseTimeout = 100 * time.Second
+	// How long a move may take to finish
+	MotionTimeout = 2 * time.Minute
+	// How often the position is polled when waiting for a move to finish with M114
+	PositionPollInterval = 50 * time.Millisecond
+	// How far in mm the printer may report that it is from where it was moved to, as M114 rounds the position
+	PositionTolerance = 0.01
 )
 
-type Printer struct {
-	conn       net.Conn
-	lastKnownX float64
-	lastKnownY float64
-	lastKnownZ float64
+// Position is where the printer reports that the nozzle is.
+type Position struct {
+	X, Y, Z float64
 }
 
-func NewPrinter(address string) (*Printer, error) {
-	conn, err := net.Dial("tcp", address)
+func (position Position) String() string {
+	return fmt.Sprintf("X%.3f Y%.3f Z%.3f", position.X, position.Y, position.Z)
+}
+
+// Printer moves the nozzle of a printer around.
+type Printer interface {
+	// StartingPosition moves to the centre of the bed, well above it
+	StartingPosition() error
+	// MoveXY moves the nozzle and waits for it to get there, returning where the printer reports that it is.
+	MoveXY(x, y, speed float64) (Position, error)
+	// MoveZ moves the nozzle and waits for it to get there, returning where the printer reports that it is.
+	MoveZ(z, speed float64) (Position, error)
+	// Position asks the printer where the nozzle is.
+	Position() (Position, error)
+	Close() error
+}
+
+// gcodePrinter is a Printer that is controlled with gcode sent over a Transport.
+type gcodePrinter struct {
+	transport Transport
+	profile   *profile.Profile
+}
+
+// NewPrinter connects to the printer with the profile's protocol.
+func NewPrinter(profile *profile.Profile) (Printer, error) {
+	transport, err := Dial(profile)
 	if err != nil {
 		return nil, err
 	}
-	return &Printer{conn, 0, 0, 100}, nil
+	return New(transport, profile), nil
 }
 
-func (printer *Printer) StartingPosition() error {
-	if err := printer.execGcode("G90"); err != nil { // Set to absolute positioning
-		return err
-	}
-	if err := printer.execGcode("G1 E0 F2000 X0 Y0 Z100"); err != nil { // Go to 0, 0, 100
+// New creates a Printer that sends gcode over the transport.
+func New(transport Transport, profile *profile.Profile) Printer {
+	return &gcodePrinter{transport, profile}
+}
+
+func (printer *gcodePrinter) StartingPosition() error {
+	if _, err := printer.execGcode("G90"); err != nil { // Set to absolute positioning
 		return err
 	}
-	time.Sleep(5 * time.Second)
-	return nil
+	x, y := printer.profile.BedCentre()
+	// Go to the centre of the bed, well above it
+	_, err := printer.move(fmt.Sprintf("G1 E0 F2000 X%.3f Y%.3f Z%.3f", x, y, printer.profile.SafeZ), x, y, printer.profile.SafeZ)
+	return err
+}
+
+func (printer *gcodePrinter) MoveXY(x, y, speed float64) (Position, error) {
+	return printer.move(fmt.Sprintf("G1 E0 F%.0f X%.3f Y%.3f", speed*60, x, y), x, y, math.NaN())
 }
 
-func (printer *Printer) MoveXY(x, y, speed float64) (time.Duration, error) {
-	command := fmt.Sprintf("G1 E0 F%.0f X%.3f Y%.3f", speed*60, x, y)
-	if err := printer.execGcode(command); err != nil {
-		return 0, err
+func (printer *gcodePrinter) MoveZ(z, speed float64) (Position, error) {
+	if z < printer.profile.MinimumZ {
+		return Position{}, fmt.Errorf("Z%.3f is below the minimum safe Z%.3f", z, printer.profile.MinimumZ)
 	}
-	distance := math.Sqrt(math.Pow(math.Abs(printer.lastKnownX-x), 2) + math.Pow(math.Abs(printer.lastKnownY-y), 2))
-	movementDuration := time.Duration(distance/speed*1000*MovementTimeMultiplier) * time.Millisecond
-	printer.lastKnownX = x
-	printer.lastKnownY = y
-	return movementDuration, nil
+	return printer.move(fmt.Sprintf("G1 E0 F%.0f Z%.3f", speed*60, z), math.NaN(), math.NaN(), z)
 }
 
-func (printer *Printer) MoveZ(z, speed float64) (time.Duration, error) {
-	if z < 50 {
-		panic("Z too low")
+// Position asks the printer where the nozzle is with M114.
+func (printer *gcodePrinter) Position() (Position, error) {
+	lines, err := printer.execGcode("M114")
+	if err != nil {
+		return Position{}, err
 	}
-	command := fmt.Sprintf("G1 E0 F%.0f Z%.3f", speed*60, z)
-	if err := printer.execGcode(command); err != nil {
-		return 0, err
+	for _, line := range lines {
+		if position, ok := parsePosition(line); ok {
+			return position, nil
+		}
 	}
-	movementDuration := time.Duration(math.Abs(printer.lastKnownZ-z)/speed*1000*MovementTimeMultiplier) * time.Millisecond
-	printer.lastKnownZ = z
-	return movementDuration, nil
+	return Position{}, fmt.Errorf("no position in the response to M114: %q", lines)
 }
 
-func (printer *Printer) Close() error {
-	return printer.conn.Close()
+// parsePosition parses a position reported by M114, eg. "X:10.00 Y:20.00 Z:30.00 E:0.00 Count X:800 Y:1600 Z:12000" (Marlin) or "X:10 Y:20 Z:30 A:0 B:0" (FlashForge).
+func parsePosition(line string) (Position, bool) {
+	// Marlin follows the position with the stepper counts, which use the same letters
+	line, _, _ = strings.Cut(line, "Count")
+	values := make(map[string]float64)
+	for _, field := range strings.Fields(line) {
+		axis, value, ok := strings.Cut(field, ":")
+		if !ok {
+			continue
+		}
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			values[strings.ToUpper(axis)] = number
+		}
+	}
+	x, hasX := values["X"]
+	y, hasY := values["Y"]
+	z, hasZ := values["Z"]
+	return Position{x, y, z}, hasX && hasY && hasZ
 }
 
-func (printer *Printer) execGcode(gcode string) error {
-	if _, err := printer.conn.Write([]byte("~" + gcode + "\r\n")); err != nil {
-		return err
+// move sends a move and waits for it to finish, returning where the printer reports that it is.
+// The target of any axis that isn't NaN is checked against the reported position.
+func (printer *gcodePrinter) move(gcode string, x, y, z float64) (Position, error) {
+	if _, err := printer.execGcode(gcode); err != nil {
+		return Position{}, err
 	}
-	if err := printer.conn.SetReadDeadline(time.Now().Add(100 * time.Second)); err != nil {
-		return err
+	isAt := func(position Position) bool {
+		isNear := func(reported, target float64) bool {
+			return math.IsNaN(target) || math.Abs(reported-target) <= PositionTolerance
+		}
+		return isNear(position.X, x) && isNear(position.Y, y) && isNear(position.Z, z)
 	}
-	buffer := make([]byte, 1024)
-	if _, err := printer.conn.Read(buffer); err != nil {
-		return err
-	} else {
-		// TODO check response
-		return nil
+
+	if printer.profile.MotionWait == profile.MotionWaitM114 {
+		// The position changes while the printer is moving, so it has finished when it is at the target and has stopped
+		deadline := time.Now().Add(MotionTimeout)
+		var lastPosition Position
+		for i := 0; time.Now().Before(deadline); i++ {
+			position, err := printer.Position()
+			if err != nil {
+				return Position{}, err
+			}
+			if i > 0 && position == lastPosition && isAt(position) {
+				return position, nil
+			}
+			lastPosition = position
+			time.Sleep(PositionPollInterval)
+		}
+		return Position{}, &TimeoutError{gcode, true, MotionTimeout}
+	}
+
+	if _, err := printer.execGcodeWithTimeout("M400", MotionTimeout); err != nil {
+		return Position{}, err
+	}
+	position, err := printer.Position()
+	if err != nil {
+		return Position{}, err
 	}
+	if !isAt(position) {
+		return Position{}, fmt.Errorf("printer is at %s after %q", position, gcode)
+	}
+	return position, nil
+}
+
+func (printer *gcodePrinter) Close() error {
+	return printer.transport.Close()
+}
+
+// execGcode sends a command and waits for the printer to accept it, returning any lines that it replied with other than "ok".
+func (printer *gcodePrinter) execGcode(gcode string) ([]string, error) {
+	return printer.transport.Exec(gcode, ResponseTimeout)
+}
+
+// execGcodeWithTimeout is execGcode for commands that the printer may take longer than ResponseTimeout to respond to.
+func (printer *gcodePrinter) execGcodeWithTimeout(gcode string, timeout time.Duration) ([]string, error) {
+	return printer.transport.Exec(gcode, timeout)
 }
@@ -0,0 +1,88 @@
+package printer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrTimeout is wrapped by every TimeoutError, so timeouts can be found with errors.Is.
+var ErrTimeout = errors.New("timed out waiting for the printer")
+
+// TimeoutError is returned when the printer doesn't respond to a command in time.
+type TimeoutError struct {
+	Command string
+	// Whether the printer had acknowledged the command, in which case it is probably still running it rather than having lost it
+	Acknowledged bool
+	Timeout      time.Duration
+}
+
+func (err *TimeoutError) Error() string {
+	if err.Acknowledged {
+		return fmt.Sprintf("printer acknowledged %q but didn't finish it within %s", err.Command, err.Timeout)
+	}
+	return fmt.Sprintf("printer didn't respond to %q within %s", err.Command, err.Timeout)
+}
+
+func (err *TimeoutError) Unwrap() error {
+	return ErrTimeout
+}
+
+// CommandError is returned when the printer replies to a command with an error.
+type CommandError struct {
+	Command string
+	// The error lines from the printer, eg. "Unknown command: "G999""
+	Messages []string
+}
+
+func (err *CommandError) Error() string {
+	return fmt.Sprintf("printer rejected %q: %s", err.Command, strings.Join(err.Messages, "; "))
+}
+
+type responseKind int
+
+const (
+	// Anything that isn't one of the others, eg. the position from M114
+	responseData responseKind = iota
+	// FlashForge printers acknowledge every command with "CMD G1 Received."
+	responseReceived
+	// The command has been accepted (and for M400, finished)
+	responseOk
+	responseError
+)
+
+// parseResponseLine works out what a line from the printer is, and returns the interesting part of it.
+// FlashForge printers reply with "CMD <code> Received." followed by any data and "ok".
+// Marlin-style firmware replies with any data and "ok", with errors as "Error:...", "echo:Unknown command..." or "Resend: <line>", and Klipper's errors start with "!!".
+func parseResponseLine(line string) (responseKind, string) {
+	line = strings.TrimSpace(line)
+	lowerLine := strings.ToLower(line)
+	switch {
+	case strings.HasPrefix(line, "CMD ") && strings.HasSuffix(line, " Received."):
+		return responseReceived, strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "CMD "), " Received."))
+	case lowerLine == "ok" || strings.HasPrefix(lowerLine, "ok "):
+		return responseOk, strings.TrimSpace(line[2:])
+	case strings.HasPrefix(lowerLine, "error:"):
+		return responseError, strings.TrimSpace(line[len("error:"):])
+	case strings.HasPrefix(line, "!!"):
+		return responseError, strings.TrimSpace(line[2:])
+	case strings.HasPrefix(lowerLine, "echo:unknown command"):
+		return responseError, strings.TrimSpace(line[len("echo:"):])
+	case strings.HasPrefix(lowerLine, "resend:"):
+		return responseError, line
+	case lowerLine == "control failed.":
+		return responseError, line
+	default:
+		return responseData, line
+	}
+}
+
+// commandCode returns the code of a line of gcode as the printer echoes it, eg. "G1" for "G1 X10 Y10".
+func commandCode(gcode string) string {
+	fields := strings.Fields(gcode)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
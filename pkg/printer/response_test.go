@@ -0,0 +1,103 @@
+package printer
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseResponseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		kind responseKind
+		text string
+	}{
+		{"ok", responseOk, ""},
+		{"OK\r", responseOk, ""},
+		{"ok N12 P15 B3", responseOk, "N12 P15 B3"},
+		{"ok T:210.0 /210.0 B:60.0 /60.0", responseOk, "T:210.0 /210.0 B:60.0 /60.0"},
+		{"okay", responseData, "okay"},
+		{"CMD M114 Received.", responseReceived, "M114"},
+		{"CMD G1 Received.", responseReceived, "G1"},
+		{"Error:Printer halted. kill() called!", responseError, "Printer halted. kill() called!"},
+		{"error: Unknown command", responseError, "Unknown command"},
+		{"!! Move out of range: 300.000 0.000 0.200 [0.000]", responseError, "Move out of range: 300.000 0.000 0.200 [0.000]"},
+		{"echo:Unknown command: \"G999\"", responseError, "Unknown command: \"G999\""},
+		{"Resend: 12", responseError, "Resend: 12"},
+		{"Control failed.", responseError, "Control failed."},
+		{"Control Success.", responseData, "Control Success."},
+		{"echo:busy: processing", responseData, "echo:busy: processing"},
+		{"echo:busy: paused for user", responseData, "echo:busy: paused for user"},
+		{"// Klipper state: Ready", responseData, "// Klipper state: Ready"},
+		{"X:10.00 Y:20.00 Z:0.20 E:0.00 Count X:800 Y:1600 Z:80", responseData, "X:10.00 Y:20.00 Z:0.20 E:0.00 Count X:800 Y:1600 Z:80"},
+		{"  X:10 Y:20 Z:0.2 A:0 B:0  ", responseData, "X:10 Y:20 Z:0.2 A:0 B:0"},
+		{"", responseData, ""},
+	}
+	for _, test := range tests {
+		kind, text := parseResponseLine(test.line)
+		if kind != test.kind || text != test.text {
+			t.Errorf("parseResponseLine(%q) = %d, %q, want %d, %q", test.line, kind, text, test.kind, test.text)
+		}
+	}
+}
+
+func TestCommandCode(t *testing.T) {
+	tests := map[string]string{
+		"G1 X10 Y10": "G1",
+		"  m114":     "M114",
+		"M400":       "M400",
+		"":           "",
+	}
+	for gcode, want := range tests {
+		if code := commandCode(gcode); code != want {
+			t.Errorf("commandCode(%q) = %q, want %q", gcode, code, want)
+		}
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	tests := []struct {
+		err  *TimeoutError
+		want string
+	}{
+		{&TimeoutError{Command: "M400", Timeout: 2 * time.Minute}, `printer didn't respond to "M400" within 2m0s`},
+		{&TimeoutError{Command: "G28", Acknowledged: true, Timeout: 100 * time.Second}, `printer acknowledged "G28" but didn't finish it within 1m40s`},
+	}
+	for _, test := range tests {
+		if message := test.err.Error(); message != test.want {
+			t.Errorf("Error() = %q, want %q", message, test.want)
+		}
+		wrapped := fmt.Errorf("moving: %w", test.err)
+		if !errors.Is(wrapped, ErrTimeout) {
+			t.Errorf("%v is not ErrTimeout", wrapped)
+		}
+		var timeoutErr *TimeoutError
+		if !errors.As(wrapped, &timeoutErr) || timeoutErr != test.err {
+			t.Errorf("%v is not a TimeoutError", wrapped)
+		}
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	tests := []struct {
+		err  *CommandError
+		want string
+	}{
+		{&CommandError{Command: "G999", Messages: []string{`Unknown command: "G999"`}}, `printer rejected "G999": Unknown command: "G999"`},
+		{&CommandError{Command: "G1 X300", Messages: []string{"Move out of range", "Must home axis first"}}, `printer rejected "G1 X300": Move out of range; Must home axis first`},
+	}
+	for _, test := range tests {
+		if message := test.err.Error(); message != test.want {
+			t.Errorf("Error() = %q, want %q", message, test.want)
+		}
+		wrapped := fmt.Errorf("probing: %w", test.err)
+		var commandErr *CommandError
+		if !errors.As(wrapped, &commandErr) || commandErr != test.err {
+			t.Errorf("%v is not a CommandError", wrapped)
+		}
+		if errors.Is(wrapped, ErrTimeout) {
+			t.Errorf("%v is ErrTimeout", wrapped)
+		}
+	}
+}
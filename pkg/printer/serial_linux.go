@@ -0,0 +1,63 @@
+package printer
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var baudRates = map[int]uint32{
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	38400:  unix.B38400,
+	57600:  unix.B57600,
+	115200: unix.B115200,
+	230400: unix.B230400,
+	460800: unix.B460800,
+	500000: unix.B500000,
+	921600: unix.B921600,
+}
+
+// openSerialPort opens a serial port in raw mode, 8N1.
+func openSerialPort(port string, baudRate int) (connection, error) {
+	speed, ok := baudRates[baudRate]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate: %d", baudRate)
+	}
+	// Opening it non-blocking lets Go's poller handle it, so that deadlines work
+	file, err := os.OpenFile(port, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	var termiosErr error
+	err = rawConn.Control(func(fd uintptr) {
+		var termios *unix.Termios
+		if termios, termiosErr = unix.IoctlGetTermios(int(fd), unix.TCGETS); termiosErr != nil {
+			return
+		}
+		termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF
+		termios.Oflag &^= unix.OPOST
+		termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		termios.Cflag &^= unix.CSIZE | unix.PARENB | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+		termios.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | speed
+		termios.Ispeed = speed
+		termios.Ospeed = speed
+		termios.Cc[unix.VMIN] = 1
+		termios.Cc[unix.VTIME] = 0
+		termiosErr = unix.IoctlSetTermios(int(fd), unix.TCSETS, termios)
+	})
+	if err == nil {
+		err = termiosErr
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
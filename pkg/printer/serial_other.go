@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+
+package printer
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func openSerialPort(port string, baudRate int) (connection, error) {
+	return nil, fmt.Errorf("serial ports aren't supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,143 @@
+package printer
+
+import (
+	"math"
+	"os"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	kernel32         = windows.NewLazySystemDLL("kernel32.dll")
+	procGetCommState = kernel32.NewProc("GetCommState")
+	procSetCommState = kernel32.NewProc("SetCommState")
+)
+
+// dcb is the Windows DCB structure that configures a serial port.
+type dcb struct {
+	DCBlength  uint32
+	BaudRate   uint32
+	Flags      uint32
+	wReserved  uint16
+	XonLim     uint16
+	XoffLim    uint16
+	ByteSize   byte
+	Parity     byte
+	StopBits   byte
+	XonChar    byte
+	XoffChar   byte
+	ErrorChar  byte
+	EofChar    byte
+	EvtChar    byte
+	wReserved1 uint16
+}
+
+const (
+	// fBinary, as Windows doesn't support anything else
+	dcbBinary = 0x1
+	// fDtrControl = DTR_CONTROL_ENABLE
+	dcbDtrControlEnable = 0x10
+	// fRtsControl = RTS_CONTROL_ENABLE
+	dcbRtsControlEnable = 0x1000
+	noParity            = 0
+	oneStopBit          = 0
+)
+
+// serialPort is a Windows serial port. Windows doesn't support deadlines on them, so they are implemented with the port's timeouts.
+type serialPort struct {
+	handle   windows.Handle
+	timeouts windows.CommTimeouts
+}
+
+// openSerialPort opens a serial port, 8N1.
+func openSerialPort(port string, baudRate int) (connection, error) {
+	// COM10 and above can only be opened with this prefix
+	if !strings.HasPrefix(port, `\\.\`) {
+		port = `\\.\` + port
+	}
+	name, err := windows.UTF16PtrFromString(port)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	state := dcb{DCBlength: uint32(unsafe.Sizeof(dcb{}))}
+	if result, _, err := procGetCommState.Call(uintptr(handle), uintptr(unsafe.Pointer(&state))); result == 0 {
+		windows.CloseHandle(handle)
+		return nil, err
+	}
+	state.BaudRate = uint32(baudRate)
+	state.Flags = dcbBinary | dcbDtrControlEnable | dcbRtsControlEnable
+	state.ByteSize = 8
+	state.Parity = noParity
+	state.StopBits = oneStopBit
+	if result, _, err := procSetCommState.Call(uintptr(handle), uintptr(unsafe.Pointer(&state))); result == 0 {
+		windows.CloseHandle(handle)
+		return nil, err
+	}
+
+	serialPort := serialPort{handle: handle}
+	// Reads return as soon as there is anything to read, or after ReadTotalTimeoutConstant with nothing
+	serialPort.timeouts.ReadIntervalTimeout = math.MaxUint32
+	serialPort.timeouts.ReadTotalTimeoutMultiplier = math.MaxUint32
+	serialPort.timeouts.ReadTotalTimeoutConstant = math.MaxUint32 - 1
+	if err := windows.SetCommTimeouts(handle, &serialPort.timeouts); err != nil {
+		windows.CloseHandle(handle)
+		return nil, err
+	}
+	return &serialPort, nil
+}
+
+func (port *serialPort) Read(buffer []byte) (int, error) {
+	var n uint32
+	if err := windows.ReadFile(port.handle, buffer, &n, nil); err != nil {
+		return 0, err
+	}
+	if n == 0 && len(buffer) > 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return int(n), nil
+}
+
+func (port *serialPort) Write(buffer []byte) (int, error) {
+	var n uint32
+	if err := windows.WriteFile(port.handle, buffer, &n, nil); err != nil {
+		return int(n), err
+	}
+	if int(n) < len(buffer) {
+		return int(n), os.ErrDeadlineExceeded
+	}
+	return int(n), nil
+}
+
+// timeoutUntil returns the time until the deadline in ms, which is 0 (no timeout) for a zero deadline.
+func timeoutUntil(deadline time.Time) uint32 {
+	if deadline.IsZero() {
+		return 0
+	}
+	return uint32(max(1, min(math.MaxUint32-1, time.Until(deadline).Milliseconds())))
+}
+
+func (port *serialPort) SetReadDeadline(deadline time.Time) error {
+	if deadline.IsZero() {
+		port.timeouts.ReadTotalTimeoutConstant = math.MaxUint32 - 1
+	} else {
+		port.timeouts.ReadTotalTimeoutConstant = timeoutUntil(deadline)
+	}
+	return windows.SetCommTimeouts(port.handle, &port.timeouts)
+}
+
+func (port *serialPort) SetWriteDeadline(deadline time.Time) error {
+	port.timeouts.WriteTotalTimeoutConstant = timeoutUntil(deadline)
+	return windows.SetCommTimeouts(port.handle, &port.timeouts)
+}
+
+func (port *serialPort) Close() error {
+	return windows.CloseHandle(port.handle)
+}
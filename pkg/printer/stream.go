@@ -0,0 +1,165 @@
+package printer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// How long sending a command may take
+	WriteTimeout = 10 * time.Second
+	// Marlin restarts when its serial port is opened, and prints its settings as it starts
+	serialStartupTimeout = 10 * time.Second
+	// The printer has started once it has been silent for this long
+	serialStartupSilence = 2 * time.Second
+)
+
+// connection is a stream to the printer that supports deadlines, like net.Conn and *os.File.
+type connection interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// streamTransport sends one line of gcode at a time over a stream and reads the response line by line.
+type streamTransport struct {
+	conn   connection
+	reader *bufio.Reader
+	// Put before each command, as FlashForge printers need it
+	prefix     string
+	lineEnding string
+	// The number of commands that timed out, whose late responses must be skipped before the response to the next command
+	pendingResponses int
+}
+
+// DialFlashForge connects to a FlashForge printer's TCP port, which is usually 8899.
+func DialFlashForge(address string) (Transport, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamTransport(conn, "~", "\r\n"), nil
+}
+
+// OpenSerial opens the serial port of a Marlin printer.
+func OpenSerial(port string, baudRate int) (Transport, error) {
+	conn, err := openSerialPort(port, baudRate)
+	if err != nil {
+		return nil, fmt.Errorf("could not open serial port %s: %w", port, err)
+	}
+	transport := newStreamTransport(conn, "", "\n")
+	if err := transport.waitForStartup(); err != nil {
+		return nil, errors.Join(err, conn.Close())
+	}
+	return transport, nil
+}
+
+func newStreamTransport(conn connection, prefix, lineEnding string) *streamTransport {
+	return &streamTransport{
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		prefix:     prefix,
+		lineEnding: lineEnding,
+	}
+}
+
+// setReadDeadline is conn.SetReadDeadline, apart from streams that don't support deadlines, which are read without one.
+func (transport *streamTransport) setReadDeadline(deadline time.Time) error {
+	if err := transport.conn.SetReadDeadline(deadline); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+		return err
+	}
+	return nil
+}
+
+// waitForStartup skips everything that the printer prints when it starts, so that it isn't mistaken for the response to the first command.
+func (transport *streamTransport) waitForStartup() error {
+	deadline := time.Now().Add(serialStartupTimeout)
+	for time.Now().Before(deadline) {
+		if err := transport.setReadDeadline(time.Now().Add(serialStartupSilence)); err != nil {
+			return err
+		}
+		line, err := transport.reader.ReadString('\n')
+		if isTimeout(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		log.Println("Printer:", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (transport *streamTransport) Exec(gcode string, timeout time.Duration) ([]string, error) {
+	if err := transport.conn.SetWriteDeadline(time.Now().Add(WriteTimeout)); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+		return nil, err
+	}
+	if _, err := transport.conn.Write([]byte(transport.prefix + gcode + transport.lineEnding)); err != nil {
+		return nil, fmt.Errorf("could not send %q: %w", gcode, err)
+	}
+
+	code := commandCode(gcode)
+	var data, errorMessages []string
+	// Whether the lines being read are the response to an earlier command that timed out
+	stale := transport.pendingResponses > 0
+	acknowledged := false
+	for {
+		if err := transport.setReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		line, err := transport.reader.ReadString('\n')
+		if isTimeout(err) {
+			if len(errorMessages) > 0 {
+				// Some firmware doesn't send "ok" after an error
+				return nil, &CommandError{gcode, errorMessages}
+			}
+			transport.pendingResponses++
+			return nil, &TimeoutError{gcode, acknowledged, timeout}
+		} else if err != nil {
+			return nil, fmt.Errorf("could not read the response to %q: %w", gcode, err)
+		}
+
+		kind, value := parseResponseLine(line)
+		switch kind {
+		case responseReceived:
+			// A late acknowledgement of an earlier command means that the lines up to its "ok" aren't ours
+			stale = value != code || (stale && transport.pendingResponses > 0)
+			acknowledged = acknowledged || !stale
+		case responseOk:
+			if stale {
+				if transport.pendingResponses > 0 {
+					transport.pendingResponses--
+				}
+				stale = transport.pendingResponses > 0
+				continue
+			}
+			if len(errorMessages) > 0 {
+				return nil, &CommandError{gcode, errorMessages}
+			}
+			return data, nil
+		case responseError:
+			if !stale {
+				errorMessages = append(errorMessages, value)
+			}
+		case responseData:
+			if !stale && value != "" {
+				data = append(data, value)
+			}
+		}
+	}
+}
+
+func (transport *streamTransport) Close() error {
+	return transport.conn.Close()
+}
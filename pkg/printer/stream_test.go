@@ -0,0 +1,147 @@
+package printer
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveStream accepts a connection on a loopback port and calls respond with each command received, which replies by writing to conn.
+// It returns the address to connect to.
+func serveStream(t *testing.T, prefix string, respond func(command string, conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			respond(strings.TrimPrefix(strings.TrimRight(scanner.Text(), "\r"), prefix), conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// flashForgeReply replies to a command like a FlashForge printer.
+func flashForgeReply(conn net.Conn, command string, lines ...string) {
+	reply := "CMD " + commandCode(command) + " Received.\r\n"
+	for _, line := range lines {
+		reply += line + "\r\n"
+	}
+	_, _ = conn.Write([]byte(reply))
+}
+
+func TestFlashForgeTransport(t *testing.T) {
+	address := serveStream(t, "~", func(command string, conn net.Conn) {
+		switch command {
+		case "G1 X10 Y10":
+			flashForgeReply(conn, command, "ok")
+		case "M114":
+			flashForgeReply(conn, command, "X:10 Y:10 Z:5 A:0 B:0", "ok")
+		case "G999":
+			flashForgeReply(conn, command, "Error: unknown command", "ok")
+		case "M400":
+			// Acknowledged straight away, but finishes after the command has timed out
+			flashForgeReply(conn, command)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				_, _ = conn.Write([]byte("ok\r\n"))
+			}()
+		case "M119":
+			// Finishes after the command has timed out, so the response arrives before the response to the next command
+			go func() {
+				time.Sleep(150 * time.Millisecond)
+				flashForgeReply(conn, command, "Endstop: X-max:1 Y-max:1 Z-min:0", "ok")
+			}()
+		case "M115":
+			time.Sleep(200 * time.Millisecond)
+			flashForgeReply(conn, command, "Machine Type: Adventurer 3", "ok")
+		}
+	})
+	transport, err := DialFlashForge(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	if data, err := transport.Exec("G1 X10 Y10", time.Second); err != nil || len(data) != 0 {
+		t.Errorf("Exec(G1) = %q, %v, want no data", data, err)
+	}
+	if data, err := transport.Exec("M114", time.Second); err != nil || !slices.Equal(data, []string{"X:10 Y:10 Z:5 A:0 B:0"}) {
+		t.Errorf("Exec(M114) = %q, %v, want the position", data, err)
+	}
+
+	var commandErr *CommandError
+	if _, err := transport.Exec("G999", time.Second); !errors.As(err, &commandErr) || !slices.Equal(commandErr.Messages, []string{"unknown command"}) {
+		t.Errorf("Exec(G999) returned %v, want a CommandError", err)
+	}
+
+	var timeoutErr *TimeoutError
+	if _, err := transport.Exec("M400", 50*time.Millisecond); !errors.As(err, &timeoutErr) || !timeoutErr.Acknowledged {
+		t.Errorf("Exec(M400) returned %v, want an acknowledged TimeoutError", err)
+	}
+	if _, err := transport.Exec("M119", 50*time.Millisecond); !errors.As(err, &timeoutErr) || timeoutErr.Acknowledged {
+		t.Errorf("Exec(M119) returned %v, want an unacknowledged TimeoutError", err)
+	}
+	// The late responses to M400 and M119 must not be mistaken for the response to M115
+	if data, err := transport.Exec("M115", time.Second); err != nil || !slices.Equal(data, []string{"Machine Type: Adventurer 3"}) {
+		t.Errorf("Exec(M115) = %q, %v, want only its own response", data, err)
+	}
+}
+
+func TestSerialTransport(t *testing.T) {
+	// Marlin doesn't acknowledge commands before replying, so the late response to a command can only be told apart by counting "ok"s
+	address := serveStream(t, "", func(command string, conn net.Conn) {
+		var reply string
+		switch command {
+		case "G28":
+			reply = "echo:busy: processing\nok\n"
+		case "M114":
+			reply = "X:10.00 Y:20.00 Z:5.00 E:0.00 Count X:800 Y:1600 Z:2000\nok\n"
+		case "G999":
+			reply = "echo:Unknown command: \"G999\"\nok\n"
+		case "G1 X1000":
+			// Klipper doesn't always send "ok" after an error
+			reply = "!! Move out of range: 1000.000 0.000 5.000 [0.000]\n"
+		case "M400":
+			time.Sleep(150 * time.Millisecond)
+			reply = "ok\n"
+		}
+		_, _ = conn.Write([]byte(reply))
+	})
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := newStreamTransport(conn, "", "\n")
+	defer transport.Close()
+
+	if data, err := transport.Exec("G28", time.Second); err != nil || !slices.Equal(data, []string{"echo:busy: processing"}) {
+		t.Errorf("Exec(G28) = %q, %v", data, err)
+	}
+	var commandErr *CommandError
+	if _, err := transport.Exec("G999", time.Second); !errors.As(err, &commandErr) || !slices.Equal(commandErr.Messages, []string{`Unknown command: "G999"`}) {
+		t.Errorf("Exec(G999) returned %v, want a CommandError", err)
+	}
+	if _, err := transport.Exec("G1 X1000", 50*time.Millisecond); !errors.As(err, &commandErr) || !slices.Equal(commandErr.Messages, []string{"Move out of range: 1000.000 0.000 5.000 [0.000]"}) {
+		t.Errorf("Exec(G1 X1000) returned %v, want a CommandError", err)
+	}
+	if _, err := transport.Exec("M400", 50*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Exec(M400) returned %v, want a TimeoutError", err)
+	}
+	// The "ok" to M400 arrives first, and must be skipped
+	if data, err := transport.Exec("M114", time.Second); err != nil || !slices.Equal(data, []string{"X:10.00 Y:20.00 Z:5.00 E:0.00 Count X:800 Y:1600 Z:2000"}) {
+		t.Errorf("Exec(M114) = %q, %v, want only its own response", data, err)
+	}
+}
@@ -0,0 +1,32 @@
+package printer
+
+import (
+	"fmt"
+	"mesh-levelling/pkg/profile"
+	"time"
+)
+
+// Transport sends gcode to a printer.
+type Transport interface {
+	// Exec sends a line of gcode and waits for the printer to accept it, returning any lines that it replied with other than "ok".
+	// The printer may be silent for up to timeout before a TimeoutError is returned.
+	// If the printer replies with an error, a CommandError is returned.
+	Exec(gcode string, timeout time.Duration) ([]string, error)
+	Close() error
+}
+
+// Dial connects to the printer with the profile's protocol.
+func Dial(printerProfile *profile.Profile) (Transport, error) {
+	switch printerProfile.PrinterProtocol {
+	case "", profile.PrinterProtocolFlashForge:
+		return DialFlashForge(printerProfile.PrinterAddress)
+	case profile.PrinterProtocolSerial:
+		return OpenSerial(printerProfile.PrinterAddress, printerProfile.PrinterBaudRate)
+	case profile.PrinterProtocolMoonraker:
+		return NewMoonraker(printerProfile.PrinterAddress, printerProfile.PrinterAPIKey), nil
+	case profile.PrinterProtocolOctoPrint:
+		return DialOctoPrint(printerProfile.PrinterAddress, printerProfile.PrinterAPIKey)
+	default:
+		return nil, fmt.Errorf("unknown printer protocol: %s", printerProfile.PrinterProtocol)
+	}
+}
@@ -0,0 +1,164 @@
+package probing
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mesh-levelling/pkg/bltouch"
+	"mesh-levelling/pkg/mesh"
+	"mesh-levelling/pkg/printer"
+	"mesh-levelling/pkg/profile"
+	"mesh-levelling/pkg/session"
+	"slices"
+	"time"
+)
+
+// Grid returns the grid to probe for the profile, or if gcodeFilename isn't empty, the grid over the area that the gcode prints on.
+// The grid is clipped to where the probe can reach, and the points are where the probe touches, which is where the nozzle will be when printing there.
+func Grid(printerProfile *profile.Profile, gcodeFilename string) (mesh.ProbeGridParameters, error) {
+	grid := printerProfile.ProbeGrid()
+	if gcodeFilename != "" {
+		printArea, err := mesh.PrintBoundsOfFile(gcodeFilename)
+		if err != nil {
+			return mesh.ProbeGridParameters{}, fmt.Errorf("could not find the print area of %s: %w", gcodeFilename, err)
+		}
+		log.Printf("%s prints from X%.3f Y%.3f to X%.3f Y%.3f\n", gcodeFilename, printArea.MinX, printArea.MinY, printArea.MaxX, printArea.MaxY)
+		if grid, err = printerProfile.PrintAreaGrid(printArea); err != nil {
+			return mesh.ProbeGridParameters{}, fmt.Errorf("could not probe the print area: %w", err)
+		}
+	}
+
+	switch grid.Layout {
+	case "", mesh.ProbeLayoutGrid:
+		log.Printf("Probing a %dx%d grid from X%.3f Y%.3f to X%.3f Y%.3f (probe offset X%.3f Y%.3f)\n", grid.NumberOfPointsX, grid.NumberOfPointsY, grid.MinX, grid.MinY, grid.MaxX, grid.MaxY, printerProfile.ProbeOffsetX, printerProfile.ProbeOffsetY)
+	case mesh.ProbeLayoutCircular:
+		log.Printf("Probing %d rings around X%.3f Y%.3f with a radius of %.3f (probe offset X%.3f Y%.3f)\n", grid.NumberOfRings, grid.CentreX, grid.CentreY, grid.Radius, printerProfile.ProbeOffsetX, printerProfile.ProbeOffsetY)
+	case mesh.ProbeLayoutPoints:
+		if skipped := len(printerProfile.ProbePoints) - len(grid.Points); skipped > 0 {
+			log.Printf("Skipping %d points that the probe can't reach (probe offset X%.3f Y%.3f)\n", skipped, printerProfile.ProbeOffsetX, printerProfile.ProbeOffsetY)
+		}
+	}
+	log.Printf("%d points to probe\n", len(grid.Positions()))
+	return grid, nil
+}
+
+// LoadSession loads the interrupted session in filename so that it can be resumed.
+// It returns nil if there is no session to resume, or if restart is set, in which case a new session should be started.
+func LoadSession(filename string, grid mesh.ProbeGridParameters, restart bool) (*session.Session, error) {
+	if restart {
+		return nil, nil
+	}
+	probingSession, err := session.Load(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load the probing session %s: %w", filename, err)
+	}
+	if !slices.Equal(probingSession.ProbeGrid.Positions(), grid.Positions()) {
+		return nil, fmt.Errorf("%s is an interrupted session for a different probe grid", filename)
+	}
+	log.Printf("Resuming the session from %s, %d points have already been probed\n", probingSession.StartDate.Format(time.DateTime), len(probingSession.Points))
+	return probingSession, nil
+}
+
+// ProbeMesh probes the grid of the session and returns the mesh, saving each point to the session as it is probed.
+// Points that were probed before the session was interrupted aren't probed again.
+// If adaptive is set, points are then added where they improve the mesh the most, up to the profile's RefinementPointBudget.
+// The printer must already be at its starting position.
+func ProbeMesh(printer printer.Printer, bltouch *bltouch.BLTouch, printerProfile *profile.Profile, probingSession *session.Session, adaptive bool) (*mesh.Mesh, error) {
+	positions := probingSession.ProbeGrid.Positions()
+	meshPoints := make([]mesh.Point, 0, len(positions))
+	var averageZ float64
+
+	probe := func(position mesh.Position) (mesh.Point, error) {
+		log.Println("X:", position.X, "Y:", position.Y)
+		meshPoint, ok := probingSession.Point(position.X, position.Y)
+		if ok {
+			log.Printf("Z: %.3f (already probed)\n", meshPoint.Z)
+			return meshPoint, nil
+		}
+		meshPoint, err := bltouch.ProbePoint(printer, position.X, position.Y)
+		if err != nil {
+			return mesh.Point{}, err
+		}
+		if len(meshPoint.Samples) > 1 {
+			log.Printf("Z: %.3f (%s)\n", meshPoint.Z, mesh.CalculateSampleStatistics(meshPoint.Samples))
+		}
+		if err := probingSession.AddPoint(meshPoint); err != nil {
+			return mesh.Point{}, fmt.Errorf("could not save the probing session: %w", err)
+		}
+		return meshPoint, nil
+	}
+	for i, position := range positions {
+		meshPoint, err := probe(position)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("%.1f%%\r\n", float64(i+1)/float64(len(positions))*100.0)
+		meshPoints = append(meshPoints, meshPoint)
+		averageZ += meshPoint.Z
+	}
+	// The points added by adaptive probing aren't included in averageZ, as they are concentrated where the bed is most uneven
+	averageZ /= float64(len(positions))
+
+	if adaptive {
+		// Resume adaptive probing where it was interrupted
+		for _, meshPoint := range probingSession.Points {
+			if !slices.Contains(positions, mesh.Position{X: meshPoint.X, Y: meshPoint.Y}) {
+				meshPoints = append(meshPoints, meshPoint)
+			}
+		}
+		for len(meshPoints) < printerProfile.RefinementPointBudget {
+			candidates := printerProfile.RefinementCandidates(meshPoints)
+			if len(candidates) == 0 {
+				log.Println("Adaptive probing finished, there is nowhere left to probe")
+				break
+			}
+			position, improvement, err := mesh.ChooseRefinementPoint(meshPoints, candidates, printerProfile.RefinementCriterion)
+			if err != nil {
+				return nil, err
+			}
+			if improvement < printerProfile.RefinementTolerance {
+				log.Printf("Adaptive probing finished, the largest estimated improvement is %.3fmm\n", improvement)
+				break
+			}
+			log.Printf("Adaptive probing %d of %d (estimated improvement %.3fmm)\n", len(meshPoints)+1, printerProfile.RefinementPointBudget, improvement)
+			meshPoint, err := probe(position)
+			if err != nil {
+				return nil, err
+			}
+			meshPoints = append(meshPoints, meshPoint)
+		}
+	}
+
+	return &mesh.Mesh{
+		Metadata: mesh.Metadata{
+			PrinterName:    printerProfile.Name,
+			ProbeDate:      time.Now(),
+			ProbeGrid:      probingSession.ProbeGrid,
+			BedTemperature: probingSession.BedTemperature,
+			ProbeOffsetX:   printerProfile.ProbeOffsetX,
+			ProbeOffsetY:   printerProfile.ProbeOffsetY,
+		},
+		BLTouchHeight: averageZ,
+		Points:        meshPoints,
+		Materials:     make(map[string]mesh.MaterialProfile),
+		FadeHeight:    mesh.DefaultFadeHeight,
+	}, nil
+}
+
+// MeasureRepeatability probes a point repeatedly, like M48, and returns how consistent the probe is.
+func MeasureRepeatability(printer printer.Printer, bltouch *bltouch.BLTouch, x, y float64, repeats int) (mesh.SampleStatistics, error) {
+	log.Printf("Probing X%.3f Y%.3f %d times\n", x, y, repeats)
+	samples := make([]float64, 0, repeats)
+	for i := 0; i < repeats; i++ {
+		z, err := bltouch.GetZAtPoint(printer, x, y)
+		if err != nil {
+			return mesh.SampleStatistics{}, err
+		}
+		samples = append(samples, z)
+		log.Printf("%d of %d: Z%.3f\n", i+1, repeats, z)
+	}
+	return mesh.CalculateSampleStatistics(samples), nil
+}
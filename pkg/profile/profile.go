@@ -0,0 +1,424 @@
+package profile
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mesh-levelling/pkg/mesh"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DefaultFilename is the name of the printer profile that is used if no other profile is given.
+const DefaultFilename = "printer.json"
+
+// Origin is where X0 Y0 is on the bed.
+type Origin string
+
+const (
+	OriginCentre Origin = "centre"
+	// The front left corner of the bed
+	OriginCorner Origin = "corner"
+)
+
+// MotionWait is how we find out that the printer has finished moving.
+type MotionWait string
+
+const (
+	// M400 waits for moves to finish before replying, which Marlin and Klipper support
+	MotionWaitM400 MotionWait = "m400"
+	// Poll the position with M114 until the printer gets there, for printers without M400
+	MotionWaitM114 MotionWait = "m114"
+)
+
+// PrinterProtocol is how we talk to the printer.
+type PrinterProtocol string
+
+const (
+	// FlashForge's gcode over TCP, where PrinterAddress is host:port
+	PrinterProtocolFlashForge PrinterProtocol = "flashforge"
+	// Marlin's gcode over a USB serial port, where PrinterAddress is the port, eg. COM3 or /dev/ttyUSB0
+	PrinterProtocolSerial PrinterProtocol = "serial"
+	// Moonraker's JSON-RPC API for Klipper, where PrinterAddress is its URL, eg. http://printer.lan:7125
+	PrinterProtocolMoonraker PrinterProtocol = "moonraker"
+	// OctoPrint's REST API, where PrinterAddress is its URL, eg. http://octopi.lan
+	PrinterProtocolOctoPrint PrinterProtocol = "octoprint"
+)
+
+// Profile describes the printer and probe that meshes are created with.
+type Profile struct {
+	// Saved in the metadata of meshes
+	Name string
+	// The size of the bed in mm
+	BedWidth float64
+	BedDepth float64
+	Origin   Origin
+
+	// Probing starts from this Z, so it shouldn't be much above the highest point of the bed
+	ProbeStartZ float64
+	// Never move below this Z, as it could crush the probe
+	MinimumZ float64
+	// The Z to move to before probing starts, which must be clear of everything
+	SafeZ float64
+	// Number of mm per Z step when probing (resolution)
+	ZStep float64
+	// Number of mm per Z step when first finding the bed, before probing it again with ZStep. 0 only probes with ZStep.
+	FastZStep float64
+	// After finding the bed with FastZStep, probing with ZStep starts this many mm above the last step that didn't touch
+	ProbeBackOff float64
+
+	// The position of the probe relative to the nozzle, eg. ProbeOffsetX is positive if the probe is to the right of the nozzle
+	ProbeOffsetX float64
+	ProbeOffsetY float64
+
+	// How the probed points are arranged. Empty means grid.
+	ProbeLayout mesh.ProbeLayout
+	// The distance in mm from the edges of the bed to the outermost probed points of grid and circular layouts
+	ProbeMargin float64
+	// The size of a grid layout
+	NumberOfPointsX uint8
+	NumberOfPointsY uint8
+	// The radius of a circular layout. 0 means as big as possible.
+	ProbeRadius   float64
+	NumberOfRings uint8
+	// The points of a points layout, which are read from ProbePointsFile if it is set.
+	// Relative paths are relative to the profile.
+	ProbePoints     []mesh.Position
+	ProbePointsFile string
+	// Areas of the bed that aren't probed
+	ExclusionZones          []mesh.ExclusionZone
+	NumberOfRepeatsPerPoint uint8
+	// How the samples at each point are combined. Empty means mean.
+	Aggregation mesh.Aggregation
+	// If the samples at a point are spread over more than this many mm, the point is probed NumberOfRepeatsPerPoint more times. 0 disables re-probing.
+	MaximumSpread float64
+	// The maximum number of times that a point is re-probed
+	MaximumReprobes uint8
+
+	// Adaptive probing adds points to the probed layout where they improve the mesh the most, until there are RefinementPointBudget points
+	// or no point would improve the mesh by more than RefinementTolerance mm.
+	RefinementPointBudget int
+	RefinementTolerance   float64
+	// Empty means error
+	RefinementCriterion mesh.RefinementCriterion
+	// The spacing in mm of the positions that are considered for adaptive probing
+	RefinementSpacing float64
+
+	// When only the area of the bed that a print covers is probed, the area is grown by this many mm on every side
+	PrintAreaMargin float64
+
+	// In mm per second
+	SpeedXY    float64
+	SpeedZFast float64
+	SpeedZSlow float64
+	// Empty means m400
+	MotionWait MotionWait
+
+	// Empty means flashforge
+	PrinterProtocol PrinterProtocol
+	// See PrinterProtocol
+	PrinterAddress string
+	// For serial printers
+	PrinterBaudRate int
+	// For Moonraker (if it requires one) and OctoPrint
+	PrinterAPIKey string
+	// host:port
+	BLTouchAddress string
+}
+
+// Default returns the profile of the printer that this was originally written for.
+func Default() *Profile {
+	return &Profile{
+		Name:                    "HarryPrinter",
+		BedWidth:                150,
+		BedDepth:                150,
+		Origin:                  OriginCentre,
+		ProbeStartZ:             56,
+		MinimumZ:                50,
+		SafeZ:                   100,
+		ZStep:                   0.02,
+		FastZStep:               0.5,
+		ProbeBackOff:            0.1,
+		NumberOfPointsX:         7,
+		NumberOfPointsY:         7,
+		NumberOfRepeatsPerPoint: 1,
+		RefinementPointBudget:   100,
+		RefinementTolerance:     0.01,
+		RefinementCriterion:     mesh.RefinementError,
+		RefinementSpacing:       5,
+		PrintAreaMargin:         5,
+		SpeedXY:                 80,
+		SpeedZFast:              16,
+		SpeedZSlow:              1,
+		MotionWait:              MotionWaitM400,
+		PrinterProtocol:         PrinterProtocolFlashForge,
+		PrinterAddress:          "HarryPrinter:8899",
+		PrinterBaudRate:         115200,
+		BLTouchAddress:          "HarryUnoWifiRev2.lan:9988",
+	}
+}
+
+// Load loads a profile from a JSON file. Anything missing from the file is taken from Default.
+func Load(filename string) (*Profile, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	profile := Default()
+	if err := json.NewDecoder(file).Decode(profile); err != nil {
+		return nil, fmt.Errorf("invalid printer profile %s: %w", filename, err)
+	}
+	if profile.ProbePointsFile != "" {
+		if !filepath.IsAbs(profile.ProbePointsFile) {
+			profile.ProbePointsFile = filepath.Join(filepath.Dir(filename), profile.ProbePointsFile)
+		}
+		if profile.ProbePoints, err = LoadProbePoints(profile.ProbePointsFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid printer profile %s: %w", filename, err)
+	}
+	return profile, nil
+}
+
+// LoadProbePoints reads a file of points to probe, with one "X,Y" or "X Y" per line. Lines starting with # are ignored.
+func LoadProbePoints(filename string) ([]mesh.Position, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var points []mesh.Position
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected X,Y but got %q", filename, lineNumber, line)
+		}
+		x, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", filename, lineNumber, err)
+		}
+		y, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", filename, lineNumber, err)
+		}
+		points = append(points, mesh.Position{X: x, Y: y})
+	}
+	return points, scanner.Err()
+}
+
+// Validate checks that the profile is safe to probe with.
+func (profile *Profile) Validate() error {
+	var errs []error
+	if profile.BedWidth <= 0 || profile.BedDepth <= 0 {
+		errs = append(errs, fmt.Errorf("invalid bed size: %f x %f", profile.BedWidth, profile.BedDepth))
+	}
+	switch profile.Origin {
+	case OriginCentre, OriginCorner:
+	default:
+		errs = append(errs, fmt.Errorf("unknown origin: %s", profile.Origin))
+	}
+	if profile.MinimumZ >= profile.ProbeStartZ || profile.ProbeStartZ > profile.SafeZ {
+		errs = append(errs, fmt.Errorf("Z limits must be in the order minimum (%f) < probe start (%f) <= safe (%f)", profile.MinimumZ, profile.ProbeStartZ, profile.SafeZ))
+	}
+	if profile.ZStep <= 0 {
+		errs = append(errs, fmt.Errorf("invalid Z step: %f", profile.ZStep))
+	}
+	if profile.FastZStep < 0 || (profile.FastZStep > 0 && profile.FastZStep < profile.ZStep) {
+		errs = append(errs, fmt.Errorf("invalid fast Z step: %f, it must be 0 or at least the Z step", profile.FastZStep))
+	}
+	if profile.ProbeBackOff < 0 {
+		errs = append(errs, fmt.Errorf("invalid probe back off: %f", profile.ProbeBackOff))
+	}
+	if profile.ProbeMargin < 0 || 2*profile.ProbeMargin >= profile.BedWidth || 2*profile.ProbeMargin >= profile.BedDepth {
+		errs = append(errs, fmt.Errorf("invalid probe margin: %f", profile.ProbeMargin))
+	} else if err := profile.ProbeGrid().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("%w (with the probe offset X%.3f Y%.3f)", err, profile.ProbeOffsetX, profile.ProbeOffsetY))
+	}
+	if profile.NumberOfRepeatsPerPoint < 1 {
+		errs = append(errs, errors.New("there must be at least 1 repeat per point"))
+	}
+	switch profile.Aggregation {
+	case "", mesh.AggregationMean, mesh.AggregationMedian, mesh.AggregationTrimmedMean:
+	default:
+		errs = append(errs, fmt.Errorf("unknown aggregation: %s", profile.Aggregation))
+	}
+	if profile.MaximumSpread < 0 {
+		errs = append(errs, fmt.Errorf("invalid maximum spread: %f", profile.MaximumSpread))
+	}
+	if profile.RefinementPointBudget < 0 || profile.RefinementTolerance < 0 || profile.RefinementSpacing <= 0 {
+		errs = append(errs, fmt.Errorf("invalid adaptive probing settings: budget %d, tolerance %f, spacing %f", profile.RefinementPointBudget, profile.RefinementTolerance, profile.RefinementSpacing))
+	}
+	if profile.PrintAreaMargin < 0 {
+		errs = append(errs, fmt.Errorf("invalid print area margin: %f", profile.PrintAreaMargin))
+	}
+	switch profile.RefinementCriterion {
+	case "", mesh.RefinementError, mesh.RefinementGradient:
+	default:
+		errs = append(errs, fmt.Errorf("unknown refinement criterion: %s", profile.RefinementCriterion))
+	}
+	if profile.SpeedXY <= 0 || profile.SpeedZFast <= 0 || profile.SpeedZSlow <= 0 {
+		errs = append(errs, fmt.Errorf("invalid speeds: XY %f, Z fast %f, Z slow %f", profile.SpeedXY, profile.SpeedZFast, profile.SpeedZSlow))
+	}
+	switch profile.MotionWait {
+	case "", MotionWaitM400, MotionWaitM114:
+	default:
+		errs = append(errs, fmt.Errorf("unknown motion wait: %s", profile.MotionWait))
+	}
+	switch profile.PrinterProtocol {
+	case "", PrinterProtocolFlashForge, PrinterProtocolMoonraker:
+	case PrinterProtocolSerial:
+		if profile.PrinterBaudRate <= 0 {
+			errs = append(errs, fmt.Errorf("invalid printer baud rate: %d", profile.PrinterBaudRate))
+		}
+	case PrinterProtocolOctoPrint:
+		if profile.PrinterAPIKey == "" {
+			errs = append(errs, errors.New("OctoPrint needs an API key"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown printer protocol: %s", profile.PrinterProtocol))
+	}
+	if profile.PrinterAddress == "" {
+		errs = append(errs, errors.New("no printer address"))
+	}
+	if profile.BLTouchAddress == "" {
+		errs = append(errs, errors.New("no BLTouch address"))
+	}
+	return errors.Join(errs...)
+}
+
+// BedBounds returns the coordinates of the edges of the bed.
+func (profile *Profile) BedBounds() (minX, minY, maxX, maxY float64) {
+	if profile.Origin == OriginCorner {
+		return 0, 0, profile.BedWidth, profile.BedDepth
+	}
+	return -profile.BedWidth / 2, -profile.BedDepth / 2, profile.BedWidth / 2, profile.BedDepth / 2
+}
+
+// BedCentre returns the coordinates of the centre of the bed.
+func (profile *Profile) BedCentre() (x, y float64) {
+	minX, minY, maxX, maxY := profile.BedBounds()
+	return (minX + maxX) / 2, (minY + maxY) / 2
+}
+
+// NozzlePosition returns where the nozzle must be for the probe to be at the position.
+func (profile *Profile) NozzlePosition(x, y float64) (nozzleX, nozzleY float64) {
+	return x - profile.ProbeOffsetX, y - profile.ProbeOffsetY
+}
+
+// ProbeBounds returns the area of the bed that the probe can reach, as the nozzle can't leave the bed.
+func (profile *Profile) ProbeBounds() (minX, minY, maxX, maxY float64) {
+	minX, minY, maxX, maxY = profile.BedBounds()
+	return max(minX, minX+profile.ProbeOffsetX), max(minY, minY+profile.ProbeOffsetY), min(maxX, maxX+profile.ProbeOffsetX), min(maxY, maxY+profile.ProbeOffsetY)
+}
+
+// CanProbe returns whether the probe can reach the position.
+func (profile *Profile) CanProbe(x, y float64) bool {
+	minX, minY, maxX, maxY := profile.ProbeBounds()
+	return x >= minX && x <= maxX && y >= minY && y <= maxY
+}
+
+// probeArea returns the area that grid and circular layouts are inside of, which is the bed apart from the margin and anywhere the probe can't reach.
+func (profile *Profile) probeArea() (minX, minY, maxX, maxY float64) {
+	bedMinX, bedMinY, bedMaxX, bedMaxY := profile.BedBounds()
+	minX, minY, maxX, maxY = profile.ProbeBounds()
+	return max(minX, bedMinX+profile.ProbeMargin), max(minY, bedMinY+profile.ProbeMargin), min(maxX, bedMaxX-profile.ProbeMargin), min(maxY, bedMaxY-profile.ProbeMargin)
+}
+
+// ProbeGrid returns the points to probe, which cover the bed apart from the margin and anywhere the probe can't reach.
+// The points are where the probe touches the bed, not where the nozzle is.
+func (profile *Profile) ProbeGrid() mesh.ProbeGridParameters {
+	minX, minY, maxX, maxY := profile.probeArea()
+	grid := mesh.ProbeGridParameters{
+		Layout:                  profile.ProbeLayout,
+		ExclusionZones:          profile.ExclusionZones,
+		NumberOfRepeatsPerPoint: profile.NumberOfRepeatsPerPoint,
+	}
+	switch profile.ProbeLayout {
+	case "", mesh.ProbeLayoutGrid:
+		grid.MinX, grid.MinY, grid.MaxX, grid.MaxY = minX, minY, maxX, maxY
+		grid.NumberOfPointsX = profile.NumberOfPointsX
+		grid.NumberOfPointsY = profile.NumberOfPointsY
+	case mesh.ProbeLayoutCircular:
+		// Centred on the bed, but the largest circle is limited by where the probe can reach
+		grid.CentreX, grid.CentreY = profile.BedCentre()
+		grid.Radius = min(grid.CentreX-minX, maxX-grid.CentreX, grid.CentreY-minY, maxY-grid.CentreY)
+		if profile.ProbeRadius > 0 {
+			grid.Radius = min(grid.Radius, profile.ProbeRadius)
+		}
+		grid.NumberOfRings = profile.NumberOfRings
+	case mesh.ProbeLayoutPoints:
+		for _, point := range profile.ProbePoints {
+			if profile.CanProbe(point.X, point.Y) {
+				grid.Points = append(grid.Points, point)
+			}
+		}
+	}
+	return grid
+}
+
+// RefinementCandidates returns the positions that adaptive probing could add to the points, leaving out any that are excluded or that the probe can't reach.
+func (profile *Profile) RefinementCandidates(points []mesh.Point) []mesh.Position {
+	var candidates []mesh.Position
+outerLoop:
+	for _, candidate := range mesh.RefinementCandidates(points, profile.RefinementSpacing) {
+		for _, zone := range profile.ExclusionZones {
+			if zone.Contains(candidate.X, candidate.Y) {
+				continue outerLoop
+			}
+		}
+		if profile.CanProbe(candidate.X, candidate.Y) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// Like Klipper's adaptive meshes, a print area is probed with at least this many points along X and Y
+const minimumPrintAreaPoints = 3
+
+// PrintAreaGrid returns a grid that covers the print area plus PrintAreaMargin, with the points spaced like the profile's grid.
+// Whatever the profile's layout is, the print area is probed with a grid so that it is covered evenly.
+func (profile *Profile) PrintAreaGrid(area mesh.Bounds) (mesh.ProbeGridParameters, error) {
+	probeMinX, probeMinY, probeMaxX, probeMaxY := profile.probeArea()
+	area = area.Expand(profile.PrintAreaMargin)
+	grid := mesh.ProbeGridParameters{
+		Layout:                  mesh.ProbeLayoutGrid,
+		MinX:                    max(area.MinX, probeMinX),
+		MinY:                    max(area.MinY, probeMinY),
+		MaxX:                    min(area.MaxX, probeMaxX),
+		MaxY:                    min(area.MaxY, probeMaxY),
+		ExclusionZones:          profile.ExclusionZones,
+		NumberOfRepeatsPerPoint: profile.NumberOfRepeatsPerPoint,
+	}
+	if grid.MinX >= grid.MaxX || grid.MinY >= grid.MaxY {
+		return mesh.ProbeGridParameters{}, fmt.Errorf("the print area X%.3f Y%.3f to X%.3f Y%.3f is outside of where the probe can reach", area.MinX, area.MinY, area.MaxX, area.MaxY)
+	}
+
+	numberOfPoints := func(length, fullLength float64, fullNumberOfPoints uint8) uint8 {
+		spacing := profile.RefinementSpacing
+		if fullNumberOfPoints >= 2 {
+			spacing = fullLength / float64(fullNumberOfPoints-1)
+		}
+		return uint8(min(math.MaxUint8, max(minimumPrintAreaPoints, math.Ceil(length/spacing)+1)))
+	}
+	grid.NumberOfPointsX = numberOfPoints(grid.MaxX-grid.MinX, probeMaxX-probeMinX, profile.NumberOfPointsX)
+	grid.NumberOfPointsY = numberOfPoints(grid.MaxY-grid.MinY, probeMaxY-probeMinY, profile.NumberOfPointsY)
+	return grid, grid.Validate()
+}
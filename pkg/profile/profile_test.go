@@ -0,0 +1,174 @@
+package profile
+
+import (
+	"math"
+	"mesh-levelling/pkg/mesh"
+	"strings"
+	"testing"
+)
+
+func TestNozzlePosition(t *testing.T) {
+	tests := []struct {
+		name                       string
+		probeOffsetX, probeOffsetY float64
+		wantX, wantY               float64
+	}{
+		{"no offset", 0, 0, 10, 20},
+		// The probe is to the right of and behind the nozzle, so the nozzle is to the left of and in front of the position
+		{"positive offset", 30, 15, -20, 5},
+		{"negative offset", -30, -15, 40, 35},
+		{"mixed offset", 25, -40, -15, 60},
+	}
+	for _, test := range tests {
+		profile := Default()
+		profile.ProbeOffsetX, profile.ProbeOffsetY = test.probeOffsetX, test.probeOffsetY
+		if x, y := profile.NozzlePosition(10, 20); x != test.wantX || y != test.wantY {
+			t.Errorf("%s: NozzlePosition(10, 20) = X%v Y%v, want X%v Y%v", test.name, x, y, test.wantX, test.wantY)
+		}
+	}
+}
+
+func TestProbeBounds(t *testing.T) {
+	tests := []struct {
+		name                       string
+		origin                     Origin
+		probeOffsetX, probeOffsetY float64
+		want                       [4]float64
+	}{
+		{"no offset", OriginCentre, 0, 0, [4]float64{-75, -75, 75, 75}},
+		// The probe can't reach as far as the nozzle on the side that it is offset away from
+		{"positive offset", OriginCentre, 30, 15, [4]float64{-45, -60, 75, 75}},
+		{"negative offset", OriginCentre, -30, -15, [4]float64{-75, -75, 45, 60}},
+		{"mixed offset", OriginCentre, 25, -40, [4]float64{-50, -75, 75, 35}},
+		{"corner origin", OriginCorner, -30, 15, [4]float64{0, 15, 120, 150}},
+	}
+	for _, test := range tests {
+		profile := Default()
+		profile.Origin = test.origin
+		profile.ProbeOffsetX, profile.ProbeOffsetY = test.probeOffsetX, test.probeOffsetY
+		minX, minY, maxX, maxY := profile.ProbeBounds()
+		if got := [4]float64{minX, minY, maxX, maxY}; got != test.want {
+			t.Errorf("%s: ProbeBounds = %v, want %v", test.name, got, test.want)
+		}
+
+		// Wherever the probe can reach, the nozzle is still on the bed
+		bedMinX, bedMinY, bedMaxX, bedMaxY := profile.BedBounds()
+		for _, corner := range [][2]float64{{minX, minY}, {minX, maxY}, {maxX, minY}, {maxX, maxY}} {
+			if x, y := profile.NozzlePosition(corner[0], corner[1]); x < bedMinX || x > bedMaxX || y < bedMinY || y > bedMaxY {
+				t.Errorf("%s: probing X%v Y%v puts the nozzle off the bed at X%v Y%v", test.name, corner[0], corner[1], x, y)
+			}
+		}
+	}
+}
+
+func TestCanProbe(t *testing.T) {
+	profile := Default()
+	profile.ProbeOffsetX, profile.ProbeOffsetY = 30, -15
+	// The probe can reach X-45 to X75 and Y-75 to Y60
+	tests := []struct {
+		x, y float64
+		want bool
+	}{
+		{0, 0, true},
+		{-45, -75, true},
+		{75, 60, true},
+		{-45, 60, true},
+		{75, -75, true},
+		{-45.001, 0, false},
+		{75.001, 0, false},
+		{0, -75.001, false},
+		{0, 60.001, false},
+		// The nozzle could reach these, but the probe can't
+		{-60, 0, false},
+		{0, 70, false},
+	}
+	for _, test := range tests {
+		if got := profile.CanProbe(test.x, test.y); got != test.want {
+			t.Errorf("CanProbe(%v, %v) = %v, want %v", test.x, test.y, got, test.want)
+		}
+	}
+}
+
+func TestPrintAreaGrid(t *testing.T) {
+	profile := Default()
+	// The probe can reach X-45 to X75, and the profile's 7×7 grid is spaced 20mm along X and 25mm along Y
+	profile.ProbeOffsetX = 30
+	tests := []struct {
+		name string
+		area mesh.Bounds
+		want mesh.ProbeGridParameters
+	}{
+		{"in the middle", mesh.Bounds{MinX: -20, MinY: -50, MaxX: 20, MaxY: 50}, mesh.ProbeGridParameters{MinX: -25, MinY: -55, MaxX: 25, MaxY: 55, NumberOfPointsX: 4, NumberOfPointsY: 6}},
+		// The print is further right than the probe can reach, so the grid stops at the edge of what it can
+		{"clipped to the probe", mesh.Bounds{MinX: 60, MinY: -10, MaxX: 100, MaxY: 10}, mesh.ProbeGridParameters{MinX: 55, MinY: -15, MaxX: 75, MaxY: 15, NumberOfPointsX: 3, NumberOfPointsY: 3}},
+		{"clipped to the bed", mesh.Bounds{MinX: -60, MinY: 60, MaxX: 0, MaxY: 80}, mesh.ProbeGridParameters{MinX: -45, MinY: 55, MaxX: 5, MaxY: 75, NumberOfPointsX: 4, NumberOfPointsY: 3}},
+		{"bigger than the bed", mesh.Bounds{MinX: -100, MinY: -100, MaxX: 100, MaxY: 100}, mesh.ProbeGridParameters{MinX: -45, MinY: -75, MaxX: 75, MaxY: 75, NumberOfPointsX: 7, NumberOfPointsY: 7}},
+	}
+	for _, test := range tests {
+		grid, err := profile.PrintAreaGrid(test.area)
+		if err != nil {
+			t.Errorf("%s: PrintAreaGrid failed: %v", test.name, err)
+			continue
+		}
+		test.want.Layout = mesh.ProbeLayoutGrid
+		test.want.NumberOfRepeatsPerPoint = profile.NumberOfRepeatsPerPoint
+		if grid.MinX != test.want.MinX || grid.MinY != test.want.MinY || grid.MaxX != test.want.MaxX || grid.MaxY != test.want.MaxY ||
+			grid.NumberOfPointsX != test.want.NumberOfPointsX || grid.NumberOfPointsY != test.want.NumberOfPointsY || grid.Layout != test.want.Layout {
+			t.Errorf("%s: PrintAreaGrid = %+v, want %+v", test.name, grid, test.want)
+		}
+		for _, position := range grid.Positions() {
+			if !profile.CanProbe(position.X, position.Y) {
+				t.Errorf("%s: the probe can't reach X%v Y%v", test.name, position.X, position.Y)
+			}
+		}
+	}
+
+	// A print that is entirely outside of where the probe can reach can't be probed
+	if _, err := profile.PrintAreaGrid(mesh.Bounds{MinX: 80, MinY: -10, MaxX: 100, MaxY: 10}); err == nil || !strings.Contains(err.Error(), "outside of where the probe can reach") {
+		t.Errorf("PrintAreaGrid returned %v, want an error", err)
+	}
+}
+
+func TestMergePrintAreaGrid(t *testing.T) {
+	// This is what the creator does with -gcode: probe a grid over the print area, and merge it into the mesh of the whole bed
+	profile := Default()
+	profile.ProbeOffsetX = 30
+	height := func(x, y float64) float64 { return 0.001*x - 0.002*y }
+	bedMesh := &mesh.Mesh{Version: mesh.FormatVersion}
+	for _, position := range profile.ProbeGrid().Positions() {
+		bedMesh.Points = append(bedMesh.Points, mesh.Point{X: position.X, Y: position.Y, Z: height(position.X, position.Y)})
+	}
+
+	grid, err := profile.PrintAreaGrid(mesh.Bounds{MinX: 50, MinY: 40, MaxX: 100, MaxY: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The new session measured Z from a different reference, so every point is 3mm lower
+	var points []mesh.Point
+	for _, position := range grid.Positions() {
+		points = append(points, mesh.Point{X: position.X, Y: position.Y, Z: height(position.X, position.Y) - 3})
+	}
+	area := mesh.Bounds{MinX: grid.MinX, MinY: grid.MinY, MaxX: grid.MaxX, MaxY: grid.MaxY}
+	if err := bedMesh.MergePoints(points, area); err != nil {
+		t.Fatalf("MergePoints failed: %v", err)
+	}
+	if err := bedMesh.Validate(); err != nil {
+		t.Fatalf("the merged mesh is invalid: %v", err)
+	}
+
+	kept := 0
+	for _, point := range bedMesh.Points {
+		if !area.Contains(point.X, point.Y) {
+			kept++
+		}
+		if !profile.CanProbe(point.X, point.Y) {
+			t.Errorf("X%v Y%v is outside of where the probe can reach", point.X, point.Y)
+		}
+		if math.Abs(point.Z-height(point.X, point.Y)) > 1e-9 {
+			t.Errorf("X%v Y%v has Z%v after merging, want Z%v", point.X, point.Y, point.Z, height(point.X, point.Y))
+		}
+	}
+	if kept == 0 || kept+len(points) != len(bedMesh.Points) {
+		t.Errorf("the merged mesh has %d points, want the %d new points and the old points outside of the print area", len(bedMesh.Points), len(points))
+	}
+}
@@ -0,0 +1,97 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"mesh-levelling/pkg/mesh"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultFilename is where probing progress is saved if no other file is given.
+const DefaultFilename = "probing-session.json"
+
+// Session is the progress of probing a mesh, which is saved after every point so that probing can be resumed if it is interrupted.
+type Session struct {
+	ProbeGrid mesh.ProbeGridParameters
+	// In °C, 0 if unknown
+	BedTemperature float64
+	StartDate      time.Time
+	// The points that have been probed so far
+	Points []mesh.Point
+
+	filename string
+}
+
+// New creates a session that is saved to filename.
+func New(filename string, probeGrid mesh.ProbeGridParameters, bedTemperature float64) *Session {
+	return &Session{
+		ProbeGrid:      probeGrid,
+		BedTemperature: bedTemperature,
+		StartDate:      time.Now(),
+		filename:       filename,
+	}
+}
+
+// Load loads an interrupted session. The error wraps fs.ErrNotExist if there is no session to resume.
+func Load(filename string) (*Session, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var session Session
+	if err := json.NewDecoder(file).Decode(&session); err != nil {
+		return nil, err
+	}
+	session.filename = filename
+	return &session, nil
+}
+
+// Point returns the point that was probed at the position, if it has been probed.
+func (session *Session) Point(x, y float64) (mesh.Point, bool) {
+	for _, point := range session.Points {
+		if point.X == x && point.Y == y {
+			return point, true
+		}
+	}
+	return mesh.Point{}, false
+}
+
+// AddPoint records a probed point and saves the session.
+func (session *Session) AddPoint(point mesh.Point) error {
+	session.Points = append(session.Points, point)
+	return session.save()
+}
+
+// save writes the session to a temporary file first, so that a crash while saving doesn't lose the previous progress.
+func (session *Session) save() error {
+	file, err := os.CreateTemp(filepath.Dir(session.filename), filepath.Base(session.filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err := json.NewEncoder(file).Encode(session); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), session.filename)
+}
+
+// Finish deletes the saved session once probing is complete.
+func (session *Session) Finish() error {
+	if err := os.Remove(session.filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package simulator
+
+// Bed is the surface of a simulated bed, as the Z of the nozzle when the probe touches it.
+type Bed struct {
+	// The Z at the centre
+	Height           float64
+	CentreX, CentreY float64
+	// The slope of the bed in mm per mm
+	TiltX, TiltY float64
+	// How much higher the bed is at WarpRadius from the centre than at the centre, so positive is a bowl and negative is a dome
+	Warp       float64
+	WarpRadius float64
+	// The standard deviation in mm of where the probe triggers
+	Noise float64
+}
+
+// HeightAt returns the Z of the bed at the position, without noise.
+func (bed Bed) HeightAt(x, y float64) float64 {
+	dx, dy := x-bed.CentreX, y-bed.CentreY
+	z := bed.Height + bed.TiltX*dx + bed.TiltY*dy
+	if bed.WarpRadius > 0 {
+		z += bed.Warp * (dx*dx + dy*dy) / (bed.WarpRadius * bed.WarpRadius)
+	}
+	return z
+}
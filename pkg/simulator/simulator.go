@@ -0,0 +1,211 @@
+package simulator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"mesh-levelling/pkg/gcode"
+	"mesh-levelling/pkg/profile"
+	"net"
+	"strings"
+	"sync"
+)
+
+// The nozzle is this far above the bed when the probe triggers, as the probe's pin reaches below the nozzle
+const nozzleClearance = 2
+
+// Simulator is a virtual printer with a BLTouch, which serves the FlashForge gcode protocol and the BLTouch sensor's protocol.
+// Moves are instant.
+type Simulator struct {
+	bed          Bed
+	probeOffsetX float64
+	probeOffsetY float64
+	random       *rand.Rand
+
+	mutex    sync.Mutex
+	x, y, z  float64
+	relative bool
+	extended bool
+	touched  bool
+	// How far above (or below) the bed the probe triggers this time it is extended
+	triggerNoise float64
+	// The number of times the nozzle has hit the bed
+	crashes int
+}
+
+// New creates a simulator of the printer in the profile, which starts with the nozzle above the centre of the bed.
+// The seed makes the noise repeatable.
+func New(bed Bed, printerProfile *profile.Profile, seed int64) *Simulator {
+	x, y := printerProfile.BedCentre()
+	return &Simulator{
+		bed:          bed,
+		probeOffsetX: printerProfile.ProbeOffsetX,
+		probeOffsetY: printerProfile.ProbeOffsetY,
+		random:       rand.New(rand.NewSource(seed)),
+		x:            x,
+		y:            y,
+		z:            printerProfile.SafeZ,
+	}
+}
+
+// Position returns where the nozzle is.
+func (simulator *Simulator) Position() (x, y, z float64) {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	return simulator.x, simulator.y, simulator.z
+}
+
+// Crashes returns the number of moves that have put the nozzle into the bed.
+func (simulator *Simulator) Crashes() int {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+	return simulator.crashes
+}
+
+// Exec runs a line of gcode and returns the lines of its response, other than "ok".
+func (simulator *Simulator) Exec(line string) ([]string, error) {
+	command, err := gcode.Parse(line)
+	if err != nil {
+		return nil, err
+	}
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+
+	switch {
+	case command.IsEmpty():
+	case command.Is('G', 0), command.Is('G', 1):
+		x, y, z := simulator.x, simulator.y, simulator.z
+		for letter, position := range map[byte]*float64{'X': &x, 'Y': &y, 'Z': &z} {
+			if value, ok := command.Param(letter); ok {
+				if simulator.relative {
+					*position += value
+				} else {
+					*position = value
+				}
+			}
+		}
+		simulator.moveTo(x, y, z)
+	case command.Is('G', 28):
+		// The simulated printer is always homed
+	case command.Is('G', 90):
+		simulator.relative = false
+	case command.Is('G', 91):
+		simulator.relative = true
+	case command.Is('M', 114):
+		return []string{fmt.Sprintf("X:%.3f Y:%.3f Z:%.3f A:0 B:0", simulator.x, simulator.y, simulator.z)}, nil
+	case command.Is('M', 400):
+		// Moves are instant, so they have already finished
+	case command.Is('M', 601), command.Is('M', 602):
+		// FlashForge's control commands
+		return []string{"Control Success."}, nil
+	default:
+		return nil, fmt.Errorf("unknown command: %s", command.Code())
+	}
+	return nil, nil
+}
+
+// moveTo moves the nozzle, triggering the probe if it reaches the bed.
+func (simulator *Simulator) moveTo(x, y, z float64) {
+	simulator.x, simulator.y, simulator.z = x, y, z
+	if z < simulator.bed.HeightAt(x, y)-nozzleClearance {
+		log.Printf("Simulator: the nozzle hit the bed at X%.3f Y%.3f Z%.3f\n", x, y, z)
+		simulator.crashes++
+	}
+	simulator.checkProbe()
+}
+
+// checkProbe triggers the probe if it is extended and has reached the bed. Like the sensor's firmware, the probe retracts when it triggers.
+func (simulator *Simulator) checkProbe() {
+	probeX, probeY := simulator.x+simulator.probeOffsetX, simulator.y+simulator.probeOffsetY
+	if simulator.extended && simulator.z <= simulator.bed.HeightAt(probeX, probeY)+simulator.triggerNoise {
+		simulator.touched = true
+		simulator.extended = false
+	}
+}
+
+// sensorCommand runs a command of the sensor's protocol, returning the reply if there is one.
+func (simulator *Simulator) sensorCommand(command byte) (byte, bool) {
+	simulator.mutex.Lock()
+	defer simulator.mutex.Unlock()
+
+	switch command {
+	case 'e':
+		simulator.extended = true
+		simulator.triggerNoise = simulator.random.NormFloat64() * simulator.bed.Noise
+		simulator.checkProbe()
+	case 'r':
+		simulator.extended = false
+	case 't':
+		// Reading whether it has touched resets it
+		touched := simulator.touched
+		simulator.touched = false
+		if touched {
+			return '1', true
+		}
+		return '0', true
+	}
+	return 0, false
+}
+
+// ServePrinter serves FlashForge's gcode protocol, where each command is "~<gcode>\r\n" and the response is "CMD <code> Received.", any data and "ok".
+func (simulator *Simulator) ServePrinter(listener net.Listener) error {
+	return serve(listener, func(conn net.Conn) error {
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			line = strings.TrimPrefix(strings.TrimSpace(line), "~")
+			response := fmt.Sprintf("CMD %s Received.\r\n", strings.ToUpper(strings.Fields(line + " ")[0]))
+			data, err := simulator.Exec(line)
+			for _, dataLine := range data {
+				response += dataLine + "\r\n"
+			}
+			if err != nil {
+				response += fmt.Sprintf("Error: %v\r\n", err)
+			}
+			if _, err := conn.Write([]byte(response + "ok\r\n")); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// ServeBLTouch serves the sensor's protocol, where 'e' extends the probe, 'r' retracts it and 't' replies '1' if it has touched the bed since it was last asked, otherwise '0'.
+func (simulator *Simulator) ServeBLTouch(listener net.Listener) error {
+	return serve(listener, func(conn net.Conn) error {
+		buffer := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buffer); err != nil {
+				return err
+			}
+			if reply, ok := simulator.sensorCommand(buffer[0]); ok {
+				if _, err := conn.Write([]byte{reply}); err != nil {
+					return err
+				}
+			}
+		}
+	})
+}
+
+// serve handles each connection to the listener until the listener is closed.
+func serve(listener net.Listener, handle func(conn net.Conn) error) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := handle(conn); err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+				log.Println("Simulator:", err)
+			}
+		}()
+	}
+}
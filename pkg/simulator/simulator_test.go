@@ -0,0 +1,270 @@
+package simulator
+
+import (
+	"math"
+	"mesh-levelling/pkg/bltouch"
+	"mesh-levelling/pkg/mesh"
+	"mesh-levelling/pkg/printer"
+	"mesh-levelling/pkg/probing"
+	"mesh-levelling/pkg/profile"
+	"mesh-levelling/pkg/session"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// testBed returns a tilted and warped bed halfway between the profile's MinimumZ and ProbeStartZ, without noise.
+func testBed(printerProfile *profile.Profile) Bed {
+	bed := Bed{
+		Height:     (printerProfile.MinimumZ + printerProfile.ProbeStartZ) / 2,
+		TiltX:      0.002,
+		TiltY:      -0.001,
+		Warp:       0.15,
+		WarpRadius: 100,
+	}
+	bed.CentreX, bed.CentreY = printerProfile.BedCentre()
+	return bed
+}
+
+// connect serves the simulator on loopback ports, and connects to it like the creator does.
+func connect(t *testing.T, simulator *Simulator, printerProfile *profile.Profile) (printer.Printer, *bltouch.BLTouch) {
+	t.Helper()
+	listen := func(serve func(listener net.Listener) error) string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go serve(listener)
+		return listener.Addr().String()
+	}
+	printerProfile.PrinterAddress = listen(simulator.ServePrinter)
+	printerProfile.BLTouchAddress = listen(simulator.ServeBLTouch)
+
+	simulatedPrinter, err := printer.NewPrinter(printerProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { simulatedPrinter.Close() })
+	simulatedBLTouch, err := bltouch.NewBLTouch(printerProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { simulatedBLTouch.Close() })
+	if err := simulatedPrinter.StartingPosition(); err != nil {
+		t.Fatal(err)
+	}
+	return simulatedPrinter, simulatedBLTouch
+}
+
+// checkProbedZ checks that z is where the probe first touches the bed when stepping down by ZStep.
+func checkProbedZ(t *testing.T, printerProfile *profile.Profile, bed Bed, x, y, z, tolerance float64) {
+	t.Helper()
+	height := bed.HeightAt(x, y)
+	if z > height+tolerance+1e-9 || z <= height-printerProfile.ZStep-tolerance {
+		t.Errorf("Z at X%.3f Y%.3f = %.3f, want between %.3f and %.3f", x, y, z, height-printerProfile.ZStep, height)
+	}
+}
+
+func TestGetZAtPoint(t *testing.T) {
+	printerProfile := profile.Default()
+	printerProfile.ProbeOffsetX, printerProfile.ProbeOffsetY = 10, -20
+	bed := testBed(printerProfile)
+	simulator := New(bed, printerProfile, 1)
+	simulatedPrinter, simulatedBLTouch := connect(t, simulator, printerProfile)
+
+	minX, minY, maxX, maxY := printerProfile.ProbeBounds()
+	centreX, centreY := printerProfile.BedCentre()
+	for _, position := range [][2]float64{{centreX, centreY}, {minX, minY}, {maxX, minY}, {minX, maxY}, {maxX, maxY}} {
+		z, err := simulatedBLTouch.GetZAtPoint(simulatedPrinter, position[0], position[1])
+		if err != nil {
+			t.Fatalf("GetZAtPoint(%v) failed: %v", position, err)
+		}
+		checkProbedZ(t, printerProfile, bed, position[0], position[1], z, 0)
+
+		// The nozzle is moved so that the probe is over the position
+		nozzleX, nozzleY, _ := simulator.Position()
+		if wantX, wantY := printerProfile.NozzlePosition(position[0], position[1]); nozzleX != wantX || nozzleY != wantY {
+			t.Errorf("the nozzle probed X%.3f Y%.3f from X%.3f Y%.3f, want X%.3f Y%.3f", position[0], position[1], nozzleX, nozzleY, wantX, wantY)
+		}
+	}
+	if _, err := simulatedBLTouch.GetZAtPoint(simulatedPrinter, maxX+1, maxY); err == nil {
+		t.Error("GetZAtPoint probed where the probe can't reach")
+	}
+	if crashes := simulator.Crashes(); crashes != 0 {
+		t.Errorf("the nozzle hit the bed %d times", crashes)
+	}
+}
+
+func TestProbePoint(t *testing.T) {
+	printerProfile := profile.Default()
+	printerProfile.NumberOfRepeatsPerPoint = 5
+	bed := testBed(printerProfile)
+	bed.Noise = 0.05
+	simulator := New(bed, printerProfile, 1)
+	simulatedPrinter, simulatedBLTouch := connect(t, simulator, printerProfile)
+
+	x, y := 40.0, -30.0
+	point, err := simulatedBLTouch.ProbePoint(simulatedPrinter, x, y)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point.X != x || point.Y != y || len(point.Samples) != 5 {
+		t.Errorf("ProbePoint = %+v, want 5 samples at X%v Y%v", point, x, y)
+	}
+	// The noise partly averages out, so the point is close to the bed even though the samples are spread out
+	checkProbedZ(t, printerProfile, bed, x, y, point.Z, 0.05)
+	if statistics := mesh.CalculateSampleStatistics(point.Samples); point.StandardDeviation != statistics.StandardDeviation || statistics.StandardDeviation == 0 {
+		t.Errorf("StandardDeviation = %v, want %v from noisy samples", point.StandardDeviation, statistics.StandardDeviation)
+	}
+}
+
+func TestCrashes(t *testing.T) {
+	printerProfile := profile.Default()
+	bed := testBed(printerProfile)
+	simulator := New(bed, printerProfile, 1)
+	height := bed.HeightAt(bed.CentreX, bed.CentreY)
+
+	for _, line := range []string{"G90", "G1 X0 Y0 Z100", "G1 Z60"} {
+		if _, err := simulator.Exec(line); err != nil {
+			t.Fatalf("Exec(%s) failed: %v", line, err)
+		}
+	}
+	if crashes := simulator.Crashes(); crashes != 0 {
+		t.Errorf("Crashes = %d above the bed", crashes)
+	}
+	// The nozzle can go a little below where the probe touches without hitting the bed
+	if _, err := simulator.Exec("G1 Z" + formatZ(height-nozzleClearance+0.1)); err != nil {
+		t.Fatal(err)
+	}
+	if crashes := simulator.Crashes(); crashes != 0 {
+		t.Errorf("Crashes = %d just above the bed", crashes)
+	}
+	for _, line := range []string{"G1 Z" + formatZ(height-nozzleClearance-0.1), "G91", "G1 Z-1", "G1 Z10"} {
+		if _, err := simulator.Exec(line); err != nil {
+			t.Fatalf("Exec(%s) failed: %v", line, err)
+		}
+	}
+	if crashes := simulator.Crashes(); crashes != 2 {
+		t.Errorf("Crashes = %d, want 2", crashes)
+	}
+	if _, err := simulator.Exec("G29"); err == nil {
+		t.Error("an unknown command was accepted")
+	}
+}
+
+func formatZ(z float64) string {
+	return strconv.FormatFloat(z, 'f', 3, 64)
+}
+
+func TestMinimumZ(t *testing.T) {
+	printerProfile := profile.Default()
+	// The bed is lower than the probe is allowed to go
+	bed := testBed(printerProfile)
+	bed.Height = printerProfile.MinimumZ - 1
+	simulator := New(bed, printerProfile, 1)
+	simulatedPrinter, simulatedBLTouch := connect(t, simulator, printerProfile)
+
+	if _, err := simulatedPrinter.MoveZ(printerProfile.MinimumZ-0.5, printerProfile.SpeedZFast); err == nil {
+		t.Error("MoveZ went below MinimumZ")
+	}
+	if _, _, z := simulator.Position(); z != printerProfile.SafeZ {
+		t.Errorf("the nozzle moved to Z%.3f after refusing to go below MinimumZ", z)
+	}
+
+	x, y := printerProfile.BedCentre()
+	if _, err := simulatedBLTouch.GetZAtPoint(simulatedPrinter, x, y); err == nil {
+		t.Error("GetZAtPoint found a bed below MinimumZ")
+	}
+	if _, _, z := simulator.Position(); z < printerProfile.MinimumZ {
+		t.Errorf("the nozzle went down to Z%.3f, below MinimumZ %.3f", z, printerProfile.MinimumZ)
+	}
+	if crashes := simulator.Crashes(); crashes != 0 {
+		t.Errorf("the nozzle hit the bed %d times", crashes)
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	printerProfile := profile.Default()
+	printerProfile.NumberOfPointsX, printerProfile.NumberOfPointsY = 3, 3
+	bed := testBed(printerProfile)
+	simulator := New(bed, printerProfile, 1)
+	simulatedPrinter, simulatedBLTouch := connect(t, simulator, printerProfile)
+
+	grid, err := probing.Grid(printerProfile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions := grid.Positions()
+	sessionFilename := filepath.Join(t.TempDir(), "session.json")
+	if probingSession, err := probing.LoadSession(sessionFilename, grid, false); probingSession != nil || err != nil {
+		t.Fatalf("LoadSession without a session = %v, %v, want nothing to resume", probingSession, err)
+	}
+
+	// Probing was interrupted after 4 points, which were recorded 1mm higher so that they can be told apart from probed points
+	interruptedSession := session.New(sessionFilename, grid, 60)
+	for _, position := range positions[:4] {
+		if err := interruptedSession.AddPoint(mesh.Point{X: position.X, Y: position.Y, Z: bed.HeightAt(position.X, position.Y) + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	probingSession, err := probing.LoadSession(sessionFilename, grid, false)
+	if err != nil || probingSession == nil {
+		t.Fatalf("LoadSession = %v, %v, want the interrupted session", probingSession, err)
+	}
+	if len(probingSession.Points) != 4 || probingSession.BedTemperature != 60 {
+		t.Errorf("the session has %d points at %v°C, want 4 at 60°C", len(probingSession.Points), probingSession.BedTemperature)
+	}
+	resultingMesh, err := probing.ProbeMesh(simulatedPrinter, simulatedBLTouch, printerProfile, probingSession, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resultingMesh.Points) != len(positions) {
+		t.Fatalf("the mesh has %d points, want %d", len(resultingMesh.Points), len(positions))
+	}
+	var averageZ float64
+	for i, point := range resultingMesh.Points {
+		if i < 4 {
+			if want := bed.HeightAt(point.X, point.Y) + 1; point.Z != want {
+				t.Errorf("point %d was probed again: Z%.3f, want the saved Z%.3f", i, point.Z, want)
+			}
+		} else {
+			checkProbedZ(t, printerProfile, bed, point.X, point.Y, point.Z, 0)
+		}
+		averageZ += point.Z
+	}
+	if averageZ /= float64(len(positions)); math.Abs(resultingMesh.BLTouchHeight-averageZ) > 1e-9 {
+		t.Errorf("BLTouchHeight = %v, want the average Z %v", resultingMesh.BLTouchHeight, averageZ)
+	}
+	if resultingMesh.Metadata.BedTemperature != 60 {
+		t.Errorf("BedTemperature = %v, want the session's", resultingMesh.Metadata.BedTemperature)
+	}
+
+	// Every point was saved as it was probed
+	savedSession, err := session.Load(sessionFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(savedSession.Points) != len(positions) {
+		t.Errorf("the saved session has %d points, want %d", len(savedSession.Points), len(positions))
+	}
+
+	// A session can't be resumed with a different grid, but can be restarted
+	printerProfile.NumberOfPointsX = 4
+	otherGrid, err := probing.Grid(printerProfile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := probing.LoadSession(sessionFilename, otherGrid, false); err == nil {
+		t.Error("a session was resumed with a different grid")
+	}
+	if probingSession, err := probing.LoadSession(sessionFilename, otherGrid, true); probingSession != nil || err != nil {
+		t.Errorf("LoadSession with restart = %v, %v, want a new session", probingSession, err)
+	}
+	if crashes := simulator.Crashes(); crashes != 0 {
+		t.Errorf("the nozzle hit the bed %d times", crashes)
+	}
+}